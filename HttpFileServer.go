@@ -166,6 +166,7 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	case "image/jpeg", "image/jpg":
 	case "image/gif", "image/png":
 	case "application/pdf":
+	case "application/x-gzip":
 	case "application/octet-stream":
 	case "text/plain; charset=utf-8":
 		break
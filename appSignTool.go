@@ -13,6 +13,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -20,6 +21,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"appsign"
 )
 
 const privateKey string = `
@@ -50,21 +53,31 @@ appSingTool -f folder -b app-name -l lib -e directory -v SV01.001 -o package nam
 -e: extended directory, multiple groups
 -v: default value SV01.001
 -o: output app package name
+-hook: hook script, name=script, name: prestart|poststop|preinstall|postinstall, multiple groups
+-hooktimeout: hook script timeout seconds, default 30, limited below the daemon stalltimeout
+-depend: app name this app depends on, stopped after this app, multiple groups
+-stoptimeout: seconds to wait after SIGTERM before SIGKILL on daemon shutdown
 
 example:
 appSignTool -f /usr/local/app -b hello -l /usr/local/app/lib -e /usr/local/app/data -v SV01.001 -o app
+appSignTool -f /usr/local/app -b hello -hook preinstall=/usr/local/app/migrate.sh -hook prestart=/usr/local/app/setup.sh -o app
 `
 const defAppVersion string = "SV01.001"
 const defAppVersionFile string = "version.cfg"
 const defAppSignFile string = "sign.cfg"
 const defAppCfgFile string = "app.cfg"
+const defAppHooksFolder string = "hooks"
 
 var gAppPackagePath string
 
 type appCfg struct {
-	AppName string `json:"appname"`
-	BinName string `json:"binname"`
-	LibPath string `json:"libpath"`
+	AppName     string            `json:"appname"`
+	BinName     string            `json:"binname"`
+	LibPath     string            `json:"libpath"`
+	Hooks       map[string]string `json:"hooks,omitempty"`
+	HookTimeout int               `json:"hooktimeout,omitempty"`
+	Depends     []string          `json:"depends,omitempty"`
+	StopTimeout int               `json:"stoptimeout,omitempty"`
 }
 
 type StringArray []string
@@ -89,6 +102,12 @@ func main() {
 	flagSet.Var(&ext, "e", "e")
 	ver := flagSet.String("v", "SV01.001", "app version")
 	out := flagSet.String("o", "", "output file")
+	hooks := StringArray{}
+	flagSet.Var(&hooks, "hook", "hook script")
+	hookTimeout := flagSet.Int("hooktimeout", 0, "hook script timeout seconds")
+	depends := StringArray{}
+	flagSet.Var(&depends, "depend", "depend app name")
+	stopTimeout := flagSet.Int("stoptimeout", 0, "stop timeout seconds")
 	flagSet.Parse(os.Args[1:])
 
 	if len(*fn) < 1 || len(*bin) < 1 {
@@ -96,6 +115,16 @@ func main() {
 		return
 	}
 
+	hookMap := make(map[string]string)
+	for _, v := range hooks {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || false == isHookName(kv[0]) || false == pathExists(kv[1]) {
+			fmt.Printf("%s invalid hook.\n", v)
+			return
+		}
+		hookMap[kv[0]] = kv[1]
+	}
+
 	binPath := filepath.Join(*fn, *bin)
 	if false == pathExists(binPath) {
 		fmt.Printf("%s File not exist.", binPath)
@@ -139,6 +168,8 @@ func main() {
 	cfg := appCfg{}
 	cfg.AppName = appName
 	cfg.BinName = *bin
+	cfg.Depends = depends
+	cfg.StopTimeout = *stopTimeout
 
 	progPath := filepath.Join(gAppPackagePath, "bin")
 	err = copyDir(*fn, progPath)
@@ -167,6 +198,26 @@ func main() {
 		}
 	}
 
+	// 钩子脚本统一放到包内 hooks 目录，app.cfg 中记录相对路径
+	if len(hookMap) > 0 {
+		hookPath := filepath.Join(gAppPackagePath, defAppHooksFolder)
+		err = os.MkdirAll(hookPath, 0755)
+		if err != nil {
+			fmt.Println("make hooks dir err: ", err)
+			return
+		}
+		cfg.Hooks = make(map[string]string)
+		for k, v := range hookMap {
+			_, err = copyFile(v, filepath.Join(hookPath, path.Base(v)))
+			if err != nil {
+				fmt.Println("copy hook file error: ", err)
+				return
+			}
+			cfg.Hooks[k] = defAppHooksFolder + "/" + path.Base(v)
+		}
+		cfg.HookTimeout = *hookTimeout
+	}
+
 	err = genVersionFile(*ver)
 	if err != nil {
 		return
@@ -178,8 +229,9 @@ func main() {
 	}
 
 	binPath = filepath.Join(gAppPackagePath, "bin/"+*bin)
-	err = rsaSign(binPath)
+	err = rsaSign(binPath, &cfg)
 	if err != nil {
+		fmt.Println("sign error: ", err)
 		return
 	}
 
@@ -218,6 +270,14 @@ func getCurrentPath() string {
 	return execDir + "/"
 }
 
+func isHookName(name string) bool {
+	switch name {
+	case "prestart", "poststop", "preinstall", "postinstall":
+		return true
+	}
+	return false
+}
+
 func pathExists(filename string) bool {
 	var exist = true
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -243,8 +303,26 @@ func getAppHashBytes(name string) []byte {
 	return md5hash.Sum(nil)
 }
 
-func rsaSign(name string) error {
+// 签名内容见 appsign.Digest，app.cfg 只签 appsign.SignedKeys 中的字段，钩子脚本路径相对包目录
+func getAppSignBytes(name string, cfg *appCfg) ([]byte, error) {
 	data := getAppHashBytes(name)
+	if data == nil {
+		return nil, errors.New(name + " hash error")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(gAppPackagePath, defAppCfgFile))
+	if err != nil {
+		return nil, err
+	}
+	return appsign.Digest(data, content, cfg.Hooks, func(script string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(gAppPackagePath, script))
+	})
+}
+
+func rsaSign(name string, cfg *appCfg) error {
+	data, err := getAppSignBytes(name, cfg)
+	if err != nil {
+		return err
+	}
 	h := sha256.New()
 	h.Write(data)
 	hashed := h.Sum(nil)
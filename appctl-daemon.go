@@ -1,53 +1,102 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
-	"crypto"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-)
+	"unsafe"
 
-const publicKey string = `
------BEGIN PUBLIC KEY-----
-MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDEdXD28RmWo8rWJu2FleiAG6wV
-Gy6O0JH0achNiFuFyhf+5AQcA4KVXaJP5UmeLpYoRIR/Apm10HoE11mPSo/fIaFF
-biJc1FfksFBv3QmE4ecbTtpwv70P9lyr2pBVT4n+TL9Vxu+qLfbraUHA/MLh+csJ
-LILyqkMGP2KAQJhVgQIDAQAB
------END PUBLIC KEY-----
-`
+	"appsign"
+	"github.com/ghodss/yaml"
+	"supervisor"
+)
 
 const version string = "1.31"
 const cfgFile string = "monitor.cfg"
+const defDesiredFile string = "desired.yaml"
+const defReconcileTime time.Duration = 30 * time.Second
+const defReconcileBackoffMax time.Duration = time.Hour
+const defStatsFolder string = "stats"
+const defStatsRawSize int = 3600
+const defStatsMinuteSize int = 7 * 24 * 60
+const defStatsTrendSize int = 10
 const defAppVersionFile string = "version.cfg"
 const defAppSignFile string = "sign.cfg"
 const defAppCfgFile string = "app.cfg"
 const defAppEventFile string = "event.log"
+const defAppEventFileSize int64 = 512 * 1024
+const defAppEventFileBackups int = 3
+const defAppEventPageSize int = 50
+const defAppEventPageMax int = 80
+
+// 一页事件的 JSON 大小上限，appctl 的响应缓冲区为 64K，事件中可能带有 4K 的钩子输出
+const defAppEventPageBytes int = 48 * 1024
+const defDownloadRetry int = 5
+const defDownloadProgressTime time.Duration = 2 * time.Second
+const defDownloadTimeout time.Duration = 30 * time.Second
+const defDownloadIdleTime time.Duration = 60 * time.Second
 const defAppsFolder string = "/usr/local/apps"
 const defAppsExtFolder string = "/usr/local/extapps"
+const defAppsLogFolder string = "/var/log/extapps"
 const defCPUThreshold int = 90
 const defMemThreshold int = 90
 const defCPULimit int = 90
 const defMemLimit int = 90
+const defDiskThreshold int = 512
+const defDiskCheckTime time.Duration = 60 * time.Second
+
+// 重启不会释放磁盘空间，连续超过磁盘门限重启这么多次后只告警不再重启
+const defDiskRestartMax int = 3
+const defHookTimeout time.Duration = 30 * time.Second
+const defHookOutputSize int = 4096
+const defHookPreStart string = "prestart"
+const defHookPostStop string = "poststop"
+const defHookPreInstall string = "preinstall"
+const defHookPostInstall string = "postinstall"
+const defLoopWarnTime time.Duration = 10 * time.Second
+const defLoopStallTime time.Duration = 120 * time.Second
+const defRestartEnv string = "APPCTL_DAEMON_RESTARTS"
+const defShutdownStop string = "stop"
+const defShutdownDetach string = "detach"
+const defShutdownGrace time.Duration = 10 * time.Second
+const defShutdownTimeout time.Duration = 120 * time.Second
+const defAccessFile string = "access.cfg"
+const defAuditFile string = "audit.log"
+const defDumpWait time.Duration = 2 * time.Second
+const defDumpFolder string = "/var/log/extapps-dump"
+const defDumpKeep int = 5
+const defDumpOutputSize int64 = 4 * 1024 * 1024
 
 type AppCmdType int8
 
@@ -71,6 +120,20 @@ const (
 	APP_CTL_QUERY_MEM_LIMIT
 	APP_CTL_QUERY_ALL_RESOURCE
 	APP_CTL_LOGS
+	APP_CTL_CONFIG_DISK_THRESHOLD
+	APP_CTL_QUERY_DISK_THRESHOLD
+	APP_CTL_QUERY_DISK
+	APP_CTL_EVENTS
+	APP_CTL_INSTALL_URL
+	APP_CTL_INSTALL_PROGRESS
+	APP_CTL_EXPORT
+	APP_CTL_IMPORT
+	APP_CTL_RECONCILE_STATUS
+	APP_CTL_STATS
+	APP_CTL_DAEMON_STATUS
+	APP_CTL_RELOAD
+	APP_CTL_EXEC
+	APP_CTL_DUMP
 )
 
 const (
@@ -79,6 +142,47 @@ const (
 	APP_CMD_STOP
 )
 
+// 权限策略中使用的命令名，与 appctl 参数一致
+var gCmdNames = map[AppCmdType]string{
+	APP_CTL_INSTALL:               "install",
+	APP_CTL_START:                 "start",
+	APP_CTL_STOP:                  "stop",
+	APP_CTL_ENABLE:                "enable",
+	APP_CTL_DISABLE:               "disable",
+	APP_CTL_RM:                    "rm",
+	APP_CTL_LIST:                  "list",
+	APP_CTL_VERSION:               "version",
+	APP_CTL_CONFIG_CPU_THRESHOLD:  "cpu",
+	APP_CTL_CONFIG_MEM_THRESHOLD:  "mem",
+	APP_CTL_QUERY_CPU_THRESHOLD:   "query",
+	APP_CTL_QUERY_MEM_THRESHOLD:   "query",
+	APP_CTL_CONFIG_CPU_LIMIT:      "cpulimit",
+	APP_CTL_CONFIG_MEM_LIMIT:      "memlimit",
+	APP_CTL_QUERY_CPU_LIMIT:       "query",
+	APP_CTL_QUERY_MEM_LIMIT:       "query",
+	APP_CTL_QUERY_ALL_RESOURCE:    "queryall",
+	APP_CTL_LOGS:                  "logs",
+	APP_CTL_CONFIG_DISK_THRESHOLD: "disk",
+	APP_CTL_QUERY_DISK_THRESHOLD:  "query",
+	APP_CTL_QUERY_DISK:            "query",
+	APP_CTL_EVENTS:                "events",
+	APP_CTL_INSTALL_URL:           "install",
+	APP_CTL_EXPORT:                "export",
+	APP_CTL_IMPORT:                "import",
+	APP_CTL_RECONCILE_STATUS:      "reconcile",
+	APP_CTL_STATS:                 "stats",
+	APP_CTL_DAEMON_STATUS:         "daemon",
+	APP_CTL_RELOAD:                "reload",
+	APP_CTL_EXEC:                  "exec",
+	APP_CTL_DUMP:                  "dump",
+}
+
+// 没有 access.cfg 或未配置 default 时非 root 用户只允许只读命令
+var gReadOnlyCmds = []string{"list", "version", "query", "queryall", "logs", "events", "export", "reconcile", "stats", "daemon"}
+
+// 安装包名会拼进本地路径，只允许普通文件名
+var gPackageName = regexp.MustCompile(`^[A-Za-z0-9._-]+\.(tar\.gz|tgz|tar)$`)
+
 const (
 	_ AppCmdType = iota
 	APP_STATUS_INSTALL
@@ -91,20 +195,60 @@ var (
 	gUnixConn       *net.UnixConn
 	gUDPConn        net.Conn
 	gTaskChan       chan *taskCmd
+	gHookChan       chan *hookJob
+	gInstalling     = make(map[string]bool)
 	gTaskList       []taskItem
 	gWaitTime       time.Duration
 	gTraceTime      time.Time
 	gCPUThreshold   int
 	gMemThreshold   int
+	gDiskThreshold  int
+	gDiskTraceTime  time.Time
 	gAppCurrentPath string
 	gContainerID    string
+	gDownloadMutex  sync.Mutex
+	gDownloadList   = make(map[string]bool)
+	gDownloadError  = make(map[string]string)
+	gDownloadIdle   = defDownloadIdleTime
+	gDesiredTime    time.Time
+	gReconcileTime  time.Time
+	gReconcileList  reconcileStatusList
+	gReconcileRetry = make(map[string]*reconcileBackoff)
+	gStatsPersist   bool
+	gStatsList      = make(map[string]*appStats)
+	gStartTime      time.Time
+	gRestarts       int
+	gStallTimeout   time.Duration
+	gLoopBusy       int64
+	gLoopLastLag    int64
+	gLoopMaxLag     int64
+	gLoopCount      int64
+	gErrorMutex     sync.Mutex
+	gErrorList      = make(map[string]daemonError)
+	gOrphanList     []int
+	gShutdownMode   string
+	gShutdownGrace  time.Duration
+	gShutdown       int32
+	gShutdownChan   = make(chan bool, 1)
+	gShutdownDone   = make(chan bool)
+	gDetached       bool
+	gAccessTime     time.Time
+	gAccessPolicy   *accessPolicy
 )
 
 type appCtlCmdReq struct {
-	Cmd   AppCmdType
-	Name  string
-	Log   int8
-	Value int
+	Cmd    AppCmdType
+	Name   string
+	Log    int8
+	Value  int
+	Kind   string
+	Since  int64
+	Until  int64
+	Offset int
+	Limit  int
+	URL    string
+	Sha256 string
+	Data   []byte
 }
 
 type appCtlCmdRsp struct {
@@ -127,6 +271,8 @@ type srvItem struct {
 	MemThreshold  int
 	MemLimit      int
 	MemUsage      int
+	DiskThreshold int
+	DiskUsage     int
 	StartTime     int64
 	LogsStartTime int64
 	LogsEndTime   int64
@@ -143,37 +289,109 @@ type appItem struct {
 }
 
 type taskItem struct {
-	Pid          int    `json:"pid"`
-	Name         string `json:"name"`
-	Path         string `json:"path"`
-	Cmd          int    `json:"cmd"`
-	Status       int    `json:"status"`
-	Enable       int    `json:"enable"`
-	StartTime    int64  `json:"starttime"`
-	LogStartTime int64  `json:"logstarttime`
-	LogEndTime   int64  `json:"logendtime"`
-	CPUThreshold int    `json:"cputhreshold"`
-	MemThreshold int    `json:"memthreshold"`
-	CPULimit     int    `json:"cpulimit"`
-	MemLimit     int    `json:"memlimit"`
-	CPURate      int    `json:"cpurate"`
-	MemRate      int    `json:"memrate"`
-	Version      string `json:"version"`
-	Hash         string `json:"hash"`
-	Param        string `json:"param"`
-	LogFile      string `json:"logfile"`
-	cfg          appCfg
+	Pid           int    `json:"pid"`
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	Cmd           int    `json:"cmd"`
+	Status        int    `json:"status"`
+	Enable        int    `json:"enable"`
+	StartTime     int64  `json:"starttime"`
+	LogStartTime  int64  `json:"logstarttime`
+	LogEndTime    int64  `json:"logendtime"`
+	CPUThreshold  int    `json:"cputhreshold"`
+	MemThreshold  int    `json:"memthreshold"`
+	CPULimit      int    `json:"cpulimit"`
+	MemLimit      int    `json:"memlimit"`
+	CPURate       int    `json:"cpurate"`
+	MemRate       int    `json:"memrate"`
+	DiskThreshold int    `json:"diskthreshold"`
+	DiskUsage     int    `json:"diskusage"`
+	Version       string `json:"version"`
+	Hash          string `json:"hash"`
+	Package       string `json:"package"`
+	URL           string `json:"url"`
+	Param         string `json:"param"`
+	LogFile       string `json:"logfile"`
+	cfg           appCfg
+	diskRestarts  int
+	starting      bool
+
+	// imageCreator 预装时写入，首次加载执行后清空
+	PendingHooks []string `json:"pendinghooks,omitempty"`
 }
 
 type taskList struct {
-	CPUThreshold int        `json:"cputhreshold"`
-	MemThreshold int        `json:"memthreshold"`
-	Items        []taskItem `json:"items"`
+	CPUThreshold  int        `json:"cputhreshold"`
+	MemThreshold  int        `json:"memthreshold"`
+	DiskThreshold int        `json:"diskthreshold"`
+	StatsPersist  bool       `json:"statspersist"`
+	StallTimeout  int        `json:"stalltimeout,omitempty"`
+	Shutdown      string     `json:"shutdown,omitempty"`
+	ShutdownGrace int        `json:"shutdowngrace,omitempty"`
+	Detached      bool       `json:"detached,omitempty"`
+	Items         []taskItem `json:"items"`
 }
 
 type taskCmd struct {
 	remote *net.UnixAddr
 	req    appCtlCmdReq
+	next   *taskCmd
+	done   func()
+}
+
+// 钩子在 handleHooks 中执行，done 通过 gTaskChan 回到主循环调用
+type hookJob struct {
+	name string
+	cfg  appCfg
+	hook string
+	env  []string
+	done func(out string, code int, err error)
+}
+
+// uid/gid 都不填的规则匹配所有用户，commands 为 appctl 命令名，"*" 表示全部
+type accessRule struct {
+	Uid      *int     `json:"uid,omitempty"`
+	Gid      *int     `json:"gid,omitempty"`
+	Commands []string `json:"commands"`
+}
+
+type accessPolicy struct {
+	Default []string     `json:"default"`
+	Rules   []accessRule `json:"rules"`
+}
+
+type auditRecord struct {
+	Time int64  `json:"time"`
+	Pid  int32  `json:"pid"`
+	Uid  int64  `json:"uid"`
+	Gid  int64  `json:"gid"`
+	Cmd  string `json:"cmd"`
+	Name string `json:"name,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+type daemonError struct {
+	Time    int64  `json:"time"`
+	Message string `json:"message"`
+}
+
+// 守护进程自身状态，looplag 为主循环当前处理耗时，单位毫秒
+type daemonStatus struct {
+	Version      string                 `json:"version"`
+	Pid          int                    `json:"pid"`
+	StartTime    int64                  `json:"starttime"`
+	Uptime       int64                  `json:"uptime"`
+	Restarts     int                    `json:"restarts"`
+	LoopCount    int64                  `json:"loopcount"`
+	LoopLag      int64                  `json:"looplag"`
+	LoopLastLag  int64                  `json:"looplastlag"`
+	LoopMaxLag   int64                  `json:"loopmaxlag"`
+	StallTimeout int64                  `json:"stalltimeout"`
+	Watchdog     int64                  `json:"watchdog"`
+	Goroutines   int                    `json:"goroutines"`
+	QueueDepth   int                    `json:"queuedepth"`
+	QueueSize    int                    `json:"queuesize"`
+	Errors       map[string]daemonError `json:"errors"`
 }
 
 type warnNotify struct {
@@ -182,18 +400,178 @@ type warnNotify struct {
 	Kind      string `json:"kind"`
 	Value     int    `json:"value"`
 	Threshold int    `json:"threshold"`
+	Trend     []int  `json:"trend,omitempty"`
+}
+
+// 资源采样，分钟记录中 CPU/Mem 为平均值，CPUMax/MemMax 为最大值
+type resSample struct {
+	Time   int64
+	CPU    int16
+	CPUMax int16
+	Mem    int16
+	MemMax int16
+	Disk   int32
+}
+
+type sampleRing struct {
+	items []resSample
+	pos   int
+	full  bool
+}
+
+// 秒级采样保留 defStatsRawSize 个，按分钟降采样后保留 defStatsMinuteSize 个
+type appStats struct {
+	raw    sampleRing
+	minute sampleRing
+	cur    resSample
+	count  int
+	cpuSum int
+	memSum int
+}
+
+type statsValue struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+	P95 int `json:"p95"`
+}
+
+type appStatsResult struct {
+	Name       string     `json:"name"`
+	Since      int64      `json:"since"`
+	Samples    int        `json:"samples"`
+	Resolution string     `json:"resolution"`
+	CPU        statsValue `json:"cpu"`
+	Mem        statsValue `json:"mem"`
+	Disk       statsValue `json:"disk"`
+}
+
+type appEvent struct {
+	Time    int64          `json:"time"`
+	App     string         `json:"app"`
+	Kind    string         `json:"kind"`
+	Message string         `json:"message"`
+	Values  map[string]int `json:"values,omitempty"`
+}
+
+type appEventPage struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Items  []appEvent `json:"items"`
+}
+
+type appState struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	Hash          string `json:"hash"`
+	Package       string `json:"package,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Sha256        string `json:"sha256,omitempty"`
+	Enable        *int   `json:"enable,omitempty"`
+	Start         *bool  `json:"start,omitempty"`
+	CPUThreshold  int    `json:"cputhreshold"`
+	MemThreshold  int    `json:"memthreshold"`
+	DiskThreshold int    `json:"diskthreshold"`
+	CPULimit      int    `json:"cpulimit"`
+	MemLimit      int    `json:"memlimit"`
+
+	//安装、下载连续失败后在 retry 之前不再重试，只由 checkDesiredState 设置
+	hold  bool
+	retry time.Time
+}
+
+// desired.yaml 中每个应用连续需要安装、下载的次数
+type reconcileBackoff struct {
+	fails int
+	next  time.Time
+}
+
+type daemonState struct {
+	Version       string     `json:"version"`
+	Cid           string     `json:"cid"`
+	Time          int64      `json:"time"`
+	CPUThreshold  int        `json:"cputhreshold"`
+	MemThreshold  int        `json:"memthreshold"`
+	DiskThreshold int        `json:"diskthreshold"`
+	Policies      *policies  `json:"policies,omitempty"`
+	Apps          []appState `json:"apps"`
+}
+
+// 守护进程的运行策略，与 monitor.cfg 中的同名字段对应，未填写的字段保持当前值
+type policies struct {
+	Shutdown      string `json:"shutdown,omitempty"`
+	ShutdownGrace int    `json:"shutdowngrace,omitempty"`
+	StallTimeout  int    `json:"stalltimeout,omitempty"`
+	StatsPersist  *bool  `json:"statspersist,omitempty"`
+}
+
+type reconcileAction struct {
+	App string
+	Op  string
+	Msg string
+}
+
+type reconcileStatus struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+}
+
+type reconcileStatusList struct {
+	File  string            `json:"file"`
+	Error string            `json:"error"`
+	Time  int64             `json:"time"`
+	Items []reconcileStatus `json:"items"`
 }
 
 type appCfg struct {
-	AppName string `json:"appname"`
-	BinName string `json:"binname"`
-	LibPath string `json:"libpath"`
+	AppName     string            `json:"appname"`
+	BinName     string            `json:"binname"`
+	LibPath     string            `json:"libpath"`
+	Hooks       map[string]string `json:"hooks,omitempty"`
+	HookTimeout int               `json:"hooktimeout,omitempty"`
+	Depends     []string          `json:"depends,omitempty"`
+	StopTimeout int               `json:"stoptimeout,omitempty"`
+
+	Args          []string `json:"args,omitempty"`
+	Env           []string `json:"env,omitempty"`
+	CPUThreshold  int      `json:"cputhreshold,omitempty"`
+	MemThreshold  int      `json:"memthreshold,omitempty"`
+	DiskThreshold int      `json:"diskthreshold,omitempty"`
+	CPULimit      int      `json:"cpulimit,omitempty"`
+	MemLimit      int      `json:"memlimit,omitempty"`
+	NoNotify      bool     `json:"nonotify,omitempty"`
+}
+
+// appctl -exec 在客户端本地执行，守护进程只返回应用的工作目录、环境变量和资源限制
+type appExecSpec struct {
+	Name   string      `json:"name"`
+	Pid    int         `json:"pid"`
+	Dir    string      `json:"dir"`
+	Env    []string    `json:"env"`
+	Limits []appRlimit `json:"limits"`
+}
+
+type appRlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
+}
+
+type appCfgChange struct {
+	Name    string
+	Old     string
+	New     string
+	Restart bool
 }
 
 type appResource struct {
-	Name         string `json:"name"`
-	CPUThreshold int    `json:"cputhreshold`
-	MemThreshold int    `json:"memthreshold"`
+	Name          string `json:"name"`
+	CPUThreshold  int    `json:"cputhreshold"`
+	MemThreshold  int    `json:"memthreshold"`
+	DiskThreshold int    `json:"diskthreshold"`
+	DiskUsage     int    `json:"diskusage"`
 }
 
 type appResourceList struct {
@@ -201,6 +579,11 @@ type appResourceList struct {
 }
 
 func main() {
+	gStartTime = time.Now()
+	gRestarts, _ = strconv.Atoi(os.Getenv(defRestartEnv))
+	if gRestarts > 0 {
+		gOrphanList = supervisor.ChildPids()
+	}
 	gAppCurrentPath = getCurrentPath()
 	log.Printf("appctl-daemon version %s, path: %s\n", version, gAppCurrentPath)
 	gContainerID = getContainerID()
@@ -208,6 +591,7 @@ func main() {
 
 	gCPUThreshold = defCPUThreshold
 	gMemThreshold = defMemThreshold
+	gDiskThreshold = defDiskThreshold
 
 	if _, err := os.Stat(defAppsFolder); os.IsNotExist(err) {
 		// 必须分成两步：先创建文件夹、再修改权限
@@ -237,6 +621,11 @@ func main() {
 		log.Println("listen error: ", err)
 		return
 	}
+	err = setPassCred(gUnixConn)
+	if err != nil {
+		log.Println("set SO_PASSCRED error: ", err)
+		return
+	}
 	defer func() {
 		gUnixConn.Close()
 		//os.Remove("/var/run/appctl-daemon.sock")
@@ -256,22 +645,38 @@ func main() {
 		//等待SIGINT或SIGKILL：
 		sig := <-c
 		log.Println("Caught signal：shutting down ", sig)
+		sdNotify("STOPPING=1")
 		//停止监听（如果unix类型，则取消套接字连接）：
 		gUnixConn.Close()
 		//os.Remove("/var/run/appctl-daemon.sock")
+		//交给主循环按配置停止或脱离应用，再次收到信号或超时直接退出
+		atomic.StoreInt32(&gShutdown, 1)
+		gShutdownChan <- true
+		select {
+		case <-gShutdownDone:
+		case sig = <-c:
+			log.Println("Caught signal again：exit now ", sig)
+		case <-time.After(defShutdownTimeout):
+			log.Println("shutdown timeout：exit now")
+		}
 		//我们完成了：
 		os.Exit(0)
 	}(sig)
 
 	gTaskChan = make(chan *taskCmd, 50)
+	gHookChan = make(chan *hookJob, 50)
 	execBashCmd("tar -zxvf /home/lib.tar.gz -C /")
 	//os.Setenv("LD_LIBRARY_PATH", "/lib:/usr/lib:/home/zxlib")
 	//log.Println(os.Getenv("LD_LIBRARY_PATH"))
 
 	loadAppList()
 	go handleTask()
+	go handleHooks()
 	go readUnixgram()
+	go handleWatchdog()
+	go watchAppCfg()
 
+	sdNotify("READY=1")
 	log.Println("appctl-daemon start service")
 	select {}
 }
@@ -284,15 +689,12 @@ func checkFileIsExist(filename string) bool {
 	return exist
 }
 
-//0,1,2为系统进程
 func isAlive(pid int) bool {
-	if pid < 3 {
+	// 看门狗重启前启动的子进程退出后成为僵尸，需要在这里回收
+	if gRestarts > 0 && supervisor.Reap(pid) {
 		return false
 	}
-	if err := syscall.Kill(pid, 0); err == nil {
-		return true
-	}
-	return false
+	return supervisor.IsAlive(pid)
 }
 
 func readFile() ([]byte, error) {
@@ -316,80 +718,138 @@ func readFile() ([]byte, error) {
 func writeFile(lst *taskList) error {
 	lst.CPUThreshold = gCPUThreshold
 	lst.MemThreshold = gMemThreshold
-
-	data, err := json.Marshal(&lst)
+	lst.DiskThreshold = gDiskThreshold
+	lst.StatsPersist = gStatsPersist
+	lst.StallTimeout = int(gStallTimeout / time.Second)
+	lst.Shutdown = gShutdownMode
+	lst.ShutdownGrace = int(gShutdownGrace / time.Second)
+	lst.Detached = gDetached
+
+	err := supervisor.WriteState(filepath.Join(gAppCurrentPath, cfgFile), lst)
 	if err != nil {
-		log.Println("writeFile masshal error:", err)
-		return err
+		log.Println("writeFile error:", err)
 	}
+	return err
+}
 
-	path := filepath.Join(gAppCurrentPath, cfgFile)
-	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Println("writeFile openfile error:", err.Error())
-		return err
+// 事件类型取消息的第一个单词，如 install、start、restart
+func writeAppEventLog(item *taskItem, format string, v ...interface{}) {
+	str := fmt.Sprintf(format, v...)
+	kind := ""
+	if fields := strings.Fields(str); len(fields) > 0 {
+		kind = fields[0]
 	}
-	defer fd.Close()
-	fd.Write(data)
-	fd.Sync()
-
-	return nil
+	writeAppEvent(item, kind, nil, str)
 }
 
-func writeAppEventLog(item *taskItem, format string, v ...interface{}) {
+func writeAppEvent(item *taskItem, kind string, values map[string]int, msg string) {
 	if item == nil {
-		log.Println("writeAppEventLog: item nil")
+		log.Println("writeAppEvent: item nil")
 		return
 	}
-	path := filepath.Join(defAppsExtFolder, item.Name)
-	fn := filepath.Join(path, defAppEventFile)
+	fn := getAppEventLogFile(item.Name)
+	rotateAppEventLog(fn)
 	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		log.Println("writeAppEventLog: ", err.Error())
+		log.Println("writeAppEvent: ", err.Error())
 		return
 	}
 	defer fd.Close()
 
+	ev := appEvent{}
+	ev.Time = time.Now().Unix()
+	ev.App = item.Name
+	ev.Kind = kind
+	ev.Message = msg
+	ev.Values = values
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		log.Println("writeAppEvent marshal error:", err)
+		return
+	}
+
 	item.LogFile = fn
-	str := fmt.Sprintf(format, v...)
-	fd.WriteString(time.Unix(time.Now().Unix(), 0).Format("2006-01-02 15:04:05") + " " + str + "\n")
+	fd.Write(append(data, '\n'))
 	fd.Sync()
+}
+
+// event.log 超过大小后依次滚动为 event.log.1 ... event.log.N
+func rotateAppEventLog(fn string) {
+	fi, err := os.Stat(fn)
+	if err != nil || fi.Size() < defAppEventFileSize {
+		return
+	}
 
+	os.Remove(fmt.Sprintf("%s.%d", fn, defAppEventFileBackups))
+	for i := defAppEventFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", fn, i), fmt.Sprintf("%s.%d", fn, i+1))
+	}
+	err = os.Rename(fn, fn+".1")
+	if err != nil {
+		log.Println("rotateAppEventLog: ", err)
+	}
 }
 
-func readAppEventLog(name string) []string {
-	path := filepath.Join(defAppsExtFolder, name)
-	fn := filepath.Join(path, defAppEventFile)
+// 按时间先后读取应用的全部事件，包括已滚动的文件
+func readAppEvents(name string) []appEvent {
+	fn := getAppEventLogFile(name)
+	var events []appEvent
+	for i := defAppEventFileBackups; i >= 0; i-- {
+		path := fn
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", fn, i)
+		}
+		events = append(events, readAppEventFile(name, path)...)
+	}
+	return events
+}
+
+func readAppEventFile(name, fn string) []appEvent {
 	fl, err := os.Open(fn)
 	if err != nil {
-		log.Println("readAppEventLog open:", err)
 		return nil
 	}
 
 	defer fl.Close()
 
-	var strArray []string
+	var events []appEvent
 	buf := bufio.NewReader(fl)
 	for {
 		line, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			ev := appEvent{}
+			if json.Unmarshal([]byte(line), &ev) != nil {
+				ev = parseOldAppEvent(name, line)
 			}
+			if ev.Time > 0 {
+				events = append(events, ev)
+			}
+		}
+		if err != nil {
 			break
 		}
-		line = strings.TrimSpace(line)
-		strArray = append(strArray, line)
 	}
+	return events
+}
 
-	arrLen := len(strArray)
-	retPos := 0
-	if arrLen > 100 {
-		retPos = arrLen - 100
-	} else {
-		retPos = 0
+// 兼容旧格式："2006-01-02 15:04:05 message"
+func parseOldAppEvent(name, line string) appEvent {
+	ev := appEvent{}
+	if len(line) < 20 {
+		return ev
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", line[:19], time.Local)
+	if err != nil {
+		return ev
 	}
-	return strArray[retPos:]
+	ev.Time = t.Unix()
+	ev.App = name
+	ev.Message = strings.TrimSpace(line[19:])
+	if fields := strings.Fields(ev.Message); len(fields) > 0 {
+		ev.Kind = fields[0]
+	}
+	return ev
 }
 
 func getAppEventLogFile(name string) string {
@@ -409,13 +869,31 @@ func loadAppList() {
 		log.Println("loadAppList: ", err)
 		return
 	}
+	// appmonitor 旧格式没有 enable，原来的应用全部保持启用
+	if supervisor.IsLegacy(content) {
+		log.Println("loadAppList: migrate old appmonitor format")
+		for k := range lst.Items {
+			lst.Items[k].Enable = 1
+		}
+	}
 
 	gCPUThreshold = lst.CPUThreshold
 	gMemThreshold = lst.MemThreshold
+	if lst.DiskThreshold > 0 {
+		gDiskThreshold = lst.DiskThreshold
+	}
+	gStatsPersist = lst.StatsPersist
+	gStallTimeout = time.Duration(lst.StallTimeout) * time.Second
+	gShutdownMode = lst.Shutdown
+	gShutdownGrace = time.Duration(lst.ShutdownGrace) * time.Second
 	gTaskList = append(gTaskList, lst.Items...)
+	pending := false
 	for k, v := range gTaskList {
 		_ = k
-		gTaskList[k].Pid = 0
+		// 看门狗重启或 detach 方式退出后接管仍在运行的应用，避免重复启动
+		if (gRestarts == 0 && !lst.Detached) || false == adoptApp(&gTaskList[k]) {
+			gTaskList[k].Pid = 0
+		}
 		if v.Enable == 1 {
 			gTaskList[k].Cmd = int(APP_CMD_START)
 		} else {
@@ -424,33 +902,134 @@ func loadAppList() {
 
 		path := filepath.Join(defAppsExtFolder, gTaskList[k].Name)
 		gTaskList[k].cfg = loadAppCfg(path)
+		if gTaskList[k].DiskThreshold == 0 {
+			gTaskList[k].DiskThreshold = gDiskThreshold
+		}
+		if gStatsPersist {
+			loadAppStats(gTaskList[k].Name)
+		}
+		if len(v.PendingHooks) > 0 {
+			runPendingHooks(&gTaskList[k])
+			pending = true
+		}
+	}
+	if pending {
+		writeAppInfoFile()
+	}
+
+	log.Printf("loadAppList: CPUThreshold=%d, MemThreshold=%d, DiskThreshold=%d\n", gCPUThreshold, gMemThreshold, gDiskThreshold)
+}
+
+// imageCreator 预装的应用没有经过 installAppPackage，安装钩子在首次加载时执行，
+// 签名校验或 preinstall 失败时应用不启用
+func runPendingHooks(item *taskItem) {
+	hooks := item.PendingHooks
+	item.PendingHooks = nil
+	log.Printf("runPendingHooks: app=%s, hooks=%v\n", item.Name, hooks)
+
+	if false == rsaSignVerify(item.Name, item.cfg.BinName) {
+		item.Enable = 0
+		item.Cmd = int(APP_CMD_STOP)
+		writeAppEventLog(item, "install %s verify sign failed, disabled.", item.Package)
+		return
+	}
+	env := []string{"APP_OLD_VERSION=", "APP_NEW_VERSION=" + getAppVersion(item.Name), "APP_BACKUP_DIR="}
+	if containsString(hooks, defHookPreInstall) {
+		err := runAppHookEvent(item, defHookPreInstall, env...)
+		if err != nil {
+			item.Enable = 0
+			item.Cmd = int(APP_CMD_STOP)
+			writeAppEventLog(item, "install %s preinstall hook failed, disabled.", item.Package)
+			return
+		}
 	}
+	if containsString(hooks, defHookPostInstall) {
+		runAppHookEvent(item, defHookPostInstall, env...)
+	}
+}
 
-	log.Printf("loadAppList: CPUThreshold=%d, MemThreshold=%d\n", gCPUThreshold, gMemThreshold)
+func adoptApp(item *taskItem) bool {
+	if false == isAlive(item.Pid) || false == supervisor.IsRunning(item.Pid, item.Path) {
+		return false
+	}
+	log.Printf("adoptApp: app=%s, pid=%d\n", item.Name, item.Pid)
+	return true
 }
 
 func loadAppCfg(path string) appCfg {
+	cfg, err := readAppCfg(path)
+	if err != nil {
+		log.Printf("loadAppCfg %s\n", err.Error())
+	}
+	return cfg
+}
+
+func readAppCfg(path string) (appCfg, error) {
 	cfg := appCfg{}
 	fn := filepath.Join(path, defAppCfgFile)
 	fl, err := os.Open(fn)
 	if err != nil {
-		log.Printf("loadAppCfg %s open:%s\n", fn, err.Error())
-		return cfg
+		return cfg, fmt.Errorf("%s open:%s", fn, err.Error())
 	}
 
 	defer fl.Close()
 	content, err := ioutil.ReadAll(fl)
 	if err != nil {
-		log.Printf("loadAppCfg %s readall:%s\n", fn, err.Error())
-		return cfg
+		return cfg, fmt.Errorf("%s readall:%s", fn, err.Error())
 	}
 
 	err = json.Unmarshal(content, &cfg)
 	if err != nil {
-		log.Printf("loadAppCfg load %s config:%s\n", fn, err.Error())
-		return cfg
+		return cfg, fmt.Errorf("load %s config:%s", fn, err.Error())
+	}
+	return cfg, nil
+}
+
+// 比较新旧 app.cfg，Restart 为 true 的字段需要重启进程才能生效
+func diffAppCfg(old, cfg *appCfg) []appCfgChange {
+	fields := []appCfgChange{
+		{"binname", old.BinName, cfg.BinName, true},
+		{"libpath", old.LibPath, cfg.LibPath, true},
+		{"args", fmt.Sprint(old.Args), fmt.Sprint(cfg.Args), true},
+		{"env", fmt.Sprint(old.Env), fmt.Sprint(cfg.Env), true},
+		{"cputhreshold", strconv.Itoa(old.CPUThreshold), strconv.Itoa(cfg.CPUThreshold), false},
+		{"memthreshold", strconv.Itoa(old.MemThreshold), strconv.Itoa(cfg.MemThreshold), false},
+		{"diskthreshold", strconv.Itoa(old.DiskThreshold), strconv.Itoa(cfg.DiskThreshold), false},
+		{"cpulimit", strconv.Itoa(old.CPULimit), strconv.Itoa(cfg.CPULimit), false},
+		{"memlimit", strconv.Itoa(old.MemLimit), strconv.Itoa(cfg.MemLimit), false},
+		{"nonotify", strconv.FormatBool(old.NoNotify), strconv.FormatBool(cfg.NoNotify), false},
+		{"hooks", fmt.Sprint(old.Hooks), fmt.Sprint(cfg.Hooks), false},
+		{"hooktimeout", strconv.Itoa(old.HookTimeout), strconv.Itoa(cfg.HookTimeout), false},
+		{"depends", fmt.Sprint(old.Depends), fmt.Sprint(cfg.Depends), false},
+		{"stoptimeout", strconv.Itoa(old.StopTimeout), strconv.Itoa(cfg.StopTimeout), false},
+	}
+
+	var changes []appCfgChange
+	for _, v := range fields {
+		if v.Old != v.New {
+			changes = append(changes, v)
+		}
+	}
+	return changes
+}
+
+// app.cfg 中配置的阈值和限制只在变化时覆盖，保留 appctl 单独设置的值
+func applyAppCfg(item *taskItem, old, cfg *appCfg) {
+	if cfg.CPUThreshold > 0 && cfg.CPUThreshold != old.CPUThreshold {
+		item.CPUThreshold = cfg.CPUThreshold
+	}
+	if cfg.MemThreshold > 0 && cfg.MemThreshold != old.MemThreshold {
+		item.MemThreshold = cfg.MemThreshold
+	}
+	if cfg.DiskThreshold > 0 && cfg.DiskThreshold != old.DiskThreshold {
+		item.DiskThreshold = cfg.DiskThreshold
+	}
+	if cfg.CPULimit > 0 && cfg.CPULimit != old.CPULimit {
+		item.CPULimit = cfg.CPULimit
+	}
+	if cfg.MemLimit > 0 && cfg.MemLimit != old.MemLimit {
+		item.MemLimit = cfg.MemLimit
 	}
-	return cfg
 }
 
 func findAppItem(name string) *taskItem {
@@ -512,8 +1091,11 @@ func handleTask() {
 		select {
 		case ctlReq, ok := <-gTaskChan:
 			{
+				loopEnter()
 				if !ok {
 					log.Println("chan err")
+				} else if ctlReq.done != nil {
+					ctlReq.done()
 				} else {
 					switch ctlReq.req.Cmd {
 					case APP_CTL_INSTALL:
@@ -569,236 +1151,1269 @@ func handleTask() {
 
 					case APP_CTL_QUERY_ALL_RESOURCE:
 						handleAppQueryAllResource(ctlReq)
+
+					case APP_CTL_CONFIG_DISK_THRESHOLD:
+						handleAppConfigDiskThreshold(ctlReq)
+
+					case APP_CTL_QUERY_DISK_THRESHOLD:
+						handleAppQueryDiskThreshold(ctlReq)
+
+					case APP_CTL_QUERY_DISK:
+						handleAppQueryDisk(ctlReq)
+
+					case APP_CTL_EVENTS:
+						handleAppEvents(ctlReq)
+
+					case APP_CTL_INSTALL_URL:
+						handleAppInstallURL(ctlReq)
+
+					case APP_CTL_EXPORT:
+						handleAppExport(ctlReq)
+
+					case APP_CTL_IMPORT:
+						handleAppImport(ctlReq)
+
+					case APP_CTL_RECONCILE_STATUS:
+						handleAppReconcileStatus(ctlReq)
+
+					case APP_CTL_STATS:
+						handleAppStats(ctlReq)
+
+					case APP_CTL_RELOAD:
+						handleAppReload(ctlReq)
+
+					case APP_CTL_EXEC:
+						handleAppExec(ctlReq)
+
+					case APP_CTL_DUMP:
+						handleAppDump(ctlReq)
 					}
 				}
+				loopLeave()
 			}
 
 		case <-time.After(time.Millisecond * 1000):
 			{
+				loopEnter()
 				checkApps()
+				checkDesiredState(false)
+				loopLeave()
+			}
+
+		case <-gShutdownChan:
+			{
+				loopEnter()
+				shutdownApps()
+				loopLeave()
+				close(gShutdownDone)
+				return
 			}
 		}
 	}
 }
 
-func checkApps() {
-	for k, v := range gTaskList {
-		_ = k
-		v.Param = ""
-		//log.Println(v.Path, ",", v.Param, ",", v.Pid)
-		if isAlive(v.Pid) {
-			//ret, err := os.Readlink("/proc/" + strconv.Itoa(v.Pid) + "/comm")
-			//if err == nil && ret == v.Path {
-			cpuRate := getAppCPUPercent(v.Name, v.Pid)
-			memRate := getAppMemPercent(v.Name, v.Pid)
-			gTaskList[k].CPURate = cpuRate
-			gTaskList[k].MemRate = memRate
-
-			if cpuRate > v.CPUThreshold {
-				restartApp(k)
-				sendWarnNotify(v.Name, "cpu", cpuRate, v.CPUThreshold)
-				writeAppEventLog(&gTaskList[k], "restart %s cpu usage rate: %d over threshold %d restart.", v.Name, cpuRate, v.CPUThreshold)
-				log.Printf("%s(%d) cpu usage rate: %d over threshold %d restart\n", v.Name, v.Pid, cpuRate, v.CPUThreshold)
-
-				continue
-			}
-
-			if memRate > v.MemThreshold {
-				restartApp(k)
-				sendWarnNotify(v.Name, "mem", memRate, v.MemThreshold)
-				writeAppEventLog(&gTaskList[k], "restart %s mem usage rate: %d over threshold %d restart.", v.Name, memRate, v.MemThreshold)
-				log.Printf("%s(%d) mem usage rate: %d over threshold %d restart\n", v.Name, v.Pid, memRate, v.MemThreshold)
-
-				continue
-			}
-
-			gTaskList[k].Status = int(APP_STATUS_RUNNING)
-			continue
-			//} else {
-			//	log.Println("checkApps 0x0001:", err, ",", v.Path)
-			//}
-		} else {
-			if v.Status == int(APP_STATUS_RUNNING) {
-				gTaskList[k].Status = int(APP_STATUS_STOP)
-				gTaskList[k].CPURate = 0
-				gTaskList[k].MemRate = 0
+// stop: 按依赖倒序逐个停止应用；detach: 保留应用运行并记录 pid，下次启动时接管
+func shutdownApps() {
+	mode := gShutdownMode
+	if mode != defShutdownStop {
+		mode = defShutdownDetach
+	}
+	log.Printf("shutdownApps: mode=%s, apps=%d\n", mode, len(gTaskList))
+
+	if mode == defShutdownDetach {
+		gDetached = true
+		for k := range gTaskList {
+			item := &gTaskList[k]
+			if isAlive(item.Pid) {
+				writeAppEvent(item, "shutdown", map[string]int{"pid": item.Pid},
+					fmt.Sprintf("shutdown daemon, %s detached pid %d.", item.Name, item.Pid))
 			}
 		}
+		writeAppInfoFile()
+		return
+	}
 
-		if v.Cmd == int(APP_CMD_START) {
-			err := startApp(&gTaskList[k])
-			if err != nil {
-				log.Printf("checkApps %s:%s", v.Path, err.Error())
-			}
+	order := getDependOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		item := &gTaskList[order[i]]
+		if false == isAlive(item.Pid) {
+			continue
 		}
+		pid := item.Pid
+		grace := stopApp(item)
+		runAppHookEvent(item, defHookPostStop)
+		writeAppEvent(item, "shutdown", map[string]int{"pid": pid, "grace": int(grace / time.Millisecond)},
+			fmt.Sprintf("shutdown daemon, %s stopped pid %d in %s.", item.Name, pid, grace.String()))
+	}
+	writeAppInfoFile()
+}
 
+// 先发 SIGTERM，超过宽限时间仍未退出再 SIGKILL，返回实际等待时间
+func stopApp(item *taskItem) time.Duration {
+	grace := defShutdownGrace
+	if gShutdownGrace > 0 {
+		grace = gShutdownGrace
+	}
+	if item.cfg.StopTimeout > 0 {
+		grace = time.Duration(item.cfg.StopTimeout) * time.Second
 	}
 
-	endTime := time.Now().UTC()
-	var durationTrace = endTime.Sub(gTraceTime)
-	if durationTrace > gWaitTime {
-		log.Println("checkApps ok: app list count =", len(gTaskList))
-		gTraceTime = time.Now().UTC()
+	d := supervisor.Stop(item.Pid, grace)
+	if d >= grace {
+		log.Printf("stopApp: %s(%d) not exit in %s, kill\n", item.Name, item.Pid, grace.String())
 	}
+
+	item.Pid = 0
+	item.Status = int(APP_STATUS_STOP)
+	item.CPURate = 0
+	item.MemRate = 0
+	item.LogEndTime = time.Now().Unix()
+	return d
 }
 
-func restartApp(idx int) error {
-	gTaskList[idx].LogEndTime = time.Now().Unix()
-	err := syscall.Kill(gTaskList[idx].Pid, 9)
-	if err != nil {
-		log.Printf("restartApp kill process: %s, pid:%d error: %s\n", gTaskList[idx].Name, gTaskList[idx].Pid, err.Error())
-		return err
+// 按 app.cfg 中 depends 排序，被依赖的应用在前，循环依赖按原顺序处理
+func getDependOrder() []int {
+	idx := make(map[string]int)
+	for k, v := range gTaskList {
+		idx[v.Name] = k
 	}
 
-	cmd := exec.Command(gTaskList[idx].Path, gTaskList[idx].Param)
-	if cmd != nil {
-		cmd.Dir = filepath.Join(defAppsExtFolder, gTaskList[idx].Name+"/bin")
-		libPath := filepath.Join(defAppsExtFolder, gTaskList[idx].Name+"/lib")
-		libEnv := fmt.Sprintf("LD_LIBRARY_PATH=/lib:/usr/lib:/home/zxlib:%s", libPath)
-		cmd.Env = append(os.Environ(), libEnv)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		err := cmd.Start()
-		if err != nil {
-			log.Println("restartApp 0x0002:", err)
-			return err
+	var order []int
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		k, ok := idx[name]
+		if !ok || visited[name] {
+			return
 		}
-
-		go cmd.Wait()
-		gTaskList[idx].Pid = cmd.Process.Pid
-		gTaskList[idx].Status = int(APP_STATUS_RUNNING)
-		gTaskList[idx].StartTime = time.Now().Unix()
-		gTaskList[idx].LogEndTime = time.Now().Unix()
-		log.Println("restartApp start name =", gTaskList[idx].Name, ", path =", gTaskList[idx].Path, ", pid =", gTaskList[idx].Pid)
-
-		writeAppInfoFile()
-		return nil
+		visited[name] = true
+		for _, v := range gTaskList[k].cfg.Depends {
+			visit(v)
+		}
+		order = append(order, k)
 	}
-
-	log.Println("restartApp exec cmd nil:", gTaskList[idx].Path)
-	return errors.New("restartApp exec cmd nil")
+	for _, v := range gTaskList {
+		visit(v.Name)
+	}
+	return order
 }
 
-func startApp(item *taskItem) error {
-	cmd := exec.Command(item.Path, item.Param)
-	if cmd != nil {
-		cmd.Dir = filepath.Join(defAppsExtFolder, item.Name+"/bin")
-		libPath := filepath.Join(defAppsExtFolder, item.Name+"/lib")
-		libEnv := fmt.Sprintf("LD_LIBRARY_PATH=/lib:/usr/lib:/home/zxlib:%s", libPath)
-		cmd.Env = append(os.Environ(), libEnv)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		err := cmd.Start()
-		if err != nil {
-			log.Printf("startApp: app=%s, %s\n", item.Path, err.Error())
-			return err
-		}
-
-		go cmd.Wait()
-		item.Pid = cmd.Process.Pid
-		item.Status = int(APP_STATUS_RUNNING)
-		item.StartTime = time.Now().Unix()
-		item.LogEndTime = time.Now().Unix()
-		writeAppInfoFile()
-
-		log.Println("startApp name =", item.Name, ", path =", item.Path, ", pid =", item.Pid)
+func loopEnter() {
+	atomic.StoreInt64(&gLoopBusy, time.Now().UnixNano())
+}
 
-		return nil
+func loopLeave() {
+	start := atomic.SwapInt64(&gLoopBusy, 0)
+	lag := (time.Now().UnixNano() - start) / int64(time.Millisecond)
+	atomic.StoreInt64(&gLoopLastLag, lag)
+	if lag > atomic.LoadInt64(&gLoopMaxLag) {
+		atomic.StoreInt64(&gLoopMaxLag, lag)
 	}
-
-	return errors.New("startApp cmd nil")
-
+	atomic.AddInt64(&gLoopCount, 1)
+}
+
+// 主循环正在处理的耗时，空闲时为 0
+func getLoopLag() time.Duration {
+	start := atomic.LoadInt64(&gLoopBusy)
+	if start == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - start)
+}
+
+func getStallTimeout() time.Duration {
+	if gStallTimeout == 0 {
+		return defLoopStallTime
+	}
+	return gStallTimeout
+}
+
+// 监控主循环耗时，卡住超过 stalltimeout 后原地重启守护进程；stalltimeout 小于 0 时只告警
+func handleWatchdog() {
+	interval := time.Second
+	notify := getSdWatchdogTime()
+	if notify > 0 && notify < interval {
+		interval = notify
+	}
+	stall := getStallTimeout()
+	lastNotify := time.Time{}
+	warned := false
+	for {
+		time.Sleep(interval)
+		reapOrphans()
+		lag := getLoopLag()
+		if lag > defLoopWarnTime {
+			if !warned {
+				recordDaemonError("watchdog", "main loop busy for %s", lag.String())
+				warned = true
+			}
+		} else {
+			warned = false
+		}
+
+		if stall > 0 && lag > stall && atomic.LoadInt32(&gShutdown) == 0 {
+			recordDaemonError("watchdog", "main loop stalled for %s, restart", lag.String())
+			restartDaemon()
+		}
+
+		if notify > 0 && time.Since(lastNotify) >= notify && (stall <= 0 || lag < stall) {
+			sdNotify("WATCHDOG=1")
+			lastNotify = time.Now()
+		}
+	}
+}
+
+// 重启前的子进程(如钩子脚本)不再有 cmd.Wait 回收，退出后在这里回收
+func reapOrphans() {
+	gOrphanList = supervisor.ReapList(gOrphanList)
+}
+
+func restartDaemon() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Println("restartDaemon executable error: ", err)
+		return
+	}
+	env := []string{fmt.Sprintf("%s=%d", defRestartEnv, gRestarts+1)}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, defRestartEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	log.Printf("restartDaemon: %s, restarts=%d\n", exe, gRestarts+1)
+	err = syscall.Exec(exe, os.Args, env)
+	if err != nil {
+		log.Println("restartDaemon exec error: ", err)
+	}
+}
+
+// systemd Type=notify 时通过 NOTIFY_SOCKET 上报状态
+func sdNotify(state string) bool {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if len(sock) == 0 {
+		return false
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		recordDaemonError("notify", "sd_notify dial: %s", err.Error())
+		return false
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		recordDaemonError("notify", "sd_notify write: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// WatchdogSec 配置后按一半间隔上报
+func getSdWatchdogTime() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func recordDaemonError(subsystem, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Printf("%s error: %s\n", subsystem, msg)
+	gErrorMutex.Lock()
+	gErrorList[subsystem] = daemonError{Time: time.Now().Unix(), Message: msg}
+	gErrorMutex.Unlock()
+}
+
+// unixgram 没有连接，无法用 SO_PEERCRED；开启 SO_PASSCRED 后内核会在每个数据报上附带发送方 pid/uid/gid
+func setPassCred(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func getPeerCred(oob []byte) *syscall.Ucred {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, v := range msgs {
+		cred, err := syscall.ParseUnixCredentials(&v)
+		if err == nil {
+			return cred
+		}
+	}
+	return nil
+}
+
+// 修改时间变化时重新加载 access.cfg，文件不存在时使用默认策略
+func loadAccessPolicy() *accessPolicy {
+	fn := filepath.Join(gAppCurrentPath, defAccessFile)
+	fi, err := os.Stat(fn)
+	if err != nil {
+		if gAccessPolicy != nil {
+			log.Println("loadAccessPolicy: policy removed, use default")
+		}
+		gAccessPolicy = nil
+		gAccessTime = time.Time{}
+		return nil
+	}
+	if fi.ModTime().Equal(gAccessTime) {
+		return gAccessPolicy
+	}
+	gAccessTime = fi.ModTime()
+
+	content, err := ioutil.ReadFile(fn)
+	policy := &accessPolicy{}
+	if err == nil {
+		err = json.Unmarshal(content, policy)
+	}
+	if err != nil {
+		// 策略文件错误时只允许 root
+		recordDaemonError("access", "%s: %s", fn, err.Error())
+		policy = &accessPolicy{Default: []string{}}
+	}
+	log.Printf("loadAccessPolicy: %s, rules=%d\n", fn, len(policy.Rules))
+	gAccessPolicy = policy
+	return gAccessPolicy
+}
+
+// reconcile 的 Value 为 1 时会立即对齐并安装、停止应用，按 reconcile-now 单独授权
+func getCmdName(req *appCtlCmdReq) string {
+	name, ok := gCmdNames[req.Cmd]
+	if !ok {
+		return strconv.Itoa(int(req.Cmd))
+	}
+	if req.Cmd == APP_CTL_RECONCILE_STATUS && req.Value == 1 {
+		return name + "-now"
+	}
+	return name
+}
+
+func checkAccess(cred *syscall.Ucred, req *appCtlCmdReq) bool {
+	name := getCmdName(req)
+	policy := loadAccessPolicy()
+
+	var allow []string
+	matched := false
+	if cred != nil && policy != nil {
+		groups := getPeerGroups(cred)
+		for _, v := range policy.Rules {
+			//不指定 uid、gid 的规则用于普通用户，root 只受明确指定 uid 0 或其所在组的规则限制
+			if v.Uid == nil && v.Gid == nil && cred.Uid == 0 {
+				continue
+			}
+			if v.Uid != nil && *v.Uid != int(cred.Uid) {
+				continue
+			}
+			if v.Gid != nil && false == containsString(groups, strconv.Itoa(*v.Gid)) {
+				continue
+			}
+			matched = true
+			allow = append(allow, v.Commands...)
+		}
+	}
+	if !matched {
+		if cred != nil && cred.Uid == 0 {
+			return true
+		}
+		allow = gReadOnlyCmds
+		if policy != nil && policy.Default != nil {
+			allow = policy.Default
+		}
+	}
+	return containsString(allow, "*") || containsString(allow, name)
+}
+
+// 主组加上 /proc/<pid>/status 中的附加组
+func getPeerGroups(cred *syscall.Ucred) []string {
+	groups := []string{strconv.Itoa(int(cred.Gid))}
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(cred.Pid)) + "/status")
+	if err != nil {
+		return groups
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Groups:") {
+			groups = append(groups, strings.Fields(strings.TrimPrefix(line, "Groups:"))...)
+			break
+		}
+	}
+	return groups
+}
+
+func writeAuditLog(cred *syscall.Ucred, req *appCtlCmdReq, msg string) {
+	rec := auditRecord{}
+	rec.Time = time.Now().Unix()
+	rec.Uid = -1
+	rec.Gid = -1
+	if cred != nil {
+		rec.Pid = cred.Pid
+		rec.Uid = int64(cred.Uid)
+		rec.Gid = int64(cred.Gid)
+	}
+	rec.Cmd = getCmdName(req)
+	rec.Name = req.Name
+	rec.Msg = msg
+	log.Printf("audit: pid=%d, uid=%d, gid=%d, cmd=%s, name=%s %s\n", rec.Pid, rec.Uid, rec.Gid, rec.Cmd, rec.Name, msg)
+
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		log.Println("writeAuditLog marshal error:", err)
+		return
+	}
+	fn := filepath.Join(gAppCurrentPath, defAuditFile)
+	rotateAppEventLog(fn)
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		recordDaemonError("access", "audit log: %s", err.Error())
+		return
+	}
+	defer fd.Close()
+	fd.Write(append(data, '\n'))
+	fd.Sync()
+}
+
+// 不经过主循环直接应答，主循环卡住时也能查询
+func handleDaemonStatus(ctl *taskCmd) {
+	st := daemonStatus{}
+	st.Version = version
+	st.Pid = os.Getpid()
+	st.StartTime = gStartTime.Unix()
+	st.Uptime = int64(time.Since(gStartTime) / time.Second)
+	st.Restarts = gRestarts
+	st.LoopCount = atomic.LoadInt64(&gLoopCount)
+	st.LoopLag = int64(getLoopLag() / time.Millisecond)
+	st.LoopLastLag = atomic.LoadInt64(&gLoopLastLag)
+	st.LoopMaxLag = atomic.LoadInt64(&gLoopMaxLag)
+	st.StallTimeout = int64(getStallTimeout() / time.Second)
+	st.Watchdog = int64(getSdWatchdogTime() / time.Second)
+	st.Goroutines = runtime.NumGoroutine()
+	st.QueueDepth = len(gTaskChan)
+	st.QueueSize = cap(gTaskChan)
+	st.Errors = make(map[string]daemonError)
+	gErrorMutex.Lock()
+	for k, v := range gErrorList {
+		st.Errors[k] = v
+	}
+	gErrorMutex.Unlock()
+
+	data, err := json.Marshal(&st)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleDaemonStatus marshal error:", err)
+		return
+	}
+	writeCtlSimpleRsp(ctl, 0, string(data))
+}
+
+func checkApps() {
+	checkDisk := false
+	if time.Now().UTC().Sub(gDiskTraceTime) > defDiskCheckTime {
+		checkDisk = true
+		gDiskTraceTime = time.Now().UTC()
+	}
+
+	for k, v := range gTaskList {
+		_ = k
+		v.Param = ""
+		//log.Println(v.Path, ",", v.Param, ",", v.Pid)
+		if checkDisk {
+			gTaskList[k].DiskUsage = getAppDiskUsage(v.Name)
+			v.DiskUsage = gTaskList[k].DiskUsage
+		}
+		if isAlive(v.Pid) {
+			//ret, err := os.Readlink("/proc/" + strconv.Itoa(v.Pid) + "/comm")
+			//if err == nil && ret == v.Path {
+			cpuRate := getAppCPUPercent(v.Name, v.Pid)
+			memRate := getAppMemPercent(v.Name, v.Pid)
+			gTaskList[k].CPURate = cpuRate
+			gTaskList[k].MemRate = memRate
+			recordAppSample(v.Name, cpuRate, memRate, v.DiskUsage)
+
+			if cpuRate > v.CPUThreshold {
+				restartApp(k)
+				sendWarnNotify(v.Name, "cpu", cpuRate, v.CPUThreshold)
+				writeAppEvent(&gTaskList[k], "restart", map[string]int{"cpu": cpuRate, "threshold": v.CPUThreshold},
+					fmt.Sprintf("restart %s cpu usage rate: %d over threshold %d restart.", v.Name, cpuRate, v.CPUThreshold))
+				log.Printf("%s(%d) cpu usage rate: %d over threshold %d restart\n", v.Name, v.Pid, cpuRate, v.CPUThreshold)
+
+				continue
+			}
+
+			if memRate > v.MemThreshold {
+				restartApp(k)
+				sendWarnNotify(v.Name, "mem", memRate, v.MemThreshold)
+				writeAppEvent(&gTaskList[k], "restart", map[string]int{"mem": memRate, "threshold": v.MemThreshold},
+					fmt.Sprintf("restart %s mem usage rate: %d over threshold %d restart.", v.Name, memRate, v.MemThreshold))
+				log.Printf("%s(%d) mem usage rate: %d over threshold %d restart\n", v.Name, v.Pid, memRate, v.MemThreshold)
+
+				continue
+			}
+
+			if checkDisk && v.DiskThreshold > 0 && v.DiskUsage <= v.DiskThreshold {
+				gTaskList[k].diskRestarts = 0
+			}
+			if checkDisk && v.DiskThreshold > 0 && v.DiskUsage > v.DiskThreshold && v.diskRestarts >= defDiskRestartMax {
+				if v.diskRestarts == defDiskRestartMax {
+					gTaskList[k].diskRestarts++
+					sendWarnNotify(v.Name, "disk", v.DiskUsage, v.DiskThreshold)
+					writeAppEvent(&gTaskList[k], "warn", map[string]int{"disk": v.DiskUsage, "threshold": v.DiskThreshold},
+						fmt.Sprintf("%s disk usage: %dMB still over threshold %dMB after %d restarts, stop restarting.", v.Name, v.DiskUsage, v.DiskThreshold, defDiskRestartMax))
+					log.Printf("%s(%d) disk usage: %dMB still over threshold %dMB after %d restarts\n", v.Name, v.Pid, v.DiskUsage, v.DiskThreshold, defDiskRestartMax)
+				}
+			} else if checkDisk && v.DiskThreshold > 0 && v.DiskUsage > v.DiskThreshold {
+				gTaskList[k].diskRestarts++
+				restartApp(k)
+				sendWarnNotify(v.Name, "disk", v.DiskUsage, v.DiskThreshold)
+				writeAppEvent(&gTaskList[k], "restart", map[string]int{"disk": v.DiskUsage, "threshold": v.DiskThreshold},
+					fmt.Sprintf("restart %s disk usage: %dMB over threshold %dMB restart.", v.Name, v.DiskUsage, v.DiskThreshold))
+				log.Printf("%s(%d) disk usage: %dMB over threshold %dMB restart\n", v.Name, v.Pid, v.DiskUsage, v.DiskThreshold)
+
+				continue
+			}
+
+			gTaskList[k].Status = int(APP_STATUS_RUNNING)
+			continue
+			//} else {
+			//	log.Println("checkApps 0x0001:", err, ",", v.Path)
+			//}
+		} else {
+			if v.Status == int(APP_STATUS_RUNNING) {
+				gTaskList[k].Status = int(APP_STATUS_STOP)
+				gTaskList[k].CPURate = 0
+				gTaskList[k].MemRate = 0
+				postAppHookEvent(&gTaskList[k], defHookPostStop)
+			}
+		}
+
+		if v.Cmd == int(APP_CMD_START) && !v.starting {
+			err := startApp(&gTaskList[k])
+			if err != nil {
+				recordDaemonError("monitor", "start %s: %s", v.Name, err.Error())
+			}
+		}
+
+	}
+
+	endTime := time.Now().UTC()
+	var durationTrace = endTime.Sub(gTraceTime)
+	if durationTrace > gWaitTime {
+		log.Println("checkApps ok: app list count =", len(gTaskList))
+		gTraceTime = time.Now().UTC()
+	}
+}
+
+func restartApp(idx int) error {
+	gTaskList[idx].LogEndTime = time.Now().Unix()
+	err := syscall.Kill(gTaskList[idx].Pid, 9)
+	if err != nil {
+		recordDaemonError("monitor", "restart %s kill pid %d: %s", gTaskList[idx].Name, gTaskList[idx].Pid, err.Error())
+		return err
+	}
+
+	gTaskList[idx].Pid = 0
+	gTaskList[idx].Status = int(APP_STATUS_STOP)
+	postAppHookEvent(&gTaskList[idx], defHookPostStop)
+	err = startApp(&gTaskList[idx])
+	if err != nil {
+		recordDaemonError("monitor", "restart %s: %s", gTaskList[idx].Name, err.Error())
+		return err
+	}
+	log.Println("restartApp start name =", gTaskList[idx].Name, ", path =", gTaskList[idx].Path, ", pid =", gTaskList[idx].Pid)
+	return nil
+}
+
+// 有 prestart 钩子时先返回，钩子成功后在主循环中启动进程，钩子失败只记录事件
+func startApp(item *taskItem) error {
+	name := item.Name
+	queued := queueAppHook(item, defHookPreStart, nil, func(out string, code int, err error) {
+		item := findAppItem(name)
+		if item == nil {
+			return
+		}
+		item.starting = false
+		writeAppHookEvent(item, defHookPreStart, out, code, err)
+		if err != nil {
+			log.Printf("startApp %s prestart hook: %s\n", name, err.Error())
+			return
+		}
+		//钩子执行期间应用被停止或已经启动
+		if item.Cmd != int(APP_CMD_START) || isAlive(item.Pid) {
+			return
+		}
+		if err = execApp(item); err != nil {
+			recordDaemonError("monitor", "start %s: %s", name, err.Error())
+		}
+	})
+	if queued {
+		item.starting = true
+		return nil
+	}
+	return execApp(item)
+}
+
+func execApp(item *taskItem) error {
+	pid, err := supervisor.Start(newAppCmd(item))
+	if err != nil {
+		log.Printf("startApp: app=%s, %s\n", item.Path, err.Error())
+		return err
+	}
+
+	item.Pid = pid
+	item.Status = int(APP_STATUS_RUNNING)
+	item.StartTime = time.Now().Unix()
+	item.LogEndTime = time.Now().Unix()
+	writeAppInfoFile()
+
+	log.Println("startApp name =", item.Name, ", path =", item.Path, ", pid =", item.Pid)
+
+	return nil
+}
+
+// app.cfg 中 args 为空时沿用 Param；libpath 为相对应用目录的库路径，未配置时为 lib
+func newAppCmd(item *taskItem) *exec.Cmd {
+	args := item.cfg.Args
+	if len(args) == 0 {
+		args = []string{item.Param}
+	}
+	cmd := supervisor.Command(&supervisor.Proc{
+		Name: item.Name,
+		Path: item.Path,
+		Args: args,
+		Dir:  filepath.Join(defAppsExtFolder, item.Name+"/bin"),
+		Env:  getAppEnv(item),
+	})
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// 应用自身的环境变量，启动时加在守护进程的环境之后
+func getAppEnv(item *taskItem) []string {
+	libPath := item.cfg.LibPath
+	if len(libPath) == 0 {
+		libPath = "lib"
+	}
+	if false == filepath.IsAbs(libPath) {
+		libPath = filepath.Join(defAppsExtFolder, item.Name, libPath)
+	}
+	libEnv := fmt.Sprintf("LD_LIBRARY_PATH=/lib:/usr/lib:/home/zxlib:%s", libPath)
+	return append([]string{libEnv}, item.cfg.Env...)
+}
+
+// 钩子脚本路径相对应用目录，通过 /bin/sh 执行，超时后杀掉整个进程组
+func runAppHook(name string, cfg appCfg, hook string, env ...string) (string, int, error) {
+	script := cfg.Hooks[hook]
+	if len(script) == 0 {
+		return "", 0, nil
+	}
+
+	dir := filepath.Join(defAppsExtFolder, name)
+	if false == filepath.IsAbs(script) {
+		script = filepath.Join(dir, script)
+	}
+	timeout := defHookTimeout
+	if cfg.HookTimeout > 0 {
+		timeout = time.Duration(cfg.HookTimeout) * time.Second
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", script)
+	cmd.Dir = dir
+	libEnv := fmt.Sprintf("LD_LIBRARY_PATH=/lib:/usr/lib:/home/zxlib:%s", filepath.Join(dir, "lib"))
+	cmd.Env = append(os.Environ(), libEnv, "APP_NAME="+name, "APP_DIR="+dir, "APP_HOOK="+hook)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		return "", -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+
+	code := 0
+	if err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				code = status.ExitStatus()
+			}
+		}
+	}
+
+	str := strings.TrimSpace(out.String())
+	if len(str) > defHookOutputSize {
+		str = str[len(str)-defHookOutputSize:]
+	}
+	log.Printf("runAppHook: app=%s, hook=%s, code=%d\n", name, hook, code)
+	if err != nil {
+		recordDaemonError("hook", "%s %s: %s", name, hook, err.Error())
+	}
+	return str, code, err
+}
+
+// 钩子按提交顺序逐个执行，不占用主循环，结果放回任务队列
+func handleHooks() {
+	for job := range gHookChan {
+		out, code, err := runAppHook(job.name, job.cfg, job.hook, job.env...)
+		done := job.done
+		ret := &taskCmd{}
+		ret.req.Name = job.name
+		ret.done = func() {
+			done(out, code, err)
+		}
+		go func(ret *taskCmd) {
+			gTaskChan <- ret
+		}(ret)
+	}
+}
+
+// 没有配置该钩子时返回 false，否则钩子执行完后在主循环中调用 done
+func queueAppHook(item *taskItem, hook string, env []string, done func(out string, code int, err error)) bool {
+	if len(item.cfg.Hooks[hook]) == 0 {
+		return false
+	}
+	job := &hookJob{name: item.Name, cfg: item.cfg, hook: hook, done: done}
+	job.env = append(append([]string{}, env...), "APP_VERSION="+item.Version)
+	gHookChan <- job
+	return true
+}
+
+// 只记录钩子结果，不等待执行完成
+func postAppHookEvent(item *taskItem, hook string, env ...string) {
+	name := item.Name
+	queueAppHook(item, hook, env, func(out string, code int, err error) {
+		if item := findAppItem(name); item != nil {
+			writeAppHookEvent(item, hook, out, code, err)
+		}
+	})
+}
+
+// 同步执行，只在主循环启动前和退出时使用
+func runAppHookEvent(item *taskItem, hook string, env ...string) error {
+	if len(item.cfg.Hooks[hook]) == 0 {
+		return nil
+	}
+	env = append(env, "APP_VERSION="+item.Version)
+	out, code, err := runAppHook(item.Name, item.cfg, hook, env...)
+	writeAppHookEvent(item, hook, out, code, err)
+	return err
+}
+
+func writeAppHookEvent(item *taskItem, hook string, out string, code int, err error) {
+	ret := "success"
+	if err != nil {
+		ret = "failed: " + err.Error()
+	}
+	msg := fmt.Sprintf("hook %s %s %s.", item.Name, hook, ret)
+	if len(out) > 0 {
+		msg += "\n" + out
+	}
+	writeAppEvent(item, "hook", map[string]int{"exit": code}, msg)
 }
 
 func readUnixgram() error {
 	for {
-		buf := make([]byte, 1400)
-		size, remote, err := gUnixConn.ReadFromUnix(buf)
+		buf := make([]byte, 64*1024)
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+		size, oobn, _, remote, err := gUnixConn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			log.Println("readUnixgram error: ", err)
+			break
+		}
+
+		//fmt.Println("recv:", string(buf[:size]), " from ", remote.String())
+		//gUnixConn.WriteToUnix(buf[:size], remote)
+
+		data := bytes.NewBuffer(buf[:size])
+		dec := gob.NewDecoder(data)
+		ctlReq := appCtlCmdReq{}
+		err = dec.Decode(&ctlReq)
+		if err != nil {
+			recordDaemonError("socket", "decode: %s", err.Error())
+			continue
+		}
+
+		ctlCmd := &taskCmd{}
+		ctlCmd.remote = remote
+		ctlCmd.req = ctlReq
+		cred := getPeerCred(oob[:oobn])
+		if false == checkAccess(cred, &ctlReq) {
+			writeAuditLog(cred, &ctlReq, "denied")
+			writeCtlSimpleRsp(ctlCmd, 3, "Permission denied.")
+			continue
+		}
+		if ctlReq.Cmd == APP_CTL_DAEMON_STATUS {
+			handleDaemonStatus(ctlCmd)
+			continue
+		}
+		select {
+		case gTaskChan <- ctlCmd:
+		default:
+			recordDaemonError("socket", "task queue full, drop cmd %d", ctlReq.Cmd)
+			writeCtlSimpleRsp(ctlCmd, 1, "Daemon busy.")
+		}
+	}
+	return nil
+}
+
+func handleAppInstall(ctl *taskCmd) {
+	log.Println("handleAppInstall: ", ctl.req.Name)
+
+	installAppPackage(ctl.req.Name, ctl.req.URL, func(item *taskItem, err error) {
+		if err != nil {
+			writeCtlSimpleRsp(ctl, 1, err.Error())
+			return
+		}
+		writeCtlSimpleRsp(ctl, 0, "Success.")
+
+		if ctl.next != nil {
+			go func(next *taskCmd) {
+				gTaskChan <- next
+			}(ctl.next)
+		}
+	})
+}
+
+// 解压并校验 defAppsFolder 下的安装包，已安装的应用更新版本信息。
+// 有 preinstall 钩子时返回 true，钩子执行完后在主循环中完成安装再调用 done，否则返回前调用 done
+func installAppPackage(pkg, src string, done func(item *taskItem, err error)) bool {
+	inst, err := prepareAppInstall(pkg)
+	if err != nil {
+		done(nil, err)
+		return false
+	}
+
+	oldVersion := ""
+	if item := findAppItem(inst.name); item != nil {
+		oldVersion = item.Version
+	}
+	env := []string{"APP_OLD_VERSION=" + oldVersion, "APP_NEW_VERSION=" + getAppVersion(inst.name), "APP_BACKUP_DIR=" + inst.backup}
+	finish := func(out string, code int, err error) {
+		delete(gInstalling, inst.name)
+		done(commitAppInstall(inst, src, env, out, code, err))
+	}
+	gInstalling[inst.name] = true
+	hookItem := &taskItem{Name: inst.name, Version: getAppVersion(inst.name), cfg: inst.cfg}
+	if queueAppHook(hookItem, defHookPreInstall, env, finish) {
+		return true
+	}
+	finish("", 0, nil)
+	return false
+}
+
+// 已解压、通过签名校验等待 preinstall 钩子的安装包
+type appInstall struct {
+	pkg    string
+	name   string
+	path   string
+	backup string
+	cfg    appCfg
+}
+
+func prepareAppInstall(pkg string) (*appInstall, error) {
+	if false == gPackageName.MatchString(pkg) {
+		return nil, errors.New("Error: invalid package name " + pkg)
+	}
+	fn := filepath.Join(defAppsFolder, pkg)
+	if false == checkFileIsExist(fn) {
+		return nil, errors.New("Error: File " + pkg + " not exist.")
+	}
+
+	appName := getPackageAppName(pkg)
+	path := filepath.Join(defAppsExtFolder, appName)
+	if gInstalling[appName] {
+		return nil, errors.New("Error: " + appName + " is installing.")
+	}
+
+	// 已安装的应用先备份，解压、校验或 preinstall 钩子失败时还原
+	backup := ""
+	if checkFileIsExist(path) {
+		backup = filepath.Join(defAppsExtFolder, "."+appName+".bak")
+		os.RemoveAll(backup)
+		out, err := exec.Command("cp", "-a", path, backup).CombinedOutput()
+		if err != nil {
+			log.Printf("installAppPackage backup: %s(%s)\n", string(out), err)
+			return nil, errors.New("Install backup failed.")
+		}
+	}
+
+	err := extractAppPackage(fn, defAppsExtFolder)
+	if err != nil {
+		log.Println("installAppPackage: ", err)
+		restoreAppDir(path, backup)
+		return nil, errors.New("Install decompress failed.")
+	}
+
+	cfg := loadAppCfg(path)
+	if false == rsaSignVerify(appName, cfg.BinName) {
+		restoreAppDir(path, backup)
+		log.Printf("installAppPackage: Verify sign failed.\n")
+		return nil, errors.New("Verify file sign failed.")
+	}
+	return &appInstall{pkg: pkg, name: appName, path: path, backup: backup, cfg: cfg}, nil
+}
+
+// preinstall 钩子失败时还原，成功时更新应用信息
+func commitAppInstall(inst *appInstall, src string, env []string, hookOut string, hookCode int, err error) (*taskItem, error) {
+	pkg, appName, path, backup, cfg := inst.pkg, inst.name, inst.path, inst.backup, inst.cfg
+	item := findAppItem(appName)
+	oldVersion, oldHash := "", ""
+	if item != nil {
+		oldVersion = item.Version
+		oldHash = item.Hash
+	}
+	if err != nil {
+		restoreAppDir(path, backup)
+		log.Printf("installAppPackage %s preinstall hook: %s\n%s\n", appName, err.Error(), hookOut)
+		if item != nil {
+			writeAppHookEvent(item, defHookPreInstall, hookOut, hookCode, err)
+			writeAppEventLog(item, "install %s operation failed, restored.", pkg)
+		}
+		return nil, errors.New("Install preinstall hook failed: " + err.Error())
+	}
+
+	if item == nil {
+		item = &taskItem{}
+		item.Name = appName
+		item.Pid = 0
+		item.Cmd = int(APP_CMD_STOP)
+		item.Enable = 1
+		item.Status = int(APP_STATUS_INSTALL)
+		item.CPUThreshold = defCPUThreshold
+		item.MemThreshold = defMemThreshold
+		item.CPULimit = defCPULimit
+		item.MemLimit = defMemLimit
+		item.DiskThreshold = gDiskThreshold
+		item.LogStartTime = time.Now().Unix()
+		gTaskList = append(gTaskList, *item)
+		item = &gTaskList[len(gTaskList)-1]
+	}
+	applyAppCfg(item, &item.cfg, &cfg)
+	item.cfg = cfg
+	item.Path = filepath.Join(path, "bin/"+item.cfg.BinName)
+	item.DiskUsage = getAppDiskUsage(appName)
+	item.LogEndTime = time.Now().Unix()
+	item.Version = getAppVersion(appName)
+	item.Hash = getAppHash(appName, cfg.BinName)
+	item.Package = pkg
+	if len(src) > 0 {
+		item.URL = src
+	}
+
+	if len(cfg.Hooks[defHookPreInstall]) > 0 {
+		writeAppHookEvent(item, defHookPreInstall, hookOut, hookCode, nil)
+	}
+	writeAppEventLog(item, "install %s success.", pkg)
+	postAppHookEvent(item, defHookPostInstall, env...)
+	// 覆盖安装时旧进程还在运行旧程序，版本变化后重启
+	if isAlive(item.Pid) && (item.Version != oldVersion || item.Hash != oldHash) {
+		stopApp(item)
+		postAppHookEvent(item, defHookPostStop)
+		err = startApp(item)
+		if err != nil {
+			writeAppEventLog(item, "restart %s after install failed: %s", item.Name, err.Error())
+		} else {
+			writeAppEventLog(item, "restart %s after install %s -> %s.", item.Name, oldVersion, item.Version)
+		}
+	}
+	if len(backup) > 0 {
+		os.RemoveAll(backup)
+	}
+	writeAppInfoFile()
+	return item, nil
+}
+
+// appSignTool 生成的 .tar 实际是 gzip 压缩的，按文件头判断是否需要解压缩
+func extractAppPackage(fn, dir string) error {
+	flag := "-xf"
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(fd, magic)
+	fd.Close()
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		flag = "-zxf"
+	}
+	out, err := exec.Command("tar", flag, fn, "-C", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s(%s)", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// 还原时保留目录本身，避免正在运行的旧进程工作目录失效
+func restoreAppDir(path, backup string) {
+	if len(backup) == 0 {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Println("remove error: ", path, "err: ", err)
+		}
+		return
+	}
+
+	filepath.Walk(path, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(path, fn)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(backup, rel)); os.IsNotExist(err) {
+			os.RemoveAll(fn)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+
+	out, err := exec.Command("cp", "-a", backup+"/.", path).CombinedOutput()
+	if err != nil {
+		log.Printf("restoreAppDir: %s(%s)\n", string(out), err)
+		return
+	}
+	os.RemoveAll(backup)
+}
+
+func getPackageAppName(pkg string) string {
+	appName := strings.TrimSuffix(pkg, ".gz")
+	appName = strings.TrimSuffix(appName, ".tgz")
+	appName = strings.TrimSuffix(appName, ".tar")
+	return appName
+}
+
+// 下载在独立的 goroutine 中进行，完成后作为普通的安装命令放回任务队列
+func handleAppInstallURL(ctl *taskCmd) {
+	log.Println("handleAppInstallURL: ", ctl.req.URL)
+
+	u, err := url.Parse(ctl.req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		writeCtlSimpleRsp(ctl, 1, "Error: invalid url "+ctl.req.URL)
+		return
+	}
+	name := path.Base(u.Path)
+	if false == gPackageName.MatchString(name) {
+		writeCtlSimpleRsp(ctl, 1, "Error: invalid package name in url "+ctl.req.URL)
+		return
+	}
+
+	gDownloadMutex.Lock()
+	if gDownloadList[name] {
+		gDownloadMutex.Unlock()
+		writeCtlSimpleRsp(ctl, 1, "Error: "+name+" is downloading.")
+		return
+	}
+	gDownloadList[name] = true
+	gDownloadMutex.Unlock()
+
+	go func() {
+		defer func() {
+			gDownloadMutex.Lock()
+			delete(gDownloadList, name)
+			gDownloadMutex.Unlock()
+		}()
+
+		fn := filepath.Join(defAppsFolder, name)
+		err := downloadAppPackage(ctl, fn)
+		gDownloadMutex.Lock()
 		if err != nil {
-			log.Println("readUnixgram error: ", err)
-			break
+			gDownloadError[ctl.req.URL] = err.Error()
+		} else {
+			delete(gDownloadError, ctl.req.URL)
+		}
+		gDownloadMutex.Unlock()
+		if err != nil {
+			recordDaemonError("download", "%s: %s", ctl.req.URL, err.Error())
+			writeCtlSimpleRsp(ctl, 1, "Download failed: "+err.Error())
+			return
 		}
 
-		//fmt.Println("recv:", string(buf[:size]), " from ", remote.String())
-		//gUnixConn.WriteToUnix(buf[:size], remote)
+		if len(ctl.req.Sha256) > 0 {
+			sum, err := getFileSha256(fn)
+			if err != nil || !strings.EqualFold(sum, ctl.req.Sha256) {
+				os.Remove(fn)
+				log.Printf("handleAppInstallURL: %s sha256 mismatch: %s\n", name, sum)
+				writeCtlSimpleRsp(ctl, 1, "Verify file sha256 failed.")
+				return
+			}
+		}
 
-		data := bytes.NewBuffer(buf[:size])
-		dec := gob.NewDecoder(data)
-		ctlReq := appCtlCmdReq{}
-		err = dec.Decode(&ctlReq)
+		install := &taskCmd{}
+		install.remote = ctl.remote
+		install.req.Cmd = APP_CTL_INSTALL
+		install.req.Name = name
+		install.req.URL = ctl.req.URL
+		install.next = ctl.next
+		gTaskChan <- install
+	}()
+}
+
+// 下载到 .part 文件，中断后再次下载时从已有长度处继续
+func downloadAppPackage(ctl *taskCmd, fn string) error {
+	part := fn + ".part"
+	var lastErr error
+	for i := 0; i < defDownloadRetry; i++ {
+		if i > 0 {
+			log.Printf("downloadAppPackage: %s retry %d: %s\n", ctl.req.URL, i, lastErr.Error())
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+
+		done, err := downloadRange(ctl, part)
 		if err != nil {
-			log.Println("decode error: ", err)
+			lastErr = err
 			continue
 		}
-
-		ctlCmd := &taskCmd{}
-		ctlCmd.remote = remote
-		ctlCmd.req = ctlReq
-		gTaskChan <- ctlCmd
+		if done {
+			return os.Rename(part, fn)
+		}
 	}
-	return nil
+	return lastErr
 }
 
-func handleAppInstall(ctl *taskCmd) {
-	fn := filepath.Join(defAppsFolder, ctl.req.Name)
-	log.Println("handleAppInstall: ", fn)
+// 连接和等待响应头有超时，读取正文时由 downloadRange 按空闲时间取消
+var gDownloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: defDownloadTimeout}).DialContext,
+		TLSHandshakeTimeout:   defDownloadTimeout,
+		ResponseHeaderTimeout: defDownloadTimeout,
+	},
+}
 
-	if false == checkFileIsExist(fn) {
-		writeCtlSimpleRsp(ctl, 1, "Error: File "+ctl.req.Name+" not exist.")
-		return
+func downloadRange(ctl *taskCmd, part string) (bool, error) {
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
 	}
-	cmd := exec.Command("/bin/sh", "-c", "tar -zxvf "+fn+" -C "+defAppsExtFolder)
-	out, err := cmd.CombinedOutput()
-	_ = out
+
+	req, err := http.NewRequest("GET", ctl.req.URL, nil)
 	if err != nil {
-		log.Printf("handleAppInstall: %s(%s)\n", string(out), err)
-		writeCtlSimpleRsp(ctl, 1, "Install decompress failed.")
-		return
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	//服务器停止发送数据超过 gDownloadIdle 时取消请求，避免下载一直挂起
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(gDownloadIdle, cancel)
+	defer idle.Stop()
+	resp, err := gDownloadClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		offset = 0
+	case http.StatusPartialContent:
+		if total >= 0 {
+			total += offset
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		//已经下载完整
+		return true, nil
+	default:
+		return false, errors.New(resp.Status)
 	}
 
-	appName := strings.TrimSuffix(ctl.req.Name, ".tar")
-	path := filepath.Join(defAppsExtFolder, appName)
-	cfg := loadAppCfg(path)
-	if false == rsaSignVerify(appName, cfg.BinName) {
-		path := filepath.Join(defAppsExtFolder, appName)
-		err := os.RemoveAll(path)
-		if err != nil {
-			log.Println("remove error: ", path, "err: ")
+	fd, err := os.OpenFile(part, flag, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	name := filepath.Base(strings.TrimSuffix(part, ".part"))
+	written := offset
+	lastTime := time.Now()
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		idle.Reset(gDownloadIdle)
+		if n > 0 {
+			if _, err := fd.Write(buf[:n]); err != nil {
+				return false, err
+			}
+			written += int64(n)
+		}
+		if time.Now().Sub(lastTime) > defDownloadProgressTime {
+			writeDownloadProgress(ctl, name, written, total)
+			lastTime = time.Now()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			fd.Sync()
+			return false, rerr
 		}
-		log.Printf("handleAppInstall: Verify sign failed.\n")
-		writeCtlSimpleRsp(ctl, 1, "Verify file sign failed.")
-		return
 	}
-	var item *taskItem
-	item = findAppItem(appName)
-	if item == nil {
-		item = &taskItem{}
-		item.Name = appName
-		item.Pid = 0
-		path := filepath.Join(defAppsExtFolder, appName)
-		item.cfg = cfg
-		item.Path = filepath.Join(path, "bin/"+item.cfg.BinName)
-		item.Cmd = int(APP_CMD_STOP)
-		item.Enable = 1
-		item.Status = int(APP_STATUS_INSTALL)
-		item.CPUThreshold = defCPUThreshold
-		item.MemThreshold = defMemThreshold
-		item.CPULimit = defCPULimit
-		item.MemLimit = defMemLimit
-		item.LogStartTime = time.Now().Unix()
-		item.LogEndTime = time.Now().Unix()
-		item.Version = getAppVersion(appName)
-		item.Hash = getAppHash(appName, cfg.BinName)
+	fd.Sync()
+	writeDownloadProgress(ctl, name, written, total)
 
-		writeAppEventLog(item, "install %s success.", ctl.req.Name)
-		gTaskList = append(gTaskList, *item)
+	if total >= 0 && written < total {
+		return false, io.ErrUnexpectedEOF
+	}
+	return true, nil
+}
 
-		writeAppInfoFile()
+func writeDownloadProgress(ctl *taskCmd, name string, written, total int64) {
+	rsp := &appCtlCmdRsp{}
+	rsp.Cmd = APP_CTL_INSTALL_PROGRESS
+	rsp.Name = name
+	rsp.Code = 0
+	if total > 0 {
+		rsp.Result = fmt.Sprintf("downloading %s %d/%d KB (%d%%)", name, written/1024, total/1024, written*100/total)
+	} else {
+		rsp.Result = fmt.Sprintf("downloading %s %d KB", name, written/1024)
+	}
+	writeCtlRsp(rsp, ctl.remote)
+}
+
+func getFileSha256(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
 	}
-	writeCtlSimpleRsp(ctl, 0, "Success.")
 
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func handleAppStart(ctl *taskCmd) {
@@ -856,6 +2471,7 @@ func handleAppStop(ctl *taskCmd) {
 			writeAppInfoFile()
 			writeCtlSimpleRsp(ctl, 0, "Success.")
 			writeAppEventLog(item, "stop %s success.", item.Name)
+			postAppHookEvent(item, defHookPostStop)
 		}
 
 	} else {
@@ -920,19 +2536,437 @@ func handleAppDisable(ctl *taskCmd) {
 	*/
 }
 
+// 重新读取 app.cfg，可在线生效的直接应用，进程相关配置变化时重启应用
+func handleAppReload(ctl *taskCmd) {
+	log.Println("handleAppReload: ", ctl.req.Name)
+
+	item := findAppItem(ctl.req.Name)
+	if item == nil {
+		writeCtlSimpleRsp(ctl, 2, "Error: App "+ctl.req.Name+" not exist.")
+		return
+	}
+	path := filepath.Join(defAppsExtFolder, item.Name)
+	cfg, err := readAppCfg(path)
+	if err != nil {
+		recordDaemonError("reload", "%s", err.Error())
+		writeCtlSimpleRsp(ctl, 1, "Error: "+err.Error())
+		return
+	}
+
+	changes := diffAppCfg(&item.cfg, &cfg)
+	if len(changes) == 0 {
+		writeCtlSimpleRsp(ctl, 0, "No change.")
+		return
+	}
+	//appsign.SignedKeys 中的字段和钩子脚本在签名范围内，修改后需要重新签名，其他字段可以直接修改
+	if false == rsaSignVerify(item.Name, cfg.BinName) {
+		writeCtlSimpleRsp(ctl, 1, "Verify file sign failed.")
+		writeAppEventLog(item, "reload %s operation failed, verify %s sign failed.", item.Name, defAppCfgFile)
+		return
+	}
+
+	restart := false
+	var str []string
+	for _, v := range changes {
+		str = append(str, fmt.Sprintf("%s: %s -> %s", v.Name, v.Old, v.New))
+		if v.Restart {
+			restart = true
+		}
+	}
+	applyAppCfg(item, &item.cfg, &cfg)
+	item.cfg = cfg
+	item.Path = filepath.Join(path, "bin/"+cfg.BinName)
+	item.Hash = getAppHash(item.Name, cfg.BinName)
+	item.LogEndTime = time.Now().Unix()
+
+	ret := strings.Join(str, "; ")
+	if restart && isAlive(item.Pid) {
+		stopApp(item)
+		postAppHookEvent(item, defHookPostStop)
+		err = startApp(item)
+		if err != nil {
+			ret += "; restart failed: " + err.Error()
+		} else {
+			ret += "; restarted"
+		}
+	}
+	writeAppEvent(item, "reload", nil, fmt.Sprintf("reload %s config: %s.", item.Name, ret))
+	writeAppInfoFile()
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, ret)
+		return
+	}
+	writeCtlSimpleRsp(ctl, 0, ret)
+}
+
+func handleAppExec(ctl *taskCmd) {
+	log.Println("handleAppExec: ", ctl.req.Name)
+
+	item := findAppItem(ctl.req.Name)
+	if item == nil {
+		writeCtlSimpleRsp(ctl, 2, "Error: App "+ctl.req.Name+" not exist.")
+		return
+	}
+	cmd := newAppCmd(item)
+	spec := appExecSpec{}
+	spec.Name = item.Name
+	spec.Dir = cmd.Dir
+	spec.Env = getAppEnv(item)
+	if isAlive(item.Pid) {
+		spec.Pid = item.Pid
+		spec.Limits = getAppRlimits(item.Pid)
+	}
+	data, err := json.Marshal(&spec)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppExec marshal error:", err)
+		return
+	}
+	writeAppEventLog(item, "exec %s requested.", item.Name)
+	writeCtlSimpleRsp(ctl, 0, string(data))
+}
+
+// /proc/<pid>/limits 每行顺序与 RLIMIT_* 编号一致
+func getAppRlimits(pid int) []appRlimit {
+	var lst []appRlimit
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/limits")
+	if err != nil {
+		return lst
+	}
+	parse := func(s string) uint64 {
+		if s == "unlimited" {
+			return ^uint64(0)
+		}
+		n, _ := strconv.ParseUint(s, 10, 64)
+		return n
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := 1; i < len(lines); i++ {
+		// 名称中有空格，固定占 26 列，后面依次为 soft/hard/units
+		if len(lines[i]) < 26 {
+			continue
+		}
+		fields := strings.Fields(lines[i][26:])
+		if len(fields) < 2 {
+			continue
+		}
+		lst = append(lst, appRlimit{Resource: i - 1, Cur: parse(fields[0]), Max: parse(fields[1])})
+	}
+	return lst
+}
+
+// 先在主循环中取应用信息，发信号、等待输出和打包放到协程中，避免阻塞监控
+func handleAppDump(ctl *taskCmd) {
+	log.Println("handleAppDump: ", ctl.req.Name, ctl.req.Kind)
+
+	item := findAppItem(ctl.req.Name)
+	if item == nil {
+		writeCtlSimpleRsp(ctl, 2, "Error: App "+ctl.req.Name+" not exist.")
+		return
+	}
+	if false == isAlive(item.Pid) {
+		writeCtlSimpleRsp(ctl, 1, "Error: App "+ctl.req.Name+" not running.")
+		return
+	}
+	sig, err := parseSignal(ctl.req.Kind)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Error: "+err.Error())
+		return
+	}
+	wait := defDumpWait
+	if ctl.req.Value > 0 {
+		wait = time.Duration(ctl.req.Value) * time.Millisecond
+	}
+	writeAppEventLog(item, "dump %s pid %d signal %d.", item.Name, item.Pid, int(sig))
+
+	name := item.Name
+	pid := item.Pid
+	go func() {
+		fn, err := dumpApp(name, pid, sig, wait)
+		if err != nil {
+			recordDaemonError("dump", "%s: %s", name, err.Error())
+			writeCtlSimpleRsp(ctl, 1, "Dump failed: "+err.Error())
+			return
+		}
+		writeCtlSimpleRsp(ctl, 0, fn)
+	}()
+}
+
+func parseSignal(str string) (syscall.Signal, error) {
+	str = strings.TrimPrefix(strings.ToUpper(str), "SIG")
+	switch str {
+	case "", "QUIT":
+		return syscall.SIGQUIT, nil
+	case "NONE":
+		return 0, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "ABRT":
+		return syscall.SIGABRT, nil
+	}
+	//不接受数字，避免 KILL、TERM 等信号通过 -dump 结束应用
+	return 0, errors.New("invalid signal " + str)
+}
+
+// 应用的 stdout/stderr 是普通文件时，取发信号后新增的内容作为输出
+func getAppOutput(pid int) map[string]int64 {
+	ret := make(map[string]int64)
+	for _, v := range []string{"1", "2"} {
+		fn, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/fd/" + v)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil || false == fi.Mode().IsRegular() {
+			continue
+		}
+		ret[fn] = fi.Size()
+	}
+	return ret
+}
+
+func readFileFrom(fn string, offset int64) []byte {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer fl.Close()
+	fi, err := fl.Stat()
+	if err != nil {
+		return nil
+	}
+	if fi.Size()-offset > defDumpOutputSize {
+		offset = fi.Size() - defDumpOutputSize
+	}
+	fl.Seek(offset, io.SeekStart)
+	data, _ := ioutil.ReadAll(io.LimitReader(fl, defDumpOutputSize))
+	return data
+}
+
+func dumpApp(name string, pid int, sig syscall.Signal, wait time.Duration) (string, error) {
+	proc := "/proc/" + strconv.Itoa(pid) + "/"
+	files := make(map[string][]byte)
+	for _, v := range []string{"status", "cmdline", "limits", "maps", "smaps_rollup", "stat", "io", "cgroup"} {
+		if data, err := ioutil.ReadFile(proc + v); err == nil {
+			files[v] = data
+		}
+	}
+	var fds bytes.Buffer
+	if lst, err := ioutil.ReadDir(proc + "fd"); err == nil {
+		for _, v := range lst {
+			target, _ := os.Readlink(proc + "fd/" + v.Name())
+			fmt.Fprintf(&fds, "%s -> %s\n", v.Name(), target)
+		}
+	}
+	files["fds"] = fds.Bytes()
+	var stacks bytes.Buffer
+	if lst, err := ioutil.ReadDir(proc + "task"); err == nil {
+		for _, v := range lst {
+			comm, _ := ioutil.ReadFile(proc + "task/" + v.Name() + "/comm")
+			stack, _ := ioutil.ReadFile(proc + "task/" + v.Name() + "/stack")
+			fmt.Fprintf(&stacks, "task %s %s%s\n", v.Name(), comm, stack)
+		}
+	}
+	files["stacks"] = stacks.Bytes()
+
+	output := getAppOutput(pid)
+	if sig != 0 {
+		err := syscall.Kill(pid, sig)
+		if err != nil {
+			return "", err
+		}
+		time.Sleep(wait)
+	}
+	var out bytes.Buffer
+	for fn, offset := range output {
+		fmt.Fprintf(&out, "==> %s <==\n", fn)
+		out.Write(readFileFrom(fn, offset))
+	}
+	if len(output) == 0 {
+		out.WriteString("stdout/stderr is not a regular file, output not captured.\n")
+	}
+	files["output"] = out.Bytes()
+	if data, err := ioutil.ReadFile(getAppEventLogFile(name)); err == nil {
+		files[defAppEventFile] = data
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(defAppsExtFolder, name, defAppCfgFile)); err == nil {
+		files[defAppCfgFile] = data
+	}
+
+	//不放在 defAppsLogFolder 下，避免计入应用磁盘占用触发超限重启
+	dir := filepath.Join(defDumpFolder, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("dump-%s-%d.tar.gz", time.Now().Format("20060102150405"), pid))
+	err = writeTarGz(fn, name+"-dump", files)
+	if err != nil {
+		os.Remove(fn)
+		return "", err
+	}
+	removeOldDumps(dir)
+	log.Println("dumpApp: ", fn)
+	return fn, nil
+}
+
+// 每个应用只保留最近 defDumpKeep 个，文件名中的时间保证按名称排序即按时间排序
+func removeOldDumps(dir string) {
+	lst, err := filepath.Glob(filepath.Join(dir, "dump-*.tar.gz"))
+	if err != nil || len(lst) <= defDumpKeep {
+		return
+	}
+	sort.Strings(lst)
+	for _, v := range lst[:len(lst)-defDumpKeep] {
+		os.Remove(v)
+	}
+}
+
+func writeTarGz(fn, prefix string, files map[string][]byte) error {
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gz)
+
+	var names []string
+	for k := range files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, v := range names {
+		hdr := &tar.Header{Name: prefix + "/" + v, Mode: 0644, Size: int64(len(files[v])), ModTime: now}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(files[v])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// 监听各应用目录下 app.cfg 的写入和替换，变化后投递内部 reload 命令
+func watchAppCfg() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		recordDaemonError("reload", "inotify init: %s", err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+
+	watchList := make(map[int]string)
+	addWatch := func(name string) {
+		if strings.HasPrefix(name, ".") {
+			return
+		}
+		wd, err := syscall.InotifyAddWatch(fd, filepath.Join(defAppsExtFolder, name), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			recordDaemonError("reload", "inotify watch %s: %s", name, err.Error())
+			return
+		}
+		watchList[wd] = name
+	}
+	root, err := syscall.InotifyAddWatch(fd, defAppsExtFolder, syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_ONLYDIR)
+	if err != nil {
+		recordDaemonError("reload", "inotify watch %s: %s", defAppsExtFolder, err.Error())
+		return
+	}
+	dirs, _ := ioutil.ReadDir(defAppsExtFolder)
+	for _, v := range dirs {
+		if v.IsDir() {
+			addWatch(v.Name())
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			recordDaemonError("reload", "inotify read: %s", err.Error())
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := ""
+			if ev.Len > 0 {
+				start := off + syscall.SizeofInotifyEvent
+				name = strings.TrimRight(string(buf[start:start+int(ev.Len)]), "\x00")
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			wd := int(ev.Wd)
+			switch {
+			case ev.Mask&syscall.IN_IGNORED != 0:
+				delete(watchList, wd)
+			case wd == root:
+				if ev.Mask&syscall.IN_ISDIR != 0 {
+					addWatch(name)
+				}
+			case name == defAppCfgFile && len(watchList[wd]) > 0:
+				log.Println("watchAppCfg: changed ", watchList[wd])
+				ctl := &taskCmd{}
+				ctl.req.Cmd = APP_CTL_RELOAD
+				ctl.req.Name = watchList[wd]
+				select {
+				case gTaskChan <- ctl:
+				default:
+					recordDaemonError("reload", "task queue full, drop reload %s", ctl.req.Name)
+				}
+			}
+		}
+	}
+}
+
 func handleAppRM(ctl *taskCmd) {
 	path := filepath.Join(defAppsExtFolder, ctl.req.Name)
 	fn := filepath.Join(path, ctl.req.Name)
 	log.Println("handleAppRM: ", fn)
 
-	code := int16(1)
-	ret := ""
 	item := findAppItem(ctl.req.Name)
-	if item != nil {
-		if item.Status == int(APP_STATUS_RUNNING) {
-			syscall.Kill(item.Pid, 9)
+	if item != nil && item.Status == int(APP_STATUS_RUNNING) {
+		syscall.Kill(item.Pid, 9)
+		item.Pid = 0
+		item.Status = int(APP_STATUS_STOP)
+		item.Cmd = int(APP_CMD_STOP)
+		//poststop 钩子在应用目录中，执行完再删除
+		name := item.Name
+		queued := queueAppHook(item, defHookPostStop, nil, func(out string, code int, err error) {
+			item := findAppItem(name)
+			if item == nil {
+				writeCtlSimpleRsp(ctl, 0, "Success.")
+				return
+			}
+			writeAppHookEvent(item, defHookPostStop, out, code, err)
+			removeApp(ctl, path, item)
+		})
+		if queued {
+			return
 		}
-	} else {
+	}
+	removeApp(ctl, path, item)
+}
+
+func removeApp(ctl *taskCmd, path string, item *taskItem) {
+	code := int16(1)
+	ret := ""
+	if item == nil {
 		code = 1
 		ret = "Operation failed."
 	}
@@ -949,6 +2983,7 @@ func handleAppRM(ctl *taskCmd) {
 	}
 
 	removeItem(item)
+	removeAppStats(ctl.req.Name)
 	writeAppInfoFile()
 	writeCtlSimpleRsp(ctl, code, ret)
 }
@@ -996,6 +3031,8 @@ func handleAppList(ctl *taskCmd) {
 			item.MemThreshold = v.MemThreshold
 			item.MemLimit = v.MemLimit
 			item.MemUsage = v.MemRate
+			item.DiskThreshold = v.DiskThreshold
+			item.DiskUsage = v.DiskUsage
 			item.StartTime = v.StartTime
 			item.LogsStartTime = 0
 			item.LogsEndTime = 0
@@ -1044,6 +3081,8 @@ func handleAppList(ctl *taskCmd) {
 			item.MemThreshold = v.MemThreshold
 			item.MemLimit = v.MemLimit
 			item.MemUsage = v.MemRate
+			item.DiskThreshold = v.DiskThreshold
+			item.DiskUsage = v.DiskUsage
 			item.StartTime = v.StartTime
 			if ctl.req.Log == 1 {
 				item.LogsStartTime = v.LogStartTime
@@ -1142,99 +3181,760 @@ func handleAppQueryMemThreshold(ctl *taskCmd) {
 	}
 }
 
-func handleAppConfigCPULimit(ctl *taskCmd) {
-	log.Printf("handleAppConfigCPULimit: %s -> %d\n", ctl.req.Name, ctl.req.Value)
-	var item *taskItem
-	item = findAppItem(ctl.req.Name)
-	if item != nil {
-		item.CPULimit = ctl.req.Value
-		item.LogEndTime = time.Now().Unix()
-		writeAppInfoFile()
-		writeCtlSimpleRsp(ctl, 0, "Success.")
-		writeAppEventLog(item, "config %s cpu limit success.", item.Name)
-	} else {
-		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
-		log.Println("handleAppConfigCPULimit findAppItem nil")
+func handleAppConfigCPULimit(ctl *taskCmd) {
+	log.Printf("handleAppConfigCPULimit: %s -> %d\n", ctl.req.Name, ctl.req.Value)
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		item.CPULimit = ctl.req.Value
+		item.LogEndTime = time.Now().Unix()
+		writeAppInfoFile()
+		writeCtlSimpleRsp(ctl, 0, "Success.")
+		writeAppEventLog(item, "config %s cpu limit success.", item.Name)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppConfigCPULimit findAppItem nil")
+	}
+}
+
+func handleAppConfigMemLimit(ctl *taskCmd) {
+	log.Printf("handleAppConfigMemLimit: %s -> %d\n", ctl.req.Name, ctl.req.Value)
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		item.MemLimit = ctl.req.Value
+		item.LogEndTime = time.Now().Unix()
+		writeAppInfoFile()
+		writeCtlSimpleRsp(ctl, 0, "Success.")
+		writeAppEventLog(item, "config %s memory limit success.", item.Name)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppConfigMemLimit findAppItem nil")
+	}
+}
+
+func handleAppQueryCPULimit(ctl *taskCmd) {
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		ret := strconv.Itoa(item.CPULimit)
+		writeCtlSimpleRsp(ctl, 0, ret)
+		log.Printf("handleAppQueryCPULimit: %s -> %s", ctl.req.Name, ret)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppQueryCPULimit findAppItem nil")
+	}
+}
+
+func handleAppQueryMemLimit(ctl *taskCmd) {
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		ret := strconv.Itoa(item.MemLimit)
+		writeCtlSimpleRsp(ctl, 0, ret)
+		log.Printf("handleAppQueryMemLimit: %s -> %s", ctl.req.Name, ret)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppQueryMemLimit findAppItem nil")
+	}
+}
+
+func handleAppConfigDiskThreshold(ctl *taskCmd) {
+	log.Printf("handleAppConfigDiskThreshold: %s -> %d\n", ctl.req.Name, ctl.req.Value)
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		item.DiskThreshold = ctl.req.Value
+		item.LogEndTime = time.Now().Unix()
+		writeAppInfoFile()
+		writeCtlSimpleRsp(ctl, 0, "Success.")
+		writeAppEventLog(item, "config %s disk threshold success.", item.Name)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppConfigDiskThreshold findAppItem nil")
+	}
+}
+
+func handleAppQueryDiskThreshold(ctl *taskCmd) {
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		ret := strconv.Itoa(item.DiskThreshold)
+		writeCtlSimpleRsp(ctl, 0, ret)
+		log.Printf("handleAppQueryDiskThreshold: %s -> %s", ctl.req.Name, ret)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppQueryDiskThreshold findAppItem nil")
+	}
+}
+
+func handleAppQueryDisk(ctl *taskCmd) {
+	var item *taskItem
+	item = findAppItem(ctl.req.Name)
+	if item != nil {
+		item.DiskUsage = getAppDiskUsage(item.Name)
+		ret := strconv.Itoa(item.DiskUsage)
+		writeCtlSimpleRsp(ctl, 0, ret)
+		log.Printf("handleAppQueryDisk: %s -> %s", ctl.req.Name, ret)
+	} else {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppQueryDisk findAppItem nil")
+	}
+}
+
+func handleAppLogs(ctl *taskCmd) {
+	log.Println("handleAppLogs:")
+
+	var ret string
+	for k, v := range gTaskList {
+		_ = k
+		ret += fmt.Sprintf("%s\n", v.LogFile)
+	}
+
+	writeCtlSimpleRsp(ctl, 0, ret)
+}
+
+func handleAppEvents(ctl *taskCmd) {
+	log.Printf("handleAppEvents: app=%s, kind=%s, since=%d, until=%d\n", ctl.req.Name, ctl.req.Kind, ctl.req.Since, ctl.req.Until)
+
+	var names []string
+	if len(ctl.req.Name) > 0 {
+		if findAppItem(ctl.req.Name) == nil && false == checkFileIsExist(getAppEventLogFile(ctl.req.Name)) {
+			writeCtlSimpleRsp(ctl, 2, "App is not exist.")
+			return
+		}
+		names = append(names, ctl.req.Name)
+	} else {
+		for _, v := range gTaskList {
+			names = append(names, v.Name)
+		}
+	}
+
+	var events []appEvent
+	for _, name := range names {
+		for _, ev := range readAppEvents(name) {
+			if len(ctl.req.Kind) > 0 && ev.Kind != ctl.req.Kind {
+				continue
+			}
+			if ctl.req.Since > 0 && ev.Time < ctl.req.Since {
+				continue
+			}
+			if ctl.req.Until > 0 && ev.Time > ctl.req.Until {
+				continue
+			}
+			events = append(events, ev)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time < events[j].Time
+	})
+
+	limit := ctl.req.Limit
+	if limit <= 0 {
+		limit = defAppEventPageSize
+	}
+	if limit > defAppEventPageMax {
+		limit = defAppEventPageMax
+	}
+
+	//默认返回最新的一页
+	page := appEventPage{}
+	page.Total = len(events)
+	page.Offset = ctl.req.Offset
+	if page.Offset < 0 {
+		page.Offset = len(events) - limit
+		if page.Offset < 0 {
+			page.Offset = 0
+		}
+	}
+	if page.Offset < len(events) {
+		end := page.Offset + limit
+		if end > len(events) {
+			end = len(events)
+		}
+		page.Items = events[page.Offset:end]
+	}
+	trimAppEventPage(&page, ctl.req.Offset < 0)
+
+	data, err := json.Marshal(&page)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppEvents marshal error:", err)
+		return
+	}
+	writeCtlSimpleRsp(ctl, 0, string(data))
+}
+
+// 按 JSON 大小截断一页，取最新一页时从前面丢弃，否则从后面丢弃，至少保留一条
+func trimAppEventPage(page *appEventPage, latest bool) {
+	size := 0
+	for i := range page.Items {
+		k := i
+		if latest {
+			k = len(page.Items) - 1 - i
+		}
+		data, _ := json.Marshal(&page.Items[k])
+		size += len(data) + 1
+		if size <= defAppEventPageBytes || i == 0 {
+			continue
+		}
+		if latest {
+			page.Offset += k + 1
+			page.Items = page.Items[k+1:]
+		} else {
+			page.Items = page.Items[:k]
+		}
+		return
+	}
+}
+
+func handleAppQueryAllResource(ctl *taskCmd) {
+	log.Println("handleAppQueryAllResource:")
+
+	lst := appResourceList{}
+	for k, v := range gTaskList {
+		_ = k
+		res := appResource{}
+		res.Name = v.Name
+		res.CPUThreshold = v.CPUThreshold
+		res.MemThreshold = v.MemThreshold
+		res.DiskThreshold = v.DiskThreshold
+		res.DiskUsage = v.DiskUsage
+		lst.Items = append(lst.Items, res)
+	}
+
+	data, err := json.Marshal(&lst)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppQueryAllResource marshal error:", err)
+		return
+	}
+	writeCtlSimpleRsp(ctl, 0, string(data))
+}
+
+func handleAppExport(ctl *taskCmd) {
+	log.Println("handleAppExport:")
+
+	state := exportState()
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppExport marshal error:", err)
+		return
+	}
+	writeCtlSimpleRsp(ctl, 0, string(data))
+}
+
+func exportState() daemonState {
+	state := daemonState{}
+	state.Version = version
+	state.Cid = gContainerID
+	state.Time = time.Now().Unix()
+	state.CPUThreshold = gCPUThreshold
+	state.MemThreshold = gMemThreshold
+	state.DiskThreshold = gDiskThreshold
+	persist := gStatsPersist
+	state.Policies = &policies{}
+	state.Policies.Shutdown = gShutdownMode
+	state.Policies.ShutdownGrace = int(gShutdownGrace / time.Second)
+	state.Policies.StallTimeout = int(gStallTimeout / time.Second)
+	state.Policies.StatsPersist = &persist
+	for _, v := range gTaskList {
+		app := appState{}
+		app.Name = v.Name
+		app.Version = v.Version
+		app.Hash = v.Hash
+		app.Package = v.Package
+		app.URL = v.URL
+		if len(v.Package) > 0 {
+			app.Sha256, _ = getFileSha256(filepath.Join(defAppsFolder, v.Package))
+		}
+		enable := v.Enable
+		start := v.Cmd == int(APP_CMD_START)
+		app.Enable = &enable
+		app.Start = &start
+		app.CPUThreshold = v.CPUThreshold
+		app.MemThreshold = v.MemThreshold
+		app.DiskThreshold = v.DiskThreshold
+		app.CPULimit = v.CPULimit
+		app.MemLimit = v.MemLimit
+		state.Apps = append(state.Apps, app)
+	}
+	return state
+}
+
+// Value 为 1 时只返回差异，不做修改
+func handleAppImport(ctl *taskCmd) {
+	log.Printf("handleAppImport: dry-run=%d, size=%d\n", ctl.req.Value, len(ctl.req.Data))
+
+	state := daemonState{}
+	err := json.Unmarshal(ctl.req.Data, &state)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Error: invalid state file: "+err.Error())
+		return
+	}
+
+	dryRun := ctl.req.Value == 1
+	actions, failed := reconcileState(&state, dryRun, func(app *appState) {
+		//下载安装完成后，再对这个应用执行一次导入，把配置对齐
+		u, err := url.Parse(app.URL)
+		if err != nil {
+			log.Println("handleAppImport parse url error:", err)
+			return
+		}
+		single := state
+		single.Apps = []appState{*app}
+		single.Apps[0].Package = path.Base(u.Path)
+		data, err := json.Marshal(&single)
+		if err != nil {
+			log.Println("handleAppImport marshal error:", err)
+			return
+		}
+		fetch := &taskCmd{}
+		fetch.req.Cmd = APP_CTL_INSTALL_URL
+		fetch.req.URL = app.URL
+		fetch.req.Sha256 = app.Sha256
+		fetch.next = &taskCmd{}
+		fetch.next.req.Cmd = APP_CTL_IMPORT
+		fetch.next.req.Data = data
+		handleAppInstallURL(fetch)
+	})
+
+	code := int16(0)
+	if failed {
+		code = 1
+	}
+	var ret []string
+	for _, v := range actions {
+		ret = append(ret, v.String())
+	}
+	if len(ret) == 0 {
+		ret = append(ret, "= no changes")
+	}
+	writeCtlSimpleRsp(ctl, code, strings.Join(ret, "\n"))
+}
+
+// 把当前状态对齐到 state，返回执行(或将要执行)的动作列表
+// 缺少安装包且有下载地址的应用交给 fetch 处理
+func reconcileState(state *daemonState, dryRun bool, fetch func(app *appState)) ([]reconcileAction, bool) {
+	var actions []reconcileAction
+	failed := false
+	add := func(app, op, format string, v ...interface{}) {
+		actions = append(actions, reconcileAction{App: app, Op: op, Msg: fmt.Sprintf(format, v...)})
+		if op == "!" {
+			failed = true
+		}
+	}
+
+	if state.CPUThreshold > 0 && state.CPUThreshold != gCPUThreshold {
+		add("", "~", "global cputhreshold %d -> %d", gCPUThreshold, state.CPUThreshold)
+		if !dryRun {
+			gCPUThreshold = state.CPUThreshold
+		}
+	}
+	if state.MemThreshold > 0 && state.MemThreshold != gMemThreshold {
+		add("", "~", "global memthreshold %d -> %d", gMemThreshold, state.MemThreshold)
+		if !dryRun {
+			gMemThreshold = state.MemThreshold
+		}
+	}
+	if state.DiskThreshold > 0 && state.DiskThreshold != gDiskThreshold {
+		add("", "~", "global diskthreshold %d -> %d", gDiskThreshold, state.DiskThreshold)
+		if !dryRun {
+			gDiskThreshold = state.DiskThreshold
+		}
+	}
+	if state.Policies != nil {
+		for _, v := range reconcilePolicies(state.Policies, dryRun) {
+			add(v.App, v.Op, "%s", v.Msg)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for k := range state.Apps {
+		app := &state.Apps[k]
+		wanted[app.Name] = true
+		item := findAppItem(app.Name)
+		drift := getAppDrift(item, app)
+		if item == nil || len(drift) > 0 {
+			act := "install"
+			if item != nil {
+				act = fmt.Sprintf("reinstall(%s)", drift)
+			}
+			if app.hold {
+				add(app.Name, "!", "%s %s: failed repeatedly, retry after %s", act, app.Name, app.retry.Format("15:04:05"))
+			} else if len(app.Package) > 0 && checkFileIsExist(filepath.Join(defAppsFolder, app.Package)) {
+				add(app.Name, "+", "%s %s from %s", act, app.Name, app.Package)
+				if dryRun {
+					continue
+				}
+				var err error
+				returned := false
+				want := *app
+				pending := installAppPackage(app.Package, app.URL, func(installed *taskItem, e error) {
+					if !returned {
+						item, err = installed, e
+						return
+					}
+					//preinstall 钩子执行完后继续对齐配置，失败时下次对齐重新安装
+					if e == nil {
+						reconcileAppConfig(installed, &want, false)
+						writeAppInfoFile()
+					}
+				})
+				returned = true
+				if pending {
+					add(app.Name, "+", "%s %s waiting for preinstall hook", act, app.Name)
+					continue
+				}
+				if err != nil {
+					add(app.Name, "!", "%s %s: %s", act, app.Name, err.Error())
+					continue
+				}
+				if drift := getAppDrift(item, app); len(drift) > 0 {
+					add(app.Name, "!", "%s still %s after install", app.Name, drift)
+				}
+			} else if len(app.URL) > 0 {
+				add(app.Name, "+", "fetch %s from %s", app.Name, app.URL)
+				if !dryRun && fetch != nil {
+					fetch(app)
+				}
+				continue
+			} else {
+				add(app.Name, "!", "%s %s: package missing", act, app.Name)
+				continue
+			}
+		}
+		if item == nil {
+			continue
+		}
+
+		actions = append(actions, reconcileAppConfig(item, app, dryRun)...)
+	}
+
+	for _, v := range gTaskList {
+		if !wanted[v.Name] {
+			add(v.Name, "-", "%s installed but not in state", v.Name)
+		}
+	}
+
+	if !dryRun && len(actions) > 0 {
+		writeAppInfoFile()
+	}
+	return actions, failed
+}
+
+func reconcilePolicies(p *policies, dryRun bool) []reconcileAction {
+	var actions []reconcileAction
+	add := func(op, format string, v ...interface{}) {
+		actions = append(actions, reconcileAction{Op: op, Msg: fmt.Sprintf(format, v...)})
+	}
+	setSeconds := func(field string, cur *time.Duration, val int) {
+		if val <= 0 || *cur == time.Duration(val)*time.Second {
+			return
+		}
+		add("~", "policy %s %d -> %d", field, int(*cur/time.Second), val)
+		if !dryRun {
+			*cur = time.Duration(val) * time.Second
+		}
+	}
+
+	if len(p.Shutdown) > 0 && p.Shutdown != gShutdownMode {
+		if p.Shutdown != defShutdownStop && p.Shutdown != defShutdownDetach {
+			add("!", "policy shutdown %s: must be %s or %s", p.Shutdown, defShutdownStop, defShutdownDetach)
+		} else {
+			add("~", "policy shutdown %s -> %s", gShutdownMode, p.Shutdown)
+			if !dryRun {
+				gShutdownMode = p.Shutdown
+			}
+		}
+	}
+	setSeconds("shutdowngrace", &gShutdownGrace, p.ShutdownGrace)
+	setSeconds("stalltimeout", &gStallTimeout, p.StallTimeout)
+	if p.StatsPersist != nil && *p.StatsPersist != gStatsPersist {
+		add("~", "policy statspersist %v -> %v", gStatsPersist, *p.StatsPersist)
+		if !dryRun {
+			gStatsPersist = *p.StatsPersist
+		}
+	}
+	return actions
+}
+
+// 检查磁盘上的应用与期望状态是否一致：被手动删除、版本或程序不符
+func getAppDrift(item *taskItem, app *appState) string {
+	if item == nil {
+		return ""
 	}
+	if false == checkFileIsExist(item.Path) {
+		return "removed"
+	}
+	if len(app.Version) > 0 && getAppVersion(item.Name) != app.Version {
+		return "version " + getAppVersion(item.Name) + " != " + app.Version
+	}
+	if len(app.Hash) > 0 && getAppHash(item.Name, item.cfg.BinName) != app.Hash {
+		return "hash mismatch"
+	}
+	return ""
 }
 
-func handleAppConfigMemLimit(ctl *taskCmd) {
-	log.Printf("handleAppConfigMemLimit: %s -> %d\n", ctl.req.Name, ctl.req.Value)
-	var item *taskItem
-	item = findAppItem(ctl.req.Name)
-	if item != nil {
-		item.MemLimit = ctl.req.Value
+func reconcileAppConfig(item *taskItem, app *appState, dryRun bool) []reconcileAction {
+	var actions []reconcileAction
+	add := func(op, format string, v ...interface{}) {
+		actions = append(actions, reconcileAction{App: item.Name, Op: op, Msg: fmt.Sprintf(format, v...)})
+	}
+	setInt := func(field string, cur *int, val int) {
+		if val <= 0 || *cur == val {
+			return
+		}
+		add("~", "%s %s %d -> %d", item.Name, field, *cur, val)
+		if !dryRun {
+			*cur = val
+		}
+	}
+	setInt("cputhreshold", &item.CPUThreshold, app.CPUThreshold)
+	setInt("memthreshold", &item.MemThreshold, app.MemThreshold)
+	setInt("diskthreshold", &item.DiskThreshold, app.DiskThreshold)
+	setInt("cpulimit", &item.CPULimit, app.CPULimit)
+	setInt("memlimit", &item.MemLimit, app.MemLimit)
+
+	//未填写 enable、start 时保持当前值
+	if app.Enable != nil && item.Enable != *app.Enable {
+		add("~", "%s enable %d -> %d", item.Name, item.Enable, *app.Enable)
+		if !dryRun {
+			item.Enable = *app.Enable
+		}
+	}
+
+	running := item.Cmd == int(APP_CMD_START)
+	if app.Start != nil && *app.Start && !running {
+		add(">", "start %s", item.Name)
+		if !dryRun {
+			item.Cmd = int(APP_CMD_START)
+			if false == isAlive(item.Pid) {
+				if err := startApp(item); err != nil {
+					add("!", "start %s: %s", item.Name, err.Error())
+				}
+			}
+		}
+	} else if app.Start != nil && !*app.Start && running {
+		add("<", "stop %s", item.Name)
+		if !dryRun {
+			item.Cmd = int(APP_CMD_STOP)
+			if isAlive(item.Pid) {
+				stopApp(item)
+				postAppHookEvent(item, defHookPostStop)
+			}
+			item.Pid = 0
+			item.Status = int(APP_STATUS_STOP)
+		}
+	}
+
+	if !dryRun && len(actions) > 0 {
+		var str []string
+		for _, v := range actions {
+			str = append(str, v.String())
+		}
 		item.LogEndTime = time.Now().Unix()
-		writeAppInfoFile()
-		writeCtlSimpleRsp(ctl, 0, "Success.")
-		writeAppEventLog(item, "config %s memory limit success.", item.Name)
-	} else {
-		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
-		log.Println("handleAppConfigMemLimit findAppItem nil")
+		writeAppEventLog(item, "reconcile %s config: %s", item.Name, strings.Join(str, "; "))
 	}
+	return actions
 }
 
-func handleAppQueryCPULimit(ctl *taskCmd) {
-	var item *taskItem
-	item = findAppItem(ctl.req.Name)
-	if item != nil {
-		ret := strconv.Itoa(item.CPULimit)
-		writeCtlSimpleRsp(ctl, 0, ret)
-		log.Printf("handleAppQueryCPULimit: %s -> %s", ctl.req.Name, ret)
-	} else {
-		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
-		log.Println("handleAppQueryCPULimit findAppItem nil")
+// desired.yaml 存在时按其内容持续对齐，文件变化或到达周期时执行一次
+func checkDesiredState(force bool) {
+	fn := filepath.Join(gAppCurrentPath, defDesiredFile)
+	fi, err := os.Stat(fn)
+	if err != nil {
+		if len(gReconcileList.File) > 0 {
+			log.Println("checkDesiredState: desired state removed, reconcile stopped")
+			gReconcileList = reconcileStatusList{}
+		}
+		return
+	}
+	if !force && fi.ModTime().Equal(gDesiredTime) && time.Now().Sub(gReconcileTime) < defReconcileTime {
+		return
+	}
+	changed := !fi.ModTime().Equal(gDesiredTime)
+	gDesiredTime = fi.ModTime()
+	gReconcileTime = time.Now()
+	gReconcileList.File = fn
+	gReconcileList.Time = gReconcileTime.Unix()
+
+	content, err := ioutil.ReadFile(fn)
+	if err == nil {
+		content, err = yaml.YAMLToJSON(content)
+	}
+	state := daemonState{}
+	if err == nil {
+		err = json.Unmarshal(content, &state)
+	}
+	if err != nil {
+		if changed {
+			recordDaemonError("reconcile", "%s: %s", fn, err.Error())
+		}
+		gReconcileList.Error = err.Error()
+		return
+	}
+	gReconcileList.Error = ""
+	if changed {
+		log.Printf("checkDesiredState: load %s, apps=%d\n", fn, len(state.Apps))
+	}
+	//立即执行或文件变化时不等待退避
+	for k := range state.Apps {
+		app := &state.Apps[k]
+		if b, ok := gReconcileRetry[app.Name]; ok && !force && !changed && gReconcileTime.Before(b.next) {
+			app.hold = true
+			app.retry = b.next
+		}
 	}
-}
 
-func handleAppQueryMemLimit(ctl *taskCmd) {
-	var item *taskItem
-	item = findAppItem(ctl.req.Name)
-	if item != nil {
-		ret := strconv.Itoa(item.MemLimit)
-		writeCtlSimpleRsp(ctl, 0, ret)
-		log.Printf("handleAppQueryMemLimit: %s -> %s", ctl.req.Name, ret)
-	} else {
-		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
-		log.Println("handleAppQueryMemLimit findAppItem nil")
+	actions, _ := reconcileState(&state, false, func(app *appState) {
+		fetch := &taskCmd{}
+		fetch.req.Cmd = APP_CTL_INSTALL_URL
+		fetch.req.URL = app.URL
+		fetch.req.Sha256 = app.Sha256
+		handleAppInstallURL(fetch)
+	})
+
+	appActions := make(map[string][]reconcileAction)
+	for _, v := range actions {
+		log.Println("checkDesiredState:", v.String())
+		appActions[v.App] = append(appActions[v.App], v)
+	}
+	updateReconcileBackoff(&state, appActions)
+
+	var items []reconcileStatus
+	names := []string{}
+	fetchError := make(map[string]string)
+	gDownloadMutex.Lock()
+	for _, v := range state.Apps {
+		names = append(names, v.Name)
+		if len(v.URL) > 0 && len(gDownloadError[v.URL]) > 0 {
+			fetchError[v.Name] = "last fetch failed: " + gDownloadError[v.URL]
+		}
+	}
+	gDownloadMutex.Unlock()
+	for _, v := range gTaskList {
+		if _, ok := appActions[v.Name]; ok && !containsString(names, v.Name) {
+			names = append(names, v.Name)
+		}
 	}
+	for _, name := range names {
+		st := reconcileStatus{}
+		st.Name = name
+		st.Status = "Synced"
+		st.Time = gReconcileTime.Unix()
+		var msg []string
+		for _, v := range appActions[name] {
+			switch v.Op {
+			case "!":
+				st.Status = "Degraded"
+			case "+":
+				if st.Status == "Synced" && strings.HasPrefix(v.Msg, "fetch") {
+					st.Status = "Progressing"
+					if len(fetchError[name]) > 0 {
+						st.Status = "Degraded"
+						msg = append(msg, fetchError[name])
+					}
+				}
+			case "-":
+				st.Status = "Unmanaged"
+			}
+			msg = append(msg, v.String())
+		}
+		st.Message = strings.Join(msg, "; ")
+		items = append(items, st)
+	}
+	gReconcileList.Items = items
 }
 
-func handleAppLogs(ctl *taskCmd) {
-	log.Println("handleAppLogs:")
-
-	var ret string
-	for k, v := range gTaskList {
-		_ = k
-		ret += fmt.Sprintf("%s\n", v.LogFile)
+// 本轮需要安装、下载或失败的应用增加失败次数，退避时间按次数加倍，对齐后清除
+func updateReconcileBackoff(state *daemonState, appActions map[string][]reconcileAction) {
+	for _, app := range state.Apps {
+		if app.hold {
+			continue
+		}
+		retry := false
+		for _, v := range appActions[app.Name] {
+			if v.Op == "!" || v.Op == "+" {
+				retry = true
+			}
+		}
+		if !retry {
+			delete(gReconcileRetry, app.Name)
+			continue
+		}
+		b := gReconcileRetry[app.Name]
+		if b == nil {
+			b = &reconcileBackoff{}
+			gReconcileRetry[app.Name] = b
+		}
+		b.fails++
+		delay := defReconcileBackoffMax
+		if b.fails < 16 {
+			delay = defReconcileTime << uint(b.fails-1)
+		}
+		if delay > defReconcileBackoffMax {
+			delay = defReconcileBackoffMax
+		}
+		b.next = gReconcileTime.Add(delay)
+		if b.fails > 1 {
+			log.Printf("checkDesiredState: %s failed %d times, next retry after %s\n", app.Name, b.fails, delay)
+		}
+	}
+	for name := range gReconcileRetry {
+		found := false
+		for _, v := range state.Apps {
+			found = found || v.Name == name
+		}
+		if !found {
+			delete(gReconcileRetry, name)
+		}
 	}
+}
 
-	writeCtlSimpleRsp(ctl, 0, ret)
+func containsString(list []string, str string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
 }
 
-func handleAppQueryAllResource(ctl *taskCmd) {
-	log.Println("handleAppQueryAllResource:")
+// Value 为 1 时立即执行一次对齐
+func handleAppReconcileStatus(ctl *taskCmd) {
+	log.Println("handleAppReconcileStatus:")
 
-	lst := appResourceList{}
-	for k, v := range gTaskList {
-		_ = k
-		res := appResource{}
-		res.Name = v.Name
-		res.CPUThreshold = v.CPUThreshold
-		res.MemThreshold = v.MemThreshold
-		lst.Items = append(lst.Items, res)
+	if ctl.req.Value == 1 {
+		checkDesiredState(true)
+	}
+	if len(gReconcileList.File) == 0 {
+		writeCtlSimpleRsp(ctl, 2, "Desired state is not configured: "+filepath.Join(gAppCurrentPath, defDesiredFile))
+		return
 	}
 
-	data, err := json.Marshal(&lst)
+	data, err := json.Marshal(&gReconcileList)
 	if err != nil {
 		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
-		log.Println("handleAppQueryAllResource marshal error:", err)
+		log.Println("handleAppReconcileStatus marshal error:", err)
 		return
 	}
-	writeCtlSimpleRsp(ctl, 0, string(data))
+	code := int16(0)
+	if len(gReconcileList.Error) > 0 {
+		code = 1
+	}
+	writeCtlSimpleRsp(ctl, code, string(data))
+}
+
+func (a reconcileAction) String() string {
+	return a.Op + " " + a.Msg
 }
 
 func writeCtlSimpleRsp(ctl *taskCmd, code int16, ret string) {
+	if ctl.remote == nil {
+		return
+	}
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
 	rsp := &appCtlCmdRsp{}
@@ -1255,6 +3955,9 @@ func writeCtlSimpleRsp(ctl *taskCmd, code int16, ret string) {
 }
 
 func writeCtlRsp(rsp *appCtlCmdRsp, remote *net.UnixAddr) {
+	if remote == nil {
+		return
+	}
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
 	err := enc.Encode(rsp)
@@ -1266,7 +3969,7 @@ func writeCtlRsp(rsp *appCtlCmdRsp, remote *net.UnixAddr) {
 	l, err := gUnixConn.WriteToUnix(buf.Bytes(), remote)
 	log.Printf("buf size=%d, send size=%d\n", buf.Len(), l)
 	if err != nil {
-		log.Println("writeCtlRsp error: ", err)
+		recordDaemonError("socket", "write %s: %s", remote.String(), err.Error())
 		return
 	}
 }
@@ -1353,6 +4056,30 @@ func getAppMem(name string, pid int) int {
 	return 0
 }
 
+// 统计应用目录和日志目录占用的磁盘空间，单位MB
+func getAppDiskUsage(name string) int {
+	var size int64
+	dirs := []string{filepath.Join(defAppsExtFolder, name), filepath.Join(defAppsLogFolder, name)}
+	for _, dir := range dirs {
+		if false == checkFileIsExist(dir) {
+			continue
+		}
+		filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+			if err != nil || f == nil {
+				return nil
+			}
+			if st, ok := f.Sys().(*syscall.Stat_t); ok {
+				size += st.Blocks * 512
+			} else {
+				size += f.Size()
+			}
+			return nil
+		})
+	}
+
+	return int((size + 1024*1024 - 1) / (1024 * 1024))
+}
+
 func getAppVersion(name string) string {
 	path := filepath.Join(defAppsExtFolder, name)
 	fn := filepath.Join(path, defAppVersionFile)
@@ -1459,18 +4186,22 @@ func getAppSign(appName, binName string) []byte {
 	return content
 }
 
+// 签名内容见 appsign.Digest，没有钩子的旧安装包只对程序签名，仍然接受，这类包的 app.cfg 不受签名保护
 func rsaSignVerify(appName, binName string) bool {
-	data := getAppHashBytes(appName, binName)
-	hashed := sha256.Sum256(data)
-	block, _ := pem.Decode([]byte(publicKey))
-	if block == nil {
-		log.Println("rsaSignVerify: public key error")
+	dir := filepath.Join(defAppsExtFolder, appName)
+	binSum := getAppHashBytes(appName, binName)
+	if binSum == nil {
 		return false
 	}
-	// 解析公钥
-	pubInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	content, err := ioutil.ReadFile(filepath.Join(dir, defAppCfgFile))
 	if err != nil {
-		log.Println("rsaSignVerify: parse public key error: ", err)
+		log.Println("rsaSignVerify: ", err)
+		return false
+	}
+	cfg := appCfg{}
+	err = json.Unmarshal(content, &cfg)
+	if err != nil {
+		log.Println("rsaSignVerify: ", err)
 		return false
 	}
 
@@ -1478,15 +4209,17 @@ func rsaSignVerify(appName, binName string) bool {
 	if signature == nil {
 		return false
 	}
-	// 类型断言
-	pub := pubInterface.(*rsa.PublicKey)
-	//验证签名
-	err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature)
+	read := func(script string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(dir, script))
+	}
+	legacy, err := appsign.VerifyPackage(binSum, content, cfg.Hooks, read, signature)
 	if err != nil {
 		log.Println("rsaSignVerify: verify sign error: ", err)
 		return false
 	}
-
+	if legacy {
+		log.Printf("rsaSignVerify: %s has no hooks and is signed with old format, %s not protected\n", appName, defAppCfgFile)
+	}
 	return true
 }
 
@@ -1497,21 +4230,291 @@ func writeAppInfoFile() {
 }
 
 func sendWarnNotify(name, kind string, value, threshold int) {
+	if item := findAppItem(name); item != nil && item.cfg.NoNotify {
+		return
+	}
 	warn := warnNotify{}
 	warn.Cid = gContainerID
 	warn.Kind = kind
 	warn.Name = name
 	warn.Threshold = threshold
 	warn.Value = value
+	warn.Trend = getAppTrend(name, kind)
 	data, err := json.Marshal(&warn)
 	if err != nil {
 		log.Println("sendWarnNotify marshal error:", err)
 		return
 	}
+	if gUDPConn == nil {
+		return
+	}
 
 	_, err = gUDPConn.Write(data)
 	if err != nil {
-		log.Println("sendWarnNotify udp write error:", err)
+		recordDaemonError("notify", "udp write: %s", err.Error())
+		return
+	}
+}
+
+func (r *sampleRing) push(s resSample, size int) {
+	if r.items == nil {
+		r.items = make([]resSample, size)
+	}
+	r.items[r.pos] = s
+	r.pos = (r.pos + 1) % len(r.items)
+	if r.pos == 0 {
+		r.full = true
+	}
+}
+
+// 按时间先后返回 since 之后的采样
+func (r *sampleRing) list(since int64) []resSample {
+	var ret []resSample
+	if r.items == nil {
+		return ret
+	}
+	start, n := 0, r.pos
+	if r.full {
+		start, n = r.pos, len(r.items)
+	}
+	for i := 0; i < n; i++ {
+		s := r.items[(start+i)%len(r.items)]
+		if s.Time >= since {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func (r *sampleRing) oldest() int64 {
+	if r.items == nil || (!r.full && r.pos == 0) {
+		return 0
+	}
+	if r.full {
+		return r.items[r.pos].Time
+	}
+	return r.items[0].Time
+}
+
+func getAppStats(name string) *appStats {
+	st, ok := gStatsList[name]
+	if !ok {
+		st = &appStats{}
+		gStatsList[name] = st
+	}
+	return st
+}
+
+func recordAppSample(name string, cpu, mem, disk int) {
+	st := getAppStats(name)
+	now := time.Now().Unix()
+	if cpu > math.MaxInt16 {
+		cpu = math.MaxInt16
+	}
+	if mem > math.MaxInt16 {
+		mem = math.MaxInt16
+	}
+	s := resSample{Time: now, CPU: int16(cpu), CPUMax: int16(cpu), Mem: int16(mem), MemMax: int16(mem), Disk: int32(disk)}
+	st.raw.push(s, defStatsRawSize)
+
+	minute := now - now%60
+	if st.count > 0 && st.cur.Time != minute {
+		flushAppMinute(name, st)
+	}
+	if st.count == 0 {
+		st.cur = resSample{Time: minute}
+	}
+	st.count++
+	st.cpuSum += cpu
+	st.memSum += mem
+	if s.CPUMax > st.cur.CPUMax {
+		st.cur.CPUMax = s.CPUMax
+	}
+	if s.MemMax > st.cur.MemMax {
+		st.cur.MemMax = s.MemMax
+	}
+	st.cur.Disk = s.Disk
+}
+
+func flushAppMinute(name string, st *appStats) {
+	st.cur.CPU = int16(st.cpuSum / st.count)
+	st.cur.Mem = int16(st.memSum / st.count)
+	st.minute.push(st.cur, defStatsMinuteSize)
+	if gStatsPersist {
+		appendAppStatsFile(name, &st.cur)
+	}
+	st.count = 0
+	st.cpuSum = 0
+	st.memSum = 0
+}
+
+func getAppStatsFile(name string) string {
+	return filepath.Join(gAppCurrentPath, defStatsFolder, name+".dat")
+}
+
+// 文件超过保留长度两倍时用内存中的分钟记录重写，避免运行中无限增长
+func appendAppStatsFile(name string, s *resSample) {
+	fn := getAppStatsFile(name)
+	os.MkdirAll(filepath.Dir(fn), 0755)
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println("appendAppStatsFile: ", err)
+		return
+	}
+	binary.Write(fd, binary.LittleEndian, s)
+	fi, err := fd.Stat()
+	fd.Close()
+	if err == nil && fi.Size() > int64(2*defStatsMinuteSize*binary.Size(resSample{})) {
+		writeAppStatsFile(name, getAppStats(name).minute.list(0))
+	}
+}
+
+// 先写临时文件再改名，重写过程中退出不会丢失原有记录
+func writeAppStatsFile(name string, samples []resSample) {
+	fn := getAppStatsFile(name)
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.LittleEndian, samples)
+	err := ioutil.WriteFile(fn+".tmp", out.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	if err != nil {
+		log.Println("writeAppStatsFile: ", err)
+	}
+}
+
+// 加载持久化的分钟记录，文件超过保留长度两倍时重写
+func loadAppStats(name string) {
+	fn := getAppStatsFile(name)
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+
+	var samples []resSample
+	buf := bytes.NewReader(content)
+	for {
+		s := resSample{}
+		if binary.Read(buf, binary.LittleEndian, &s) != nil {
+			break
+		}
+		samples = append(samples, s)
+	}
+	if len(samples) > defStatsMinuteSize {
+		samples = samples[len(samples)-defStatsMinuteSize:]
+	}
+	if int64(len(content)) > int64(2*defStatsMinuteSize*binary.Size(resSample{})) {
+		writeAppStatsFile(name, samples)
+	}
+
+	st := getAppStats(name)
+	for _, s := range samples {
+		st.minute.push(s, defStatsMinuteSize)
+	}
+	log.Printf("loadAppStats: %s %d samples\n", name, len(samples))
+}
+
+func removeAppStats(name string) {
+	delete(gStatsList, name)
+	os.Remove(getAppStatsFile(name))
+}
+
+// 最近 defStatsTrendSize 分钟的平均值，不足一分钟时用秒级采样
+func getAppTrend(name, kind string) []int {
+	st, ok := gStatsList[name]
+	if !ok {
+		return nil
+	}
+	samples := st.minute.list(0)
+	if len(samples) == 0 {
+		samples = st.raw.list(0)
+	}
+	if len(samples) > defStatsTrendSize {
+		samples = samples[len(samples)-defStatsTrendSize:]
+	}
+
+	var trend []int
+	for _, s := range samples {
+		switch kind {
+		case "cpu":
+			trend = append(trend, int(s.CPU))
+		case "mem":
+			trend = append(trend, int(s.Mem))
+		case "disk":
+			trend = append(trend, int(s.Disk))
+		}
+	}
+	return trend
+}
+
+func calcStatsValue(vals []int, maxs []int) statsValue {
+	v := statsValue{}
+	if len(vals) == 0 {
+		return v
+	}
+	sum := 0
+	v.Min = vals[0]
+	for _, val := range vals {
+		sum += val
+		if val < v.Min {
+			v.Min = val
+		}
+	}
+	for _, val := range maxs {
+		if val > v.Max {
+			v.Max = val
+		}
+	}
+	v.Avg = sum / len(vals)
+	sorted := append([]int{}, vals...)
+	sort.Ints(sorted)
+	v.P95 = sorted[(len(sorted)*95+99)/100-1]
+	return v
+}
+
+// Since 落在秒级采样范围内时用秒级数据，否则用分钟数据
+func handleAppStats(ctl *taskCmd) {
+	log.Printf("handleAppStats: %s since %d\n", ctl.req.Name, ctl.req.Since)
+
+	st, ok := gStatsList[ctl.req.Name]
+	if !ok {
+		if findAppItem(ctl.req.Name) == nil {
+			writeCtlSimpleRsp(ctl, 2, "App is not exist.")
+			return
+		}
+		st = &appStats{}
+	}
+
+	ret := appStatsResult{}
+	ret.Name = ctl.req.Name
+	ret.Since = ctl.req.Since
+	samples := st.raw.list(ctl.req.Since)
+	ret.Resolution = "1s"
+	if oldest := st.raw.oldest(); oldest == 0 || ctl.req.Since < oldest {
+		if minutes := st.minute.list(ctl.req.Since); len(minutes) > 0 {
+			samples = minutes
+			ret.Resolution = "1m"
+		}
+	}
+	ret.Samples = len(samples)
+
+	var cpu, cpuMax, mem, memMax, disk []int
+	for _, s := range samples {
+		cpu = append(cpu, int(s.CPU))
+		cpuMax = append(cpuMax, int(s.CPUMax))
+		mem = append(mem, int(s.Mem))
+		memMax = append(memMax, int(s.MemMax))
+		disk = append(disk, int(s.Disk))
+	}
+	ret.CPU = calcStatsValue(cpu, cpuMax)
+	ret.Mem = calcStatsValue(mem, memMax)
+	ret.Disk = calcStatsValue(disk, disk)
+
+	data, err := json.Marshal(&ret)
+	if err != nil {
+		writeCtlSimpleRsp(ctl, 1, "Operation failed.")
+		log.Println("handleAppStats marshal error:", err)
 		return
 	}
+	writeCtlSimpleRsp(ctl, 0, string(data))
 }
@@ -0,0 +1,352 @@
+package main
+
+// go test appctl-daemon.go appctl-daemon_test.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 记录每次请求的 Range 头，前 abort 次请求只发送 half 字节后断开
+type rangeServer struct {
+	sync.Mutex
+	data   []byte
+	half   int
+	abort  int
+	stall  bool
+	ranges []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	cut := len(s.ranges) <= s.abort
+	s.Unlock()
+
+	if cut {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.data[:s.half])
+		w.(http.Flusher).Flush()
+		if s.stall {
+			<-r.Context().Done()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "app.tar.gz", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *rangeServer) getRanges() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func testPackageData() []byte {
+	data := make([]byte, 200*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func testDownload(t *testing.T, srv *rangeServer, part []byte) []string {
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "app.tar.gz")
+	if part != nil {
+		if err := ioutil.WriteFile(fn+".part", part, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctl := &taskCmd{}
+	ctl.req.URL = ts.URL + "/app.tar.gz"
+	if err := downloadAppPackage(ctl, fn); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if false == bytes.Equal(got, srv.data) {
+		t.Fatalf("downloaded %d bytes, content mismatch", len(got))
+	}
+	if _, err := os.Stat(fn + ".part"); false == os.IsNotExist(err) {
+		t.Fatalf("part file not removed: %v", err)
+	}
+	return srv.getRanges()
+}
+
+func checkRanges(t *testing.T, got []string, want ...string) {
+	if len(got) != len(want) {
+		t.Fatalf("requests %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("requests %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	srv := &rangeServer{data: testPackageData(), half: 64 * 1024, abort: 1}
+	ranges := testDownload(t, srv, nil)
+	checkRanges(t, ranges, "", "bytes=65536-")
+}
+
+func TestDownloadExistingPart(t *testing.T) {
+	data := testPackageData()
+	srv := &rangeServer{data: data}
+	ranges := testDownload(t, srv, data[:1000])
+	checkRanges(t, ranges, "bytes=1000-")
+}
+
+// 服务器不支持 Range 时返回 200，已有的 .part 内容要丢弃
+func TestDownloadRangeIgnored(t *testing.T) {
+	data := testPackageData()
+	srv := &rangeServer{data: data, half: 1000, abort: 1}
+	ranges := testDownload(t, srv, []byte("stale"))
+	checkRanges(t, ranges, "bytes=5-", "bytes=1000-")
+}
+
+func TestDownloadComplete(t *testing.T) {
+	data := testPackageData()
+	srv := &rangeServer{data: data}
+	ranges := testDownload(t, srv, data)
+	checkRanges(t, ranges, "bytes="+strconv.Itoa(len(data))+"-")
+}
+
+// 服务器发送一部分后停止，空闲超时后从断点继续
+func TestDownloadStall(t *testing.T) {
+	old := gDownloadIdle
+	gDownloadIdle = 200 * time.Millisecond
+	defer func() { gDownloadIdle = old }()
+
+	srv := &rangeServer{data: testPackageData(), half: 32 * 1024, abort: 1, stall: true}
+	ranges := testDownload(t, srv, nil)
+	checkRanges(t, ranges, "", "bytes=32768-")
+}
+
+// 带钩子输出的事件按大小分页，最新一页保留末尾的事件
+func TestTrimAppEventPage(t *testing.T) {
+	var events []appEvent
+	for i := 0; i < defAppEventPageMax; i++ {
+		events = append(events, appEvent{Time: int64(i), App: "app", Kind: "hook", Message: strings.Repeat("x", 4096)})
+	}
+
+	page := appEventPage{Total: len(events), Offset: 0, Items: events}
+	trimAppEventPage(&page, true)
+	data, _ := json.Marshal(&page)
+	if len(data) > 64*1024-1024 || len(page.Items) == 0 {
+		t.Fatalf("latest page %d bytes, %d items", len(data), len(page.Items))
+	}
+	if page.Offset+len(page.Items) != len(events) || page.Items[len(page.Items)-1].Time != int64(len(events)-1) {
+		t.Errorf("latest page offset %d, items %d", page.Offset, len(page.Items))
+	}
+
+	page = appEventPage{Total: len(events), Offset: 10, Items: events[10:]}
+	trimAppEventPage(&page, false)
+	if page.Offset != 10 || page.Items[0].Time != 10 || len(page.Items) == len(events)-10 {
+		t.Errorf("page offset %d, items %d", page.Offset, len(page.Items))
+	}
+
+	page = appEventPage{Items: []appEvent{{Message: strings.Repeat("x", defAppEventPageBytes)}}}
+	trimAppEventPage(&page, true)
+	if len(page.Items) != 1 {
+		t.Error("single large event dropped")
+	}
+}
+
+// appSignTool 生成的 <name>.tar 是 gzip 压缩的，未压缩的 tar 也能安装
+func TestExtractAppPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "hello", "bin"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "hello", "bin", "hello"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "hello", defAppCfgFile), []byte(`{"binname":"hello"}`), 0644)
+
+	cases := []struct {
+		pkg  string
+		flag string
+	}{
+		{"hello.tar", "-zcf"},
+		{"hello.tar", "-cf"},
+		{"hello.tar.gz", "-zcf"},
+		{"hello.tgz", "-zcf"},
+	}
+	for _, v := range cases {
+		if false == gPackageName.MatchString(v.pkg) || getPackageAppName(v.pkg) != "hello" {
+			t.Fatalf("package name %s rejected", v.pkg)
+		}
+		fn := filepath.Join(dir, v.pkg)
+		out, err := exec.Command("tar", v.flag, fn, "-C", src, "hello/").CombinedOutput()
+		if err != nil {
+			t.Fatalf("tar %s: %s", out, err)
+		}
+		ext := filepath.Join(dir, "ext")
+		os.RemoveAll(ext)
+		os.MkdirAll(ext, os.ModePerm)
+		if err = extractAppPackage(fn, ext); err != nil {
+			t.Fatalf("extract %s %s: %v", v.pkg, v.flag, err)
+		}
+		if loadAppCfg(filepath.Join(ext, "hello")).BinName != "hello" {
+			t.Errorf("%s %s: app.cfg not extracted", v.pkg, v.flag)
+		}
+	}
+
+	for _, v := range []string{"../hello.tar", "hello.zip", "hello tar.tar", "hello.tar/x"} {
+		if gPackageName.MatchString(v) {
+			t.Errorf("package name %s accepted", v)
+		}
+	}
+}
+
+// 导出的策略导入后还原，dry-run 只列出差异
+func TestReconcilePolicies(t *testing.T) {
+	gShutdownMode = defShutdownStop
+	gShutdownGrace = 5 * time.Second
+	gStallTimeout = 0
+	gStatsPersist = true
+	state := exportState()
+	data, _ := json.Marshal(&state)
+
+	gShutdownMode = defShutdownDetach
+	gShutdownGrace = 0
+	gStallTimeout = 30 * time.Second
+	gStatsPersist = false
+	state = daemonState{}
+	if err := json.Unmarshal(data, &state); err != nil || state.Policies == nil {
+		t.Fatalf("policies not exported: %s", data)
+	}
+
+	actions := reconcilePolicies(state.Policies, true)
+	if len(actions) != 3 || gShutdownMode != defShutdownDetach || gStatsPersist {
+		t.Fatalf("dry-run actions %v", actions)
+	}
+	reconcilePolicies(state.Policies, false)
+	if gShutdownMode != defShutdownStop || gShutdownGrace != 5*time.Second || !gStatsPersist {
+		t.Errorf("policies not imported: %s %s %v", gShutdownMode, gShutdownGrace, gStatsPersist)
+	}
+	// 未填写的 stalltimeout 保持当前值
+	if gStallTimeout != 30*time.Second {
+		t.Errorf("stalltimeout %s", gStallTimeout)
+	}
+
+	actions = reconcilePolicies(&policies{Shutdown: "reboot"}, false)
+	if len(actions) != 1 || actions[0].Op != "!" || gShutdownMode != defShutdownStop {
+		t.Errorf("invalid shutdown mode actions %v", actions)
+	}
+}
+
+// 钩子不在调用者中执行，结果通过任务队列返回
+func TestQueueAppHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "hook.sh")
+	ioutil.WriteFile(script, []byte("sleep 0.3\necho $APP_HOOK $APP_VERSION $EXTRA\nexit 3\n"), 0755)
+
+	gTaskChan = make(chan *taskCmd, 10)
+	gHookChan = make(chan *hookJob, 10)
+	defer close(gHookChan)
+	go handleHooks()
+
+	// 钩子在应用目录中执行，用相对路径把应用目录指向临时目录
+	name, _ := filepath.Rel(defAppsExtFolder, dir)
+	item := &taskItem{Name: name, Version: "1.0"}
+	if queueAppHook(item, defHookPreStart, nil, nil) {
+		t.Fatal("queued without hook")
+	}
+	item.cfg.Hooks = map[string]string{defHookPreStart: script}
+	var out string
+	var code int
+	start := time.Now()
+	if !queueAppHook(item, defHookPreStart, []string{"EXTRA=x"}, func(o string, c int, err error) {
+		out, code = o, c
+	}) {
+		t.Fatal("hook not queued")
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Fatal("queueAppHook waited for hook")
+	}
+
+	select {
+	case ctl := <-gTaskChan:
+		if ctl.done == nil || ctl.req.Name != name {
+			t.Fatalf("task %+v", ctl.req)
+		}
+		ctl.done()
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook result not posted")
+	}
+	if out != "prestart 1.0 x" || code != 3 {
+		t.Errorf("hook out %q, code %d", out, code)
+	}
+}
+
+// 不指定 uid、gid 的规则不限制 root
+func TestCheckAccessCatchAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gAppCurrentPath = dir
+	ioutil.WriteFile(filepath.Join(dir, defAccessFile), []byte(`{"rules":[{"commands":["list"]}]}`), 0644)
+
+	stop := &appCtlCmdReq{Cmd: APP_CTL_STOP, Name: "hello"}
+	list := &appCtlCmdReq{Cmd: APP_CTL_LIST}
+	root := &syscall.Ucred{Uid: 0, Gid: 0}
+	user := &syscall.Ucred{Uid: 1000, Gid: 1000}
+	if !checkAccess(root, stop) {
+		t.Error("catch-all rule limits root")
+	}
+	if checkAccess(user, stop) || !checkAccess(user, list) {
+		t.Error("catch-all rule not applied to user")
+	}
+
+	gAccessTime = time.Time{}
+	ioutil.WriteFile(filepath.Join(dir, defAccessFile), []byte(`{"rules":[{"uid":0,"commands":["list"]}]}`), 0644)
+	if checkAccess(root, stop) || !checkAccess(root, list) {
+		t.Error("uid 0 rule not applied to root")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, v := range []string{"", "quit", "SIGUSR1", "usr2", "hup", "abrt", "none"} {
+		if _, err := parseSignal(v); err != nil {
+			t.Errorf("parseSignal(%s) err=%v", v, err)
+		}
+	}
+	for _, v := range []string{"9", "15", "KILL", "TERM", "SIGSEGV", "-1"} {
+		if _, err := parseSignal(v); err == nil {
+			t.Errorf("parseSignal(%s) accepted", v)
+		}
+	}
+}
@@ -4,19 +4,27 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"github.com/ghodss/yaml"
 )
 
 const cfgFile string = "monitor.cfg"
+const defReadTimeout time.Duration = 10 * time.Second
 
 var (
 	gDstUnixAddr *net.UnixAddr
@@ -24,6 +32,11 @@ var (
 	gUnixConn    *net.UnixConn
 	gCtlCmdRsp   appCtlCmdRsp
 	gLog         *log.Logger
+	gOutput      string
+	gWatch       bool
+	gInterval    time.Duration
+	gExecArgs    []string
+	gReadTimeout = defReadTimeout
 )
 
 type AppCmdType int8
@@ -48,6 +61,20 @@ const (
 	APP_CTL_QUERY_MEM_LIMIT
 	APP_CTL_QUERY_ALL_RESOURCE
 	APP_CTL_LOGS
+	APP_CTL_CONFIG_DISK_THRESHOLD
+	APP_CTL_QUERY_DISK_THRESHOLD
+	APP_CTL_QUERY_DISK
+	APP_CTL_EVENTS
+	APP_CTL_INSTALL_URL
+	APP_CTL_INSTALL_PROGRESS
+	APP_CTL_EXPORT
+	APP_CTL_IMPORT
+	APP_CTL_RECONCILE_STATUS
+	APP_CTL_STATS
+	APP_CTL_DAEMON_STATUS
+	APP_CTL_RELOAD
+	APP_CTL_EXEC
+	APP_CTL_DUMP
 )
 
 const (
@@ -58,10 +85,18 @@ const (
 )
 
 type appCtlCmdReq struct {
-	Cmd   AppCmdType
-	Name  string
-	Log   int8
-	Value int
+	Cmd    AppCmdType
+	Name   string
+	Log    int8
+	Value  int
+	Kind   string
+	Since  int64
+	Until  int64
+	Offset int
+	Limit  int
+	URL    string
+	Sha256 string
+	Data   []byte
 }
 type appCtlCmdRsp struct {
 	Cmd    AppCmdType
@@ -73,38 +108,140 @@ type appCtlCmdRsp struct {
 }
 
 type srvItem struct {
-	Index         int32
-	Name          string
-	Enable        int8
-	Status        int8
-	CPUThreshold  int
-	CPULimit      int
-	CPUUsage      int
-	MemThreshold  int
-	MemLimit      int
-	MemUsage      int
-	StartTime     int64
-	LogsStartTime int64
-	LogsEndTime   int64
+	Index         int32  `json:"index"`
+	Name          string `json:"name"`
+	Enable        int8   `json:"enable"`
+	Status        int8   `json:"status"`
+	CPUThreshold  int    `json:"cputhreshold"`
+	CPULimit      int    `json:"cpulimit"`
+	CPUUsage      int    `json:"cpuusage"`
+	MemThreshold  int    `json:"memthreshold"`
+	MemLimit      int    `json:"memlimit"`
+	MemUsage      int    `json:"memusage"`
+	DiskThreshold int    `json:"diskthreshold"`
+	DiskUsage     int    `json:"diskusage"`
+	StartTime     int64  `json:"starttime"`
+	LogsStartTime int64  `json:"logsstarttime,omitempty"`
+	LogsEndTime   int64  `json:"logsendtime,omitempty"`
+}
+
+type appEvent struct {
+	Time    int64          `json:"time"`
+	App     string         `json:"app"`
+	Kind    string         `json:"kind"`
+	Message string         `json:"message"`
+	Values  map[string]int `json:"values,omitempty"`
+}
+
+type appEventPage struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Items  []appEvent `json:"items"`
+}
+
+type reconcileStatus struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+}
+
+type reconcileStatusList struct {
+	File  string            `json:"file"`
+	Error string            `json:"error"`
+	Time  int64             `json:"time"`
+	Items []reconcileStatus `json:"items"`
+}
+
+type statsValue struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+	P95 int `json:"p95"`
+}
+
+type appStatsResult struct {
+	Name       string     `json:"name"`
+	Since      int64      `json:"since"`
+	Samples    int        `json:"samples"`
+	Resolution string     `json:"resolution"`
+	CPU        statsValue `json:"cpu"`
+	Mem        statsValue `json:"mem"`
+	Disk       statsValue `json:"disk"`
+}
+
+type daemonError struct {
+	Time    int64  `json:"time"`
+	Message string `json:"message"`
+}
+
+type daemonStatus struct {
+	Version      string                 `json:"version"`
+	Pid          int                    `json:"pid"`
+	StartTime    int64                  `json:"starttime"`
+	Uptime       int64                  `json:"uptime"`
+	Restarts     int                    `json:"restarts"`
+	LoopCount    int64                  `json:"loopcount"`
+	LoopLag      int64                  `json:"looplag"`
+	LoopLastLag  int64                  `json:"looplastlag"`
+	LoopMaxLag   int64                  `json:"loopmaxlag"`
+	StallTimeout int64                  `json:"stalltimeout"`
+	Watchdog     int64                  `json:"watchdog"`
+	Goroutines   int                    `json:"goroutines"`
+	QueueDepth   int                    `json:"queuedepth"`
+	QueueSize    int                    `json:"queuesize"`
+	Errors       map[string]daemonError `json:"errors"`
+}
+
+type appExecSpec struct {
+	Name   string      `json:"name"`
+	Pid    int         `json:"pid"`
+	Dir    string      `json:"dir"`
+	Env    []string    `json:"env"`
+	Limits []appRlimit `json:"limits"`
+}
+
+type appRlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
 }
 
 type appItem struct {
-	Index   int32
-	Name    string
-	Version string
-	Hash    string
+	Index   int32  `json:"index"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+
+	SrvTotal int32     `json:"srvtotal"`
+	SrvItems []srvItem `json:"srvitems"`
+	LogFile  string    `json:"logfile,omitempty"`
+}
+
+type appListOutput struct {
+	Total int32     `json:"total"`
+	Items []appItem `json:"items"`
+}
 
-	SrvTotal int32
-	SrvItems []srvItem
-	LogFile  string
+type ctlRspOutput struct {
+	Cmd    AppCmdType  `json:"cmd"`
+	Name   string      `json:"name,omitempty"`
+	Code   int16       `json:"code"`
+	Result interface{} `json:"result"`
 }
 
 func main() {
 	//log.Println("appctl version1.0.0")
+	err := parseGlobalArgs()
+	if err != nil {
+		fmt.Println("Command args error:", err)
+		os.Exit(1)
+	}
+
 	l := len(os.Args)
 	if l < 2 {
 		fmt.Println("args less: len=", l)
-		return
+		os.Exit(1)
 	}
 
 	gLog = log.New(os.Stdout, "\r\n", log.LstdFlags|log.Lshortfile)
@@ -162,26 +299,36 @@ func main() {
 		os.Exit(0)
 	}(sig)
 
-	go readUnixgram()
+	if !gWatch {
+		go readUnixgram()
+	}
 
 	switch os.Args[1] {
 	case "-install":
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
 			ctl.Cmd = APP_CTL_INSTALL
 			ctl.Name = os.Args[2]
+			if strings.HasPrefix(ctl.Name, "http://") || strings.HasPrefix(ctl.Name, "https://") {
+				ctl.Cmd = APP_CTL_INSTALL_URL
+				ctl.URL = ctl.Name
+				ctl.Name = ""
+			}
+			if len(os.Args) > 4 && (os.Args[3] == "--sha256" || os.Args[3] == "-sha256") {
+				ctl.Sha256 = os.Args[4]
+			}
 			writeUnixgram(&ctl)
 		}
 	case "-start":
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -193,7 +340,7 @@ func main() {
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -205,7 +352,7 @@ func main() {
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -217,7 +364,7 @@ func main() {
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 
@@ -230,7 +377,7 @@ func main() {
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 
@@ -265,13 +412,17 @@ func main() {
 				ctl.Log = 0
 			}
 
+			if gWatch {
+				watchAppList(&ctl)
+				return
+			}
 			writeUnixgram(&ctl)
 		}
 	case "-version":
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -283,7 +434,7 @@ func main() {
 		{
 			if len(os.Args) < 4 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -292,7 +443,7 @@ func main() {
 			val, err := strconv.Atoi(os.Args[2])
 			if err != nil {
 				fmt.Println("Command args value error.")
-				os.Exit(0)
+				os.Exit(1)
 			} else {
 				ctl.Value = val
 			}
@@ -302,7 +453,7 @@ func main() {
 		{
 			if len(os.Args) < 4 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -311,7 +462,7 @@ func main() {
 			val, err := strconv.Atoi(os.Args[2])
 			if err != nil {
 				fmt.Println("Command args value error.")
-				os.Exit(0)
+				os.Exit(1)
 			} else {
 				ctl.Value = val
 			}
@@ -321,7 +472,7 @@ func main() {
 		{
 			if len(os.Args) < 4 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -330,7 +481,7 @@ func main() {
 			val, err := strconv.Atoi(os.Args[2])
 			if err != nil {
 				fmt.Println("Command args value error.")
-				os.Exit(0)
+				os.Exit(1)
 			} else {
 				ctl.Value = val
 			}
@@ -340,7 +491,7 @@ func main() {
 		{
 			if len(os.Args) < 4 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			ctl := appCtlCmdReq{}
@@ -349,7 +500,26 @@ func main() {
 			val, err := strconv.Atoi(os.Args[2])
 			if err != nil {
 				fmt.Println("Command args value error.")
-				os.Exit(0)
+				os.Exit(1)
+			} else {
+				ctl.Value = val
+			}
+			writeUnixgram(&ctl)
+		}
+	case "-disk":
+		{
+			if len(os.Args) < 4 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_CONFIG_DISK_THRESHOLD
+			ctl.Name = os.Args[3]
+			val, err := strconv.Atoi(os.Args[2])
+			if err != nil {
+				fmt.Println("Command args value error.")
+				os.Exit(1)
 			} else {
 				ctl.Value = val
 			}
@@ -359,7 +529,7 @@ func main() {
 		{
 			if len(os.Args) < 4 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			if os.Args[2] == "cpu" {
@@ -382,9 +552,19 @@ func main() {
 				ctl.Cmd = APP_CTL_QUERY_MEM_LIMIT
 				ctl.Name = os.Args[3]
 				writeUnixgram(&ctl)
+			} else if os.Args[2] == "disk" {
+				ctl := appCtlCmdReq{}
+				ctl.Cmd = APP_CTL_QUERY_DISK_THRESHOLD
+				ctl.Name = os.Args[3]
+				writeUnixgram(&ctl)
+			} else if os.Args[2] == "diskusage" {
+				ctl := appCtlCmdReq{}
+				ctl.Cmd = APP_CTL_QUERY_DISK
+				ctl.Name = os.Args[3]
+				writeUnixgram(&ctl)
 			} else {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 		}
@@ -398,7 +578,7 @@ func main() {
 		{
 			if len(os.Args) < 3 {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
 				return
 			}
 			if os.Args[2] == "files" {
@@ -407,19 +587,249 @@ func main() {
 				writeUnixgram(&ctl)
 			} else {
 				fmt.Println("Command args error.")
-				os.Exit(0)
+				os.Exit(1)
+				return
+			}
+		}
+	case "-export":
+		{
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_EXPORT
+			writeUnixgram(&ctl)
+		}
+	case "-import":
+		{
+			if len(os.Args) < 3 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
 				return
 			}
+			data, err := ioutil.ReadFile(os.Args[2])
+			if err != nil {
+				fmt.Println("read state file error: ", err)
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_IMPORT
+			ctl.Data = data
+			if len(os.Args) > 3 && (os.Args[3] == "--dry-run" || os.Args[3] == "-dry-run") {
+				ctl.Value = 1
+			}
+			writeUnixgram(&ctl)
+		}
+	case "-reconcile":
+		{
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_RECONCILE_STATUS
+			if len(os.Args) > 2 && os.Args[2] == "now" {
+				ctl.Value = 1
+			}
+			writeUnixgram(&ctl)
+		}
+	case "-stats":
+		{
+			if len(os.Args) < 3 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_STATS
+			ctl.Name = os.Args[2]
+			since := time.Hour
+			if len(os.Args) > 4 && (os.Args[3] == "--since" || os.Args[3] == "-since") {
+				d, err := time.ParseDuration(os.Args[4])
+				if err != nil {
+					fmt.Println("Command args value error.")
+					os.Exit(1)
+					return
+				}
+				since = d
+			}
+			ctl.Since = time.Now().Add(-since).Unix()
+			writeUnixgram(&ctl)
+		}
+	case "-reload":
+		{
+			if len(os.Args) < 3 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_RELOAD
+			ctl.Name = os.Args[2]
+			writeUnixgram(&ctl)
+		}
+	case "-exec":
+		{
+			if len(os.Args) < 3 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_EXEC
+			ctl.Name = os.Args[2]
+			writeUnixgram(&ctl)
+		}
+	case "-dump":
+		{
+			if len(os.Args) < 3 {
+				fmt.Println("Command args error.")
+				os.Exit(1)
+				return
+			}
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_DUMP
+			ctl.Name = os.Args[2]
+			for i := 3; i+1 < len(os.Args); i += 2 {
+				switch strings.TrimLeft(os.Args[i], "-") {
+				case "signal":
+					ctl.Kind = os.Args[i+1]
+				case "wait":
+					d, err := time.ParseDuration(os.Args[i+1])
+					if err != nil {
+						fmt.Println("Command args value error.")
+						os.Exit(1)
+						return
+					}
+					if d < time.Millisecond {
+						fmt.Println("Command args value error.")
+						os.Exit(1)
+						return
+					}
+					ctl.Value = int(d / time.Millisecond)
+					//守护进程等待 wait 后才返回结果
+					gReadTimeout = defReadTimeout + d
+				}
+			}
+			writeUnixgram(&ctl)
+		}
+	case "-daemon":
+		{
+			ctl := appCtlCmdReq{}
+			ctl.Cmd = APP_CTL_DAEMON_STATUS
+			writeUnixgram(&ctl)
+		}
+	case "-events":
+		{
+			ctl, err := parseEventsArgs(os.Args[2:])
+			if err != nil {
+				fmt.Println("Command args error:", err)
+				os.Exit(1)
+				return
+			}
+			writeUnixgram(ctl)
 		}
 	default:
 		fmt.Println("Command args error.")
-		os.Exit(0)
+		os.Exit(1)
 		return
 	}
 
 	select {}
 }
 
+// 全局参数：-o json|yaml|table|wide，-watch，-interval 2s
+func parseGlobalArgs() error {
+	gInterval = 2 * time.Second
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--":
+			// -- 之后为 -exec 执行的命令，原样保留
+			gExecArgs = os.Args[i+1:]
+			i = len(os.Args)
+		case "-o", "--output":
+			if i+1 >= len(os.Args) {
+				return fmt.Errorf("%s missing value", os.Args[i])
+			}
+			i++
+			switch os.Args[i] {
+			case "json", "yaml", "table", "wide":
+				gOutput = os.Args[i]
+			default:
+				return fmt.Errorf("unknown output format %s", os.Args[i])
+			}
+		case "-watch", "--watch":
+			gWatch = true
+		case "-interval", "--interval":
+			if i+1 >= len(os.Args) {
+				return fmt.Errorf("%s missing value", os.Args[i])
+			}
+			i++
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil {
+				return err
+			}
+			if d < time.Second {
+				d = time.Second
+			}
+			gInterval = d
+		default:
+			args = append(args, os.Args[i])
+		}
+	}
+	os.Args = args
+	// 只有 -list 支持持续刷新，其他命令带 -watch 会一直等不到响应
+	if gWatch && (len(os.Args) < 2 || os.Args[1] != "-list") {
+		return fmt.Errorf("-watch only supported with -list")
+	}
+	return nil
+}
+
+// appctl -events [name] [--since 1h] [--until 10m] [--kind restart] [--offset 0] [--limit 50]
+func parseEventsArgs(args []string) (*appCtlCmdReq, error) {
+	ctl := &appCtlCmdReq{}
+	ctl.Cmd = APP_CTL_EVENTS
+	ctl.Offset = -1
+	now := time.Now()
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			ctl.Name = args[i]
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("%s missing value", args[i])
+		}
+		val := args[i+1]
+		i++
+		switch strings.TrimLeft(args[i-1], "-") {
+		case "since":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			ctl.Since = now.Add(-d).Unix()
+		case "until":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			ctl.Until = now.Add(-d).Unix()
+		case "kind":
+			ctl.Kind = val
+		case "offset":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			ctl.Offset = n
+		case "limit":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			ctl.Limit = n
+		default:
+			return nil, fmt.Errorf("unknown option %s", args[i-1])
+		}
+	}
+	return ctl, nil
+}
+
 func closeUinxgram(ext bool) {
 	gUnixConn.Close()
 	os.Remove("/var/run/appctl-cli.sock")
@@ -428,22 +838,43 @@ func closeUinxgram(ext bool) {
 	}
 }
 
+func readCtlRsp() (appCtlCmdRsp, error) {
+	ctlRsp := appCtlCmdRsp{}
+	t := time.Now()
+	gUnixConn.SetReadDeadline(t.Add(gReadTimeout))
+	buf := make([]byte, 1024*64)
+	size, err := gUnixConn.Read(buf)
+	if err != nil {
+		return ctlRsp, err
+	}
+	data := bytes.NewBuffer(buf[:size])
+	dec := gob.NewDecoder(data)
+	err = dec.Decode(&ctlRsp)
+	return ctlRsp, err
+}
+
 func readUnixgram() {
+	code := 1
 	for {
-		t := time.Now()
-		gUnixConn.SetReadDeadline(t.Add(time.Duration(10 * time.Second)))
-		buf := make([]byte, 1024*16)
-		size, err := gUnixConn.Read(buf)
+		ctlRsp, err := readCtlRsp()
 		if err != nil {
 			fmt.Println("readUnixgram error: ", err)
 			break
 		}
-		data := bytes.NewBuffer(buf[:size])
-		dec := gob.NewDecoder(data)
-		ctlRsp := appCtlCmdRsp{}
-		err = dec.Decode(&ctlRsp)
-		if err != nil {
-			fmt.Println("decode error: ", err)
+		code = int(ctlRsp.Code)
+		// 3: 权限不足
+		if ctlRsp.Code == 3 {
+			fmt.Println(ctlRsp.Result)
+			break
+		}
+		if ctlRsp.Cmd == APP_CTL_INSTALL_PROGRESS {
+			if len(gOutput) == 0 {
+				fmt.Println(ctlRsp.Result)
+			}
+			continue
+		}
+		if (gOutput == "json" || gOutput == "yaml") && ctlRsp.Cmd != APP_CTL_LIST && ctlRsp.Cmd != APP_CTL_EVENTS {
+			printCtlRsp(&ctlRsp)
 			break
 		}
 		switch ctlRsp.Cmd {
@@ -454,6 +885,9 @@ func readUnixgram() {
 				fmt.Println(ctlRsp.Result)
 			}
 
+		case APP_CTL_INSTALL_URL:
+			fmt.Println(ctlRsp.Result)
+
 		case APP_CTL_START:
 			if 0 == ctlRsp.Code {
 
@@ -575,12 +1009,83 @@ func readUnixgram() {
 			} else {
 				log.Println(ctlRsp.Result)
 			}
+
+		case APP_CTL_CONFIG_DISK_THRESHOLD:
+			if 0 == ctlRsp.Code {
+				//fmt.Println(ctlRsp.Result)
+			} else {
+				log.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_QUERY_DISK_THRESHOLD:
+			if 0 == ctlRsp.Code {
+				fmt.Println(ctlRsp.Result)
+			} else {
+				log.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_QUERY_DISK:
+			if 0 == ctlRsp.Code {
+				fmt.Println(ctlRsp.Result)
+			} else {
+				log.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_EXPORT:
+			if 0 == ctlRsp.Code {
+				fmt.Println(ctlRsp.Result)
+			} else {
+				log.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_IMPORT:
+			fmt.Println(ctlRsp.Result)
+
+		case APP_CTL_STATS:
+			if 0 == ctlRsp.Code {
+				handleAppStats(&ctlRsp)
+			} else {
+				fmt.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_RELOAD:
+			fmt.Println(ctlRsp.Result)
+
+		case APP_CTL_EXEC:
+			if 0 == ctlRsp.Code {
+				code = handleAppExec(&ctlRsp)
+			} else {
+				fmt.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_DUMP:
+			fmt.Println(ctlRsp.Result)
+
+		case APP_CTL_DAEMON_STATUS:
+			if 0 == ctlRsp.Code {
+				handleDaemonStatus(&ctlRsp)
+			} else {
+				fmt.Println(ctlRsp.Result)
+			}
+
+		case APP_CTL_RECONCILE_STATUS:
+			if 2 == ctlRsp.Code {
+				fmt.Println(ctlRsp.Result)
+			} else {
+				handleAppReconcileStatus(&ctlRsp)
+			}
+
+		case APP_CTL_EVENTS:
+			if 0 == ctlRsp.Code {
+				handleAppEvents(&ctlRsp)
+			} else {
+				fmt.Println(ctlRsp.Result)
+			}
 		}
 		break
 	}
 
-	os.Exit(0)
-	return
+	os.Exit(code)
 }
 
 func writeUnixgram(req *appCtlCmdReq) {
@@ -589,13 +1094,13 @@ func writeUnixgram(req *appCtlCmdReq) {
 	err := enc.Encode(req)
 	if err != nil {
 		fmt.Println("gob encode error: ", err)
-		os.Exit(0)
+		os.Exit(1)
 		return
 	}
 	_, err = gUnixConn.Write(buf.Bytes())
 	if err != nil {
 		fmt.Println("writeUnixgram error: ", err)
-		os.Exit(0)
+		os.Exit(1)
 		return
 	}
 }
@@ -620,6 +1125,10 @@ func readAppEventLog(fn string) []string {
 			break
 		}
 		line = strings.TrimSpace(line)
+		ev := appEvent{}
+		if json.Unmarshal([]byte(line), &ev) == nil {
+			line = formatAppEvent(&ev)
+		}
 		strArray = append(strArray, line)
 	}
 
@@ -633,6 +1142,147 @@ func readAppEventLog(fn string) []string {
 	return strArray[retPos:]
 }
 
+func formatAppEvent(ev *appEvent) string {
+	return fmt.Sprintf("%s %-16s %-10s %s", time.Unix(ev.Time, 0).Format("2006-01-02 15:04:05"), ev.App, ev.Kind, ev.Message)
+}
+
+func handleAppEvents(rsp *appCtlCmdRsp) {
+	page := appEventPage{}
+	err := json.Unmarshal([]byte(rsp.Result), &page)
+	if err != nil {
+		fmt.Println("decode events error: ", err)
+		return
+	}
+	if gOutput == "json" || gOutput == "yaml" {
+		printOutput(&page)
+		return
+	}
+
+	for k := range page.Items {
+		fmt.Println(formatAppEvent(&page.Items[k]))
+	}
+	if page.Total > page.Offset+len(page.Items) || page.Offset > 0 {
+		fmt.Printf("-- events %d-%d of %d, use --offset/--limit for more --\n", page.Offset+1, page.Offset+len(page.Items), page.Total)
+	}
+}
+
+func handleAppStats(rsp *appCtlCmdRsp) {
+	ret := appStatsResult{}
+	err := json.Unmarshal([]byte(rsp.Result), &ret)
+	if err != nil {
+		fmt.Println("decode stats error: ", err)
+		return
+	}
+
+	fmt.Printf("App %s since %s: %d samples, %s resolution\n\n", ret.Name, time.Unix(ret.Since, 0).Format("2006-01-02 15:04:05"), ret.Samples, ret.Resolution)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tMIN\tAVG\tMAX\tP95")
+	fmt.Fprintf(w, "cpu(%%)\t%d\t%d\t%d\t%d\n", ret.CPU.Min, ret.CPU.Avg, ret.CPU.Max, ret.CPU.P95)
+	fmt.Fprintf(w, "mem(%%)\t%d\t%d\t%d\t%d\n", ret.Mem.Min, ret.Mem.Avg, ret.Mem.Max, ret.Mem.P95)
+	fmt.Fprintf(w, "disk(MB)\t%d\t%d\t%d\t%d\n", ret.Disk.Min, ret.Disk.Avg, ret.Disk.Max, ret.Disk.P95)
+	w.Flush()
+}
+
+// 在应用的工作目录、环境变量和资源限制下替换当前进程执行命令，默认 /bin/sh
+func handleAppExec(rsp *appCtlCmdRsp) int {
+	spec := appExecSpec{}
+	err := json.Unmarshal([]byte(rsp.Result), &spec)
+	if err != nil {
+		fmt.Println("decode exec spec error: ", err)
+		return 1
+	}
+
+	args := gExecArgs
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		fmt.Println("exec error: ", err)
+		return 127
+	}
+	err = os.Chdir(spec.Dir)
+	if err != nil {
+		fmt.Println("exec chdir error: ", err)
+		return 1
+	}
+	for _, v := range spec.Limits {
+		err := syscall.Setrlimit(v.Resource, &syscall.Rlimit{Cur: v.Cur, Max: v.Max})
+		if err != nil {
+			gLog.Printf("setrlimit %d error: %s\n", v.Resource, err)
+		}
+	}
+
+	closeUinxgram(false)
+	//与守护进程启动应用时一样，应用的环境变量加在当前环境之后
+	err = syscall.Exec(bin, args, append(os.Environ(), spec.Env...))
+	fmt.Println("exec error: ", err)
+	return 126
+}
+
+func handleDaemonStatus(rsp *appCtlCmdRsp) {
+	st := daemonStatus{}
+	err := json.Unmarshal([]byte(rsp.Result), &st)
+	if err != nil {
+		fmt.Println("decode daemon status error: ", err)
+		return
+	}
+
+	watchdog := "off"
+	if st.Watchdog > 0 {
+		watchdog = fmt.Sprintf("%ds", st.Watchdog)
+	}
+	fmt.Printf("%-20s: %s\n", "Version", st.Version)
+	fmt.Printf("%-20s: %d\n", "Pid", st.Pid)
+	fmt.Printf("%-20s: %s\n", "Start time", time.Unix(st.StartTime, 0).Format("2006-01-02 15:04:05"))
+	fmt.Printf("%-20s: %s\n", "Uptime", (time.Duration(st.Uptime) * time.Second).String())
+	fmt.Printf("%-20s: %d\n", "Restarts", st.Restarts)
+	fmt.Printf("%-20s: %dms (last %dms, max %dms)\n", "Loop lag", st.LoopLag, st.LoopLastLag, st.LoopMaxLag)
+	fmt.Printf("%-20s: %d\n", "Loop count", st.LoopCount)
+	fmt.Printf("%-20s: %ds\n", "Stall timeout", st.StallTimeout)
+	fmt.Printf("%-20s: %s\n", "sd watchdog", watchdog)
+	fmt.Printf("%-20s: %d\n", "Goroutines", st.Goroutines)
+	fmt.Printf("%-20s: %d/%d\n", "Task queue", st.QueueDepth, st.QueueSize)
+	if len(st.Errors) == 0 {
+		return
+	}
+
+	var keys []string
+	for k := range st.Errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBSYSTEM\tTIME\tLAST ERROR")
+	for _, k := range keys {
+		v := st.Errors[k]
+		fmt.Fprintf(w, "%s\t%s\t%s\n", k, time.Unix(v.Time, 0).Format("2006-01-02 15:04:05"), v.Message)
+	}
+	w.Flush()
+}
+
+func handleAppReconcileStatus(rsp *appCtlCmdRsp) {
+	lst := reconcileStatusList{}
+	err := json.Unmarshal([]byte(rsp.Result), &lst)
+	if err != nil {
+		fmt.Println("decode reconcile status error: ", err)
+		return
+	}
+
+	fmt.Printf("Desired state: %s, last reconcile: %s\n", lst.File, time.Unix(lst.Time, 0).Format("2006-01-02 15:04:05"))
+	if len(lst.Error) > 0 {
+		fmt.Printf("Error: %s\n", lst.Error)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tMESSAGE")
+	for _, v := range lst.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, v.Status, v.Message)
+	}
+	w.Flush()
+}
+
 func handleAppList(rsp *appCtlCmdRsp) int {
 	gCtlCmdRsp.Cmd = rsp.Cmd
 	gCtlCmdRsp.Name = rsp.Name
@@ -645,6 +1295,11 @@ func handleAppList(rsp *appCtlCmdRsp) int {
 		return 1
 	}
 	gLog.Println("handleAppList recv finish.")
+	if len(gOutput) > 0 {
+		printAppList(gOutput)
+		gCtlCmdRsp.Items = gCtlCmdRsp.Items[0:0]
+		return 0
+	}
 	bHaveEnter := false
 	fmt.Printf("Total app number %d \n\n", gCtlCmdRsp.Total)
 
@@ -680,6 +1335,8 @@ func handleAppList(rsp *appCtlCmdRsp) int {
 			fmt.Printf("%-20s: %d%%\n", "CPU usage", t.CPUUsage)
 			fmt.Printf("%-20s: %d%%\n", "Mem threshold", t.MemThreshold)
 			fmt.Printf("%-20s: %d%%\n", "Mem usage", t.MemUsage)
+			fmt.Printf("%-20s: %dMB\n", "Disk threshold", t.DiskThreshold)
+			fmt.Printf("%-20s: %dMB\n", "Disk usage", t.DiskUsage)
 			fmt.Printf("%-20s: %s\n", "Start time", time.Unix(t.StartTime, 0).Format("2006-01-02 15:04:05"))
 
 			if t.LogsStartTime != 0 {
@@ -707,3 +1364,122 @@ func handleAppList(rsp *appCtlCmdRsp) int {
 	gCtlCmdRsp.Items = gCtlCmdRsp.Items[0:0]
 	return 0
 }
+
+// 定时刷新应用列表，直到 Ctrl+C 退出
+func watchAppList(ctl *appCtlCmdReq) {
+	if len(gOutput) == 0 {
+		gOutput = "table"
+	}
+	for {
+		writeUnixgram(ctl)
+		for {
+			ctlRsp, err := readCtlRsp()
+			if err != nil {
+				fmt.Println("readUnixgram error: ", err)
+				os.Exit(1)
+			}
+			if ctlRsp.Code == 2 {
+				fmt.Println(ctlRsp.Result)
+				os.Exit(int(ctlRsp.Code))
+			}
+			gCtlCmdRsp.Cmd = ctlRsp.Cmd
+			gCtlCmdRsp.Total = ctlRsp.Total
+			gCtlCmdRsp.Items = append(gCtlCmdRsp.Items, ctlRsp.Items...)
+			if ctlRsp.Code == 0 {
+				break
+			}
+		}
+
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Every %s: appctl -list %s\t%s\n\n", gInterval, ctl.Name, time.Now().Format("2006-01-02 15:04:05"))
+		printAppList(gOutput)
+		gCtlCmdRsp.Items = gCtlCmdRsp.Items[0:0]
+		time.Sleep(gInterval)
+	}
+}
+
+func printAppList(format string) {
+	out := appListOutput{}
+	out.Total = gCtlCmdRsp.Total
+	out.Items = gCtlCmdRsp.Items
+	sort.Slice(out.Items, func(i, j int) bool {
+		return out.Items[i].Name < out.Items[j].Name
+	})
+
+	if format == "json" || format == "yaml" {
+		printOutput(&out)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if format == "wide" {
+		fmt.Fprintln(w, "NAME\tVERSION\tSERVICE\tENABLE\tSTATUS\tCPU\tCPU-THR\tMEM\tMEM-THR\tDISK\tDISK-THR\tSTART\tHASH")
+	} else {
+		fmt.Fprintln(w, "NAME\tVERSION\tSERVICE\tENABLE\tSTATUS\tCPU\tMEM\tSTART")
+	}
+	for _, v := range out.Items {
+		for _, t := range v.SrvItems {
+			enable := "no"
+			if t.Enable == 1 {
+				enable = "yes"
+			}
+			start := "-"
+			if t.StartTime > 0 && t.Status == int8(APP_STATUS_RUNNING) {
+				start = time.Unix(t.StartTime, 0).Format("2006-01-02 15:04:05")
+			}
+			if format == "wide" {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d%%\t%d%%\t%d%%\t%d%%\t%dMB\t%dMB\t%s\t%s\n", v.Name, v.Version, t.Name, enable, statusString(t.Status),
+					t.CPUUsage, t.CPUThreshold, t.MemUsage, t.MemThreshold, t.DiskUsage, t.DiskThreshold, start, v.Hash)
+			} else {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d%%\t%d%%\t%s\n", v.Name, v.Version, t.Name, enable, statusString(t.Status),
+					t.CPUUsage, t.MemUsage, start)
+			}
+		}
+	}
+	w.Flush()
+}
+
+func statusString(status int8) string {
+	switch status {
+	case int8(APP_STATUS_INSTALL):
+		return "installed"
+	case int8(APP_STATUS_RUNNING):
+		return "running"
+	}
+	return "stop"
+}
+
+// json/yaml 输出时，Result 如果本身是 JSON 则按结构输出
+func printCtlRsp(rsp *appCtlCmdRsp) {
+	out := ctlRspOutput{}
+	out.Cmd = rsp.Cmd
+	out.Name = rsp.Name
+	out.Code = rsp.Code
+	out.Result = rsp.Result
+	var v interface{}
+	if json.Unmarshal([]byte(rsp.Result), &v) == nil {
+		if _, ok := v.(map[string]interface{}); ok {
+			out.Result = v
+		}
+	}
+	printOutput(&out)
+}
+
+func printOutput(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Println("marshal error: ", err)
+		return
+	}
+	if gOutput != "yaml" {
+		fmt.Println(string(data))
+		return
+	}
+
+	out, err := yaml.JSONToYAML(data)
+	if err != nil {
+		fmt.Println("marshal error: ", err)
+		return
+	}
+	fmt.Print(string(out))
+}
@@ -1,81 +1,36 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
-	"strconv"
-	"syscall"
 	"time"
+
+	"supervisor"
 )
 
 const cfgFile string = "monitor.cfg"
-
-type appItem struct {
-	Pid   int    `json:"pid"`
-	Name  string `json:"name"`
-	Path  string `json:"path"`
-	Param string `json:"param"`
-}
-
-type appList struct {
-	Items []appItem `json:"items"`
-}
+const daemonSock string = "/var/run/appctl-daemon.sock"
 
 func main() {
-	log.Println("appmoitor version1.0.0")
-
-	go check()
-
-	select {}
-}
-
-//0,1,2为系统进程
-func isAlive(pid int) bool {
-	if pid < 3 {
-		return false
-	}
-	if err := syscall.Kill(pid, 0); err == nil {
-		return true
-	}
-	return false
-}
-
-func readFile() ([]byte, error) {
-	fl, err := os.Open(cfgFile)
-	if err != nil {
-		log.Println("readFile 0x0001:", err)
-		return nil, err
-	}
+	log.Println("appmoitor version1.1.0")
 
-	defer fl.Close()
-	content, err := ioutil.ReadAll(fl)
-	if err != nil {
-		log.Println("readFile 0x0002:", err)
-		return nil, err
+	// appctl-daemon 同样按 monitor.cfg 拉起应用，两者同时运行会重复启动
+	if daemonAlive() {
+		log.Println("main appctl-daemon is running, exit")
+		os.Exit(1)
 	}
 
-	return content, err
-}
-
-func writeFile(lst *appList) error {
-	data, err := json.Marshal(&lst)
+	lst, migrated, err := supervisor.LoadList(cfgFile)
 	if err != nil {
-		log.Println("writeFile 0x0001:", err)
-		return err
+		log.Println("main 0x0001:", err)
+	} else if migrated {
+		log.Println("main migrate", cfgFile, "from old format, app list count =", len(lst.Items))
 	}
 
-	fd, err := os.OpenFile(cfgFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
-	if err != nil {
-		log.Println("writeFile 0x0002:", err.Error())
-		return err
-	}
-	defer fd.Close()
-	fd.Write(data)
+	go check()
 
-	return nil
+	select {}
 }
 
 func check() {
@@ -84,48 +39,48 @@ func check() {
 
 	for {
 		time.Sleep(1 * time.Second)
-
-		lst := appList{}
-		content, err := readFile()
-		if err != nil {
+		if daemonAlive() {
 			continue
 		}
-		err = json.Unmarshal(content, &lst)
+
+		// 每次重新读取，appctl-daemon 或手工修改 monitor.cfg 后立即生效
+		lst, _, err := supervisor.LoadList(cfgFile)
 		if err != nil {
 			log.Println("check 0x0001:", err)
 			continue
 		}
 
-		needUpd := false
+		var updated []supervisor.Item
 		for k, v := range lst.Items {
-			_ = k
-			//log.Println(v.Path, ",", v.Param, ",", v.Pid)
-			if isAlive(v.Pid) {
-				ret, err := os.Readlink("/proc/" + strconv.Itoa(v.Pid) + "/exe")
-				if err == nil && ret == v.Path {
-					//log.Println("link:", ret)
-					continue
-				} else {
-					log.Println("check 0x0002:", err, ",", v.Path)
-				}
+			// appctl -stop 只修改 cmd，enable 仍为 1
+			if v.Enable != 1 || v.Cmd == supervisor.CmdStop {
+				continue
+			}
+			if supervisor.IsRunning(v.Pid, v.Path) {
+				continue
 			}
-			cmd := exec.Command(v.Path, v.Param)
-			if cmd != nil {
-				err := cmd.Start()
-				if err != nil {
-					log.Println("check 0x0003:", err)
-				} else {
-					needUpd = true
-					lst.Items[k].Pid = cmd.Process.Pid
-					log.Println("check start name =", v.Name, ", path =", v.Path, ", pid =", v.Pid)
-				}
-			} else {
-				log.Println("check exec cmd nil:", v.Path)
+
+			// 与旧版一致，param 整体作为一个参数传入
+			proc := supervisor.Proc{Name: v.Name, Path: v.Path, Args: []string{v.Param}}
+			pid, err := supervisor.Start(supervisor.Command(&proc))
+			if err != nil {
+				log.Println("check 0x0003:", v.Path, err)
+				lst.Items[k].Status = supervisor.StatusStop
+				continue
 			}
+			lst.Items[k].Pid = pid
+			lst.Items[k].Status = supervisor.StatusRunning
+			lst.Items[k].StartTime = time.Now().Unix()
+			updated = append(updated, lst.Items[k])
+			log.Println("check start name =", v.Name, ", path =", v.Path, ", pid =", pid)
 		}
 
-		if needUpd {
-			writeFile(&lst)
+		// 只写回运行状态，appctl-daemon 的阈值、版本等配置原样保留
+		if len(updated) > 0 {
+			err = supervisor.UpdateList(cfgFile, updated, "pid", "status", "starttime")
+			if err != nil {
+				log.Println("check 0x0004:", err)
+			}
 		}
 
 		endTime := time.Now().UTC()
@@ -136,3 +91,13 @@ func check() {
 		}
 	}
 }
+
+// unixgram 套接字没有进程监听时连接失败
+func daemonAlive() bool {
+	conn, err := net.Dial("unixgram", daemonSock)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
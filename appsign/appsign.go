@@ -0,0 +1,121 @@
+package appsign
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// appSignTool 私钥对应的公钥，appctl-daemon 和 imageCreator 用它校验应用包
+const PublicKey string = `
+-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDEdXD28RmWo8rWJu2FleiAG6wV
+Gy6O0JH0achNiFuFyhf+5AQcA4KVXaJP5UmeLpYoRIR/Apm10HoE11mPSo/fIaFF
+biJc1FfksFBv3QmE4ecbTtpwv70P9lyr2pBVT4n+TL9Vxu+qLfbraUHA/MLh+csJ
+LILyqkMGP2KAQJhVgQIDAQAB
+-----END PUBLIC KEY-----
+`
+
+var ErrNoSign = errors.New("sign not found")
+
+// 签名覆盖的 app.cfg 字段，决定运行哪个程序、加载哪些库和执行哪些脚本。
+// 其余字段（args、env、各项门限和限制、hooktimeout、depends、stoptimeout、nonotify）
+// 可以在设备上直接修改，修改后 -reload 或 inotify 重新加载不会校验失败
+var SignedKeys = []string{"appname", "binname", "libpath", "hooks"}
+
+// 取出 app.cfg 中 SignedKeys 的字段，重新编码为键有序的 JSON，与格式和未签名字段无关
+func SignedCfg(cfg []byte) ([]byte, error) {
+	all := make(map[string]interface{})
+	if len(cfg) > 0 {
+		if err := json.Unmarshal(cfg, &all); err != nil {
+			return nil, err
+		}
+	}
+	signed := make(map[string]interface{})
+	for _, k := range SignedKeys {
+		if v, ok := all[k]; ok {
+			signed[k] = v
+		}
+	}
+	return json.Marshal(signed)
+}
+
+// 钩子脚本只能是包内的相对路径
+func HookPath(script string) (string, bool) {
+	script = path.Clean(script)
+	if path.IsAbs(script) || script == ".." || strings.HasPrefix(script, "../") {
+		return script, false
+	}
+	return script, true
+}
+
+// 签名内容为程序的 md5、SignedCfg(app.cfg) 的 sha256，再按钩子名顺序接每个钩子 "名=路径\n内容" 的 sha256，
+// read 按包内相对路径读取钩子脚本
+func Digest(binSum, cfg []byte, hooks map[string]string, read func(script string) ([]byte, error)) ([]byte, error) {
+	signed, err := SignedCfg(cfg)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte{}, binSum...)
+	sum := sha256.Sum256(signed)
+	data = append(data, sum[:]...)
+
+	var names []string
+	for k := range hooks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		script, ok := HookPath(hooks[k])
+		if !ok {
+			return nil, fmt.Errorf("hook %s %s not in package", k, hooks[k])
+		}
+		content, err := read(script)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(append([]byte(k+"="+script+"\n"), content...))
+		data = append(data, sum[:]...)
+	}
+	return data, nil
+}
+
+// 对签名内容做 sha256 后校验 PKCS1v15 签名
+func Verify(data, signature []byte) error {
+	if len(signature) == 0 {
+		return ErrNoSign
+	}
+	block, _ := pem.Decode([]byte(PublicKey))
+	if block == nil {
+		return errors.New("public key error")
+	}
+	pubInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(pubInterface.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature)
+}
+
+// 按 Digest 的内容校验，没有钩子的旧安装包只对程序签名，仍然接受，legacy 为 true 表示按旧格式通过。
+// 因此 app.cfg 的签名字段只有在包含钩子的包中一定受保护，没有钩子的包可能按旧格式通过，
+// 此时 binname、libpath 被修改也不会校验失败
+func VerifyPackage(binSum, cfg []byte, hooks map[string]string, read func(string) ([]byte, error), signature []byte) (legacy bool, err error) {
+	data, err := Digest(binSum, cfg, hooks, read)
+	if err != nil {
+		return false, err
+	}
+	err = Verify(data, signature)
+	if err != nil && err != ErrNoSign && len(hooks) == 0 && Verify(binSum, signature) == nil {
+		return true, nil
+	}
+	return false, err
+}
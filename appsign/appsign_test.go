@@ -0,0 +1,103 @@
+package appsign
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func testRead(files map[string]string) func(string) ([]byte, error) {
+	return func(script string) ([]byte, error) {
+		if v, ok := files[script]; ok {
+			return []byte(v), nil
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+func TestHookPath(t *testing.T) {
+	cases := []struct {
+		script string
+		clean  string
+		ok     bool
+	}{
+		{"hooks/pre.sh", "hooks/pre.sh", true},
+		{"./hooks/../pre.sh", "pre.sh", true},
+		{"/etc/init.sh", "/etc/init.sh", false},
+		{"..", "..", false},
+		{"hooks/../../x.sh", "../x.sh", false},
+	}
+	for _, v := range cases {
+		clean, ok := HookPath(v.script)
+		if clean != v.clean || ok != v.ok {
+			t.Errorf("HookPath(%s) = %s, %v", v.script, clean, ok)
+		}
+	}
+}
+
+// 签名内容与钩子的声明顺序无关，钩子名、路径和脚本内容任一变化都会改变
+func TestDigest(t *testing.T) {
+	binSum := []byte("0123456789abcdef")
+	cfg := []byte(`{"binname":"hello"}`)
+	files := map[string]string{"hooks/pre.sh": "echo pre", "hooks/post.sh": "echo post"}
+	hooks := map[string]string{"preinstall": "hooks/pre.sh", "postinstall": "./hooks/post.sh"}
+
+	data, err := Digest(binSum, cfg, hooks, testRead(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(binSum)+3*32 || !bytes.HasPrefix(data, binSum) {
+		t.Fatalf("digest length %d", len(data))
+	}
+	for i := 0; i < 10; i++ {
+		again, _ := Digest(binSum, cfg, hooks, testRead(files))
+		if !bytes.Equal(again, data) {
+			t.Fatal("digest depends on map order")
+		}
+	}
+
+	changed := map[string]string{"hooks/pre.sh": "rm -rf /", "hooks/post.sh": "echo post"}
+	if other, _ := Digest(binSum, cfg, hooks, testRead(changed)); bytes.Equal(other, data) {
+		t.Error("hook script change not covered")
+	}
+	renamed := map[string]string{"prestart": "hooks/pre.sh", "postinstall": "hooks/post.sh"}
+	if other, _ := Digest(binSum, cfg, renamed, testRead(files)); bytes.Equal(other, data) {
+		t.Error("hook name change not covered")
+	}
+	if other, _ := Digest(binSum, []byte(`{"binname":"other"}`), hooks, testRead(files)); bytes.Equal(other, data) {
+		t.Error("app.cfg change not covered")
+	}
+	// 可在设备上调整的字段和格式变化不影响签名
+	tuned := []byte(`{ "cputhreshold": 90, "env": ["DEBUG=1"], "args": ["-v"],
+		"binname": "hello" }`)
+	if other, _ := Digest(binSum, tuned, hooks, testRead(files)); !bytes.Equal(other, data) {
+		t.Error("unsigned app.cfg field change covered")
+	}
+	if _, err = Digest(binSum, []byte(`{"binname":`), hooks, testRead(files)); err == nil {
+		t.Error("invalid app.cfg accepted")
+	}
+
+	if _, err = Digest(binSum, cfg, map[string]string{"preinstall": "/bin/sh"}, testRead(files)); err == nil {
+		t.Error("absolute hook path accepted")
+	}
+	if _, err = Digest(binSum, cfg, map[string]string{"preinstall": "missing.sh"}, testRead(files)); err == nil {
+		t.Error("missing hook script accepted")
+	}
+}
+
+func TestVerifyPackage(t *testing.T) {
+	binSum := []byte("0123456789abcdef")
+	cfg := []byte(`{"binname":"hello"}`)
+	read := testRead(map[string]string{"pre.sh": "echo pre"})
+
+	if _, err := VerifyPackage(binSum, cfg, nil, read, nil); err != ErrNoSign {
+		t.Errorf("no sign err=%v", err)
+	}
+	legacy, err := VerifyPackage(binSum, cfg, map[string]string{"preinstall": "pre.sh"}, read, bytes.Repeat([]byte{1}, 128))
+	if err == nil || legacy {
+		t.Errorf("bad sign legacy=%v, err=%v", legacy, err)
+	}
+	if _, err = VerifyPackage(binSum, cfg, map[string]string{"preinstall": "../pre.sh"}, read, []byte{1}); err == nil {
+		t.Error("hook outside package accepted")
+	}
+}
@@ -1,43 +1,90 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"dockerapi"
+	"kubeapi"
 )
 
 const help = `
-Usage: container [-h] [install deploy-file] [uninstall deploy-file] [status]
+Usage: container [-h] [install deploy-file] [uninstall deploy-file] [status [pod-name]] [list]
+       [logs app-name] [restart app-name] [exec app-name -- cmd] [rollout status|undo app-name]
+       [init app-name --image image] [validate deploy-file]
 Configure the basic functions of containers.
 Application_context: Users can use the app images to create containers by executing the container 
 install container app-name command. The app images are download into xxx/xxx directory. 
 The app images file will be deleted after setup.
 Users can delete the containers by executing container uninstall container.
 Users can get the status of containers by executing container status command. 
-IP address, CPU usage, RAM usage and storage usage can be get only when the container is in running status, otherwise, all the value will be 0.
+IP address, CPU usage and memory usage can be get only when the container is in running status, otherwise, the value will be empty.
 The command can be executed in any directory.
+The kubernetes api server is accessed with $KUBECONFIG, ~/.kube/config, /etc/kubernetes/admin.conf,
+or the client certificates in /etc/kubernetes/pki.
 Commands:
 -h			--help, show help information
-install			--creating containers using deploy yaml file
+install			--creating containers using deploy yaml file, the file is validated before apply
 uninstall		--uninstall the specified container using deploy yaml file
-status			--show status information of containers
+status			--show status information of containers, without pod-name show all pods on this node
+			--with cpu, memory, block io and node totals, --watch to refresh, --interval 2s
+			--pod stats are read from the Docker Engine API(/var/run/docker.sock), so block io
+			--needs docker as the container runtime; with containerd/cri-o, or when docker is
+			--not available, cpu and memory come from the kubelet summary and block io is "-"
 list			--show all containers
+logs			--print the logs of the app container, -f follow, --since 10m, --tail 100
+restart			--rolling restart the app, a pod without controller is not supported
+exec			--execute a command in the app container, command after --
+rollout status		--wait until the app rollout finished, --timeout 5m
+rollout undo		--rollback the app to the previous revision, --to-revision n
+init			--generate deployment/daemonset and configmap yaml of the app
+validate		--check deploy yaml file offline
+
+init options:
+--image image		--app image, required
+--kind kind		--deployment(default) or daemonset
+--node hostname		--run on the TTU node with the hostname
+--replicas n		--deployment replicas, default 1
+--cpu-request 100m	--cpu request, --cpu-limit 500m for limit
+--mem-request 64Mi	--memory request, --mem-limit 256Mi for limit
+--hostnetwork		--use host network
+--device /dev/ttyS1	--mount device, /dev/host:/dev/container, multiple
+--env KEY=VALUE		--environment in configmap, multiple
+--config file		--config file in configmap, mounted at --config-dir(default /etc/app-name), multiple
+-n namespace		--namespace of the objects
+-f file			--write yaml to file, default stdout
 
 Parameters:
 deploy-file		--deploy yaml file.
 app-name		--Specify the app image file name in the container,string format.
-`
+			--logs/restart/exec/rollout: deployment or daemonset name, or pod name
+pod-name		--pod name in the default namespace.
+-c container		--container name in the pod, default the first container
+-o json			--status/logs/restart/exec/rollout output json, status --watch outputs one line per refresh
+			--status source: docker, kubelet or docker,kubelet, where the pod stats came from
 
-type dockerStat struct {
-	Container string
-	Name      string
-	Memory    string
-	CPUPerc   string
-	MemPerc   string
-	BlockIO   string
-}
+example:
+container status --watch
+container status -o json
+container logs appctl -f --since 10m
+container exec appctl -- appctl -version container
+container rollout undo appctl -o json
+container init appctl --image basic_img-arm:1.0 --kind daemonset --node ttu1 --hostnetwork --device /dev/ttyS1 -f appctl.yaml
+`
 
 func main() {
 	len := len(os.Args)
@@ -63,14 +110,31 @@ func main() {
 		} else {
 			kubeUninstall(os.Args[2])
 		}
-	case "status":
+	case "list":
+		kubeList()
+	case "init":
+		err := kubeInit(os.Args[2:])
+		if err == errHelp {
+			fmt.Println(help)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+	case "validate":
 		if len < 3 {
 			fmt.Println(help)
-		} else {
-			kubeStatus(os.Args[2])
+		} else if _, err := validateDeployFile(os.Args[2]); err != nil {
+			os.Exit(1)
+		}
+	case "status", "logs", "restart", "exec", "rollout":
+		err := kubeAppCmd(os.Args[1], os.Args[2:])
+		if err == errHelp {
+			fmt.Println(help)
+			os.Exit(1)
+		}
+		if err != nil {
+			os.Exit(1)
 		}
-	case "list":
-		kubeList()
 	default:
 		fmt.Println(help)
 	}
@@ -85,7 +149,19 @@ func execBashCmd(bash string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+func newKubeClient() (*kubeapi.Client, error) {
+	cfg, err := kubeapi.LoadConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return kubeapi.NewClient(cfg)
+}
+
 func kubeInstall(name string) error {
+	_, err := validateDeployFile(name)
+	if err != nil {
+		return err
+	}
 	fmt.Println("It will take some time to install, please wait a moment.")
 	res, err := execBashCmd("kubectl apply -f " + name)
 	if err != nil {
@@ -107,71 +183,816 @@ func kubeUninstall(name string) error {
 	return err
 }
 
-func kubeStatus(name string) error {
-	fmt.Println("It will take some time to get status, please wait a moment.")
-	res, err := execBashCmd("kubectl describe pod " + name)
-	if err != nil {
-		fmt.Println(res, ",", err)
-		return err
+// 与 kubectl apply -f 相同，name 为目录时检查其中的 yaml、yml、json 文件
+func validateDeployFile(name string) ([]kubeapi.ManifestObject, error) {
+	files := []string{name}
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		files = nil
+		for _, ext := range []string{"*.yaml", "*.yml", "*.json"} {
+			lst, _ := filepath.Glob(filepath.Join(name, ext))
+			files = append(files, lst...)
+		}
 	}
-	//fmt.Println(res)
 
-	var ip string
-	var container string
-	var status string
-	strList := strings.Split(res, "\n")
-	for _, v := range strList {
-		if idx := strings.Index(v, "IP:"); idx > -1 {
-			ip = strings.TrimSpace(v[idx+len("IP:"):])
+	var objs []kubeapi.ManifestObject
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			fmt.Println(err)
+			return objs, err
+		}
+		lst, err := kubeapi.ValidateManifest(data)
+		if err != nil {
+			fmt.Println(fn, "check failed:", err)
+			return objs, err
 		}
-		if idx := strings.Index(v, "Container ID:"); idx > -1 {
-			container = strings.TrimSpace(v[idx+len("Container ID:"):])
+		for _, v := range lst {
+			fmt.Println(fn+":", v.Kind+"/"+v.Name, "ok")
 		}
+		objs = append(objs, lst...)
 	}
+	if len(objs) == 0 {
+		err = fmt.Errorf("no deploy file in %s", name)
+		fmt.Println(err)
+	}
+	return objs, err
+}
+
+type StringArray []string
 
-	if idx := strings.Index(container, "docker://"); idx > -1 {
-		container = strings.TrimSpace(container[idx+len("docker://"):])
+func (s *StringArray) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *StringArray) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// 应用名可以在选项前或后
+func kubeInit(args []string) error {
+	spec := &kubeapi.AppSpec{Env: make(map[string]string), Files: make(map[string]string)}
+	var devices, envs, configs StringArray
+	flagSet := flag.NewFlagSet("container init", flag.ContinueOnError)
+	flagSet.Usage = func() {}
+	flagSet.StringVar(&spec.Image, "image", "", "app image")
+	flagSet.StringVar(&spec.Kind, "kind", "deployment", "deployment or daemonset")
+	flagSet.StringVar(&spec.Node, "node", "", "node hostname")
+	flagSet.IntVar(&spec.Replicas, "replicas", 1, "replicas")
+	flagSet.StringVar(&spec.CPURequest, "cpu-request", "", "cpu request")
+	flagSet.StringVar(&spec.CPULimit, "cpu-limit", "", "cpu limit")
+	flagSet.StringVar(&spec.MemRequest, "mem-request", "", "memory request")
+	flagSet.StringVar(&spec.MemLimit, "mem-limit", "", "memory limit")
+	flagSet.BoolVar(&spec.HostNetwork, "hostnetwork", false, "host network")
+	flagSet.Var(&devices, "device", "device")
+	flagSet.Var(&envs, "env", "environment")
+	flagSet.Var(&configs, "config", "config file")
+	flagSet.StringVar(&spec.ConfigDir, "config-dir", "", "config mount path")
+	flagSet.StringVar(&spec.Namespace, "n", "", "namespace")
+	out := flagSet.String("f", "", "output file")
+
+	err := flagSet.Parse(args)
+	if err == nil && flagSet.NArg() > 0 {
+		spec.Name = flagSet.Arg(0)
+		err = flagSet.Parse(flagSet.Args()[1:])
+	}
+	if err != nil || len(spec.Name) == 0 || flagSet.NArg() > 0 {
+		return errHelp
+	}
+
+	spec.Devices = devices
+	for _, v := range envs {
+		idx := strings.Index(v, "=")
+		if idx <= 0 {
+			err = fmt.Errorf("invalid env %s, use KEY=VALUE", v)
+			fmt.Println(err)
+			return err
+		}
+		spec.Env[v[:idx]] = v[idx+1:]
+	}
+	for _, v := range configs {
+		data, err := ioutil.ReadFile(v)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		spec.Files[filepath.Base(v)] = string(data)
+	}
+
+	data, err := kubeapi.GenerateApp(spec)
+	if err == nil {
+		_, err = kubeapi.ValidateManifest(data)
 	}
-	res, err = execBashCmd(`kubectl get pod ` + name + ` | awk '{print $3}'`)
 	if err != nil {
 		fmt.Println(err)
+		return err
+	}
+	if len(*out) == 0 {
+		fmt.Print(string(data))
+		return nil
+	}
+	err = ioutil.WriteFile(*out, data, 0644)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	fmt.Println("write", *out, "ok, install with: container install", *out)
+	return nil
+}
+
+// 返回 pod 状态和资源使用，资源使用取不到时 Metrics 为 nil
+func getPodStatus(client *kubeapi.Client, name string) (*kubeapi.PodStatus, error) {
+	pod, err := client.GetPod("", name)
+	if err != nil {
+		return nil, err
+	}
+	st := kubeapi.GetPodStatus(pod)
+	if st.Phase == "Running" {
+		st.Metrics, _ = client.GetPodMetrics(pod)
+	}
+	return st, nil
+}
+
+func kubeStatus(client *kubeapi.Client, a *appArgs) error {
+	st, err := getPodStatus(client, a.args[0])
+	if err != nil {
+		return err
+	}
+	if a.output == "json" {
+		printJSON(st)
+		return nil
+	}
+
+	fmt.Println("name:\t\t", st.Name)
+	fmt.Println("namespace:\t", st.Namespace)
+	fmt.Println("node:\t\t", st.Node)
+	fmt.Println("status:\t\t", st.Status)
+	fmt.Println("ready:\t\t", st.Ready)
+	fmt.Println("restarts:\t", st.Restarts)
+	fmt.Println("ip:\t\t", st.IP)
+	if st.Metrics != nil {
+		fmt.Println("cpu-usage:\t", formatCPU(st.Metrics.CPU))
+		fmt.Println("memory:\t\t", formatBytes(st.Metrics.Memory))
 	} else {
-		statList := strings.Split(res, "\n")
-		if len(statList) > 1 {
-			status = statList[1]
+		fmt.Println("cpu-usage:\t")
+		fmt.Println("memory:\t\t")
+	}
+	for _, v := range st.Containers {
+		fmt.Println("container:\t", v.Name, v.State, v.Reason)
+		fmt.Println("  id:\t\t", v.ID)
+		fmt.Println("  image:\t", v.Image)
+		fmt.Println("  restarts:\t", v.Restarts)
+	}
+
+	return nil
+}
+
+func kubeList() error {
+	client, err := newKubeClient()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	pods, err := client.ListPods("", "", "")
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREADY\tSTATUS\tRESTARTS\tAGE\tIP\tNODE")
+	for k := range pods {
+		st := kubeapi.GetPodStatus(&pods[k])
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", st.Name, st.Ready, st.Status, st.Restarts,
+			formatAge(pods[k].Metadata.CreationTimestamp), st.IP, st.Node)
+	}
+	return w.Flush()
+}
+
+var errHelp = errors.New("help")
+
+// logs、restart、exec、rollout 的参数，选项可以在应用名前后，-- 之后为 exec 的命令
+type appArgs struct {
+	args       []string
+	cmd        []string
+	container  string
+	output     string
+	follow     bool
+	watch      bool
+	interval   time.Duration
+	since      time.Duration
+	tail       int
+	timeout    time.Duration
+	toRevision int64
+}
+
+var boolFlags = map[string]bool{"-f": true, "--follow": true, "-w": true, "--watch": true}
+
+func parseAppArgs(lst []string) (*appArgs, error) {
+	a := &appArgs{timeout: 5 * time.Minute, interval: 2 * time.Second}
+	for i := 0; i < len(lst); i++ {
+		name := lst[i]
+		if name == "--" {
+			a.cmd = lst[i+1:]
+			break
+		}
+		if false == strings.HasPrefix(name, "-") {
+			a.args = append(a.args, name)
+			continue
+		}
+
+		value := ""
+		if idx := strings.Index(name, "="); idx > 0 {
+			name, value = name[:idx], name[idx+1:]
+		} else if false == boolFlags[name] {
+			if i+1 >= len(lst) {
+				return nil, fmt.Errorf("flag %s needs a value", name)
+			}
+			i++
+			value = lst[i]
+		}
+
+		var err error
+		switch name {
+		case "-f", "--follow":
+			a.follow = true
+		case "-w", "--watch":
+			a.watch = true
+		case "--interval":
+			a.interval, err = time.ParseDuration(value)
+			if err == nil && a.interval < time.Second {
+				err = errors.New("interval at least 1s")
+			}
+		case "-c", "--container":
+			a.container = value
+		case "-o", "--output":
+			a.output = value
+			if value != "json" {
+				err = fmt.Errorf("unsupported output %s", value)
+			}
+		case "--since":
+			a.since, err = time.ParseDuration(value)
+		case "--tail":
+			a.tail, err = strconv.Atoi(value)
+		case "--timeout":
+			a.timeout, err = time.ParseDuration(value)
+		case "--to-revision":
+			a.toRevision, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown flag %s", name)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
+	return a, nil
+}
 
-	ret, err := execBashCmd(`docker stats ` + container + ` --no-stream --format "{\"container\":\"{{ .Container }}\",\"name\":\"{{ .Name }}\",
-	\"memory\":\"{{ .MemUsage }}\",\"cpuperc\":\"{{ .CPUPerc }}\",\"memperc\":\"{{ .MemPerc }}\",\"blockio\":\"{{ .BlockIO }}\"}"`)
+// 错误在 -o json 时也以 JSON 输出：{"error": "..."}
+func kubeAppCmd(cmd string, lst []string) error {
+	a, err := parseAppArgs(lst)
+	if err == nil {
+		err = checkAppArgs(cmd, a)
+	}
+	if err == errHelp {
+		return err
+	}
+	if err == nil {
+		var client *kubeapi.Client
+		client, err = newKubeClient()
+		if err == nil {
+			switch cmd {
+			case "status":
+				if len(a.args) == 1 {
+					err = kubeStatus(client, a)
+				} else {
+					err = kubeNodeStatus(client, a)
+				}
+			case "logs":
+				err = kubeLogs(client, a)
+			case "restart":
+				err = kubeRestart(client, a)
+			case "exec":
+				err = kubeExec(client, a)
+			case "rollout":
+				err = kubeRollout(client, a)
+			}
+		}
+	}
+	if err != nil {
+		if a != nil && a.output == "json" {
+			printJSON(map[string]string{"error": err.Error()})
+		} else {
+			fmt.Println(err)
+		}
+	}
+	return err
+}
 
-	ds := dockerStat{}
-	err = json.Unmarshal([]byte(ret), &ds)
+func checkAppArgs(cmd string, a *appArgs) error {
+	switch {
+	case cmd == "rollout" && len(a.args) == 2 && (a.args[0] == "status" || a.args[0] == "undo"):
+		return nil
+	case cmd == "rollout":
+		return errHelp
+	case cmd == "status" && len(a.args) <= 1:
+		return nil
+	case len(a.args) != 1:
+		return errHelp
+	case cmd == "exec" && len(a.cmd) == 0:
+		return errors.New("exec needs a command after --")
+	}
+	return nil
+}
+
+func printJSON(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+// 应用名为 Deployment/DaemonSet 时在其 pod 中选择：本节点优先，其次运行中的；否则按 pod 名查找
+func getAppPod(client *kubeapi.Client, app string) (*kubeapi.Pod, error) {
+	w, err := client.GetWorkload("", app)
+	if kubeapi.IsNotFound(err) {
+		return client.GetPod("", app)
+	}
 	if err != nil {
-		//fmt.Println(err)
-		//log.Println(ret)
+		return nil, err
+	}
+	pods, err := client.WorkloadPods(w)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("%s %s has no pod", w.Kind, app)
+	}
+
+	hostname, _ := os.Hostname()
+	best, score := 0, -1
+	for k := range pods {
+		v := 0
+		if pods[k].Spec.NodeName == hostname {
+			v += 2
+		}
+		if pods[k].Status.Phase == "Running" {
+			v++
+		}
+		if v > score {
+			best, score = k, v
+		}
+	}
+	return &pods[best], nil
+}
+
+// -c 未指定时使用第一个容器，多容器 pod 的 log/exec 接口要求指定容器
+func getContainer(pod *kubeapi.Pod, container string) string {
+	if len(container) == 0 && len(pod.Spec.Containers) > 0 {
+		return pod.Spec.Containers[0].Name
+	}
+	return container
+}
+
+func kubeLogs(client *kubeapi.Client, a *appArgs) error {
+	pod, err := getAppPod(client, a.args[0])
+	if err != nil {
+		return err
+	}
+	opt := &kubeapi.LogOptions{
+		Container: getContainer(pod, a.container),
+		Follow:    a.follow,
+		Since:     a.since,
+		Tail:      a.tail,
+	}
+	rd, err := client.Logs(pod.Metadata.Namespace, pod.Metadata.Name, opt)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	// JSON 模式每行一个对象，便于 -f 时逐行处理
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	enc := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		if a.output == "json" {
+			enc.Encode(map[string]string{"pod": pod.Metadata.Name, "container": opt.Container, "log": scanner.Text()})
+		} else {
+			fmt.Println(scanner.Text())
+		}
+	}
+	return scanner.Err()
+}
+
+// 有控制器的 pod 直接删除由控制器重建，没有控制器的删除后不会恢复，不支持
+func kubeRestart(client *kubeapi.Client, a *appArgs) error {
+	app := a.args[0]
+	result := map[string]string{"app": app}
+	w, err := client.GetWorkload("", app)
+	if err == nil {
+		result["kind"] = w.Kind
+		result["restartedAt"], err = client.Restart(w)
+	} else if kubeapi.IsNotFound(err) {
+		var pod *kubeapi.Pod
+		pod, err = client.GetPod("", app)
+		if err == nil && len(pod.Metadata.OwnerReferences) == 0 {
+			err = fmt.Errorf("pod %s has no controller, restart not supported", app)
+		}
+		if err == nil {
+			result["kind"] = "Pod"
+			result["restartedAt"] = time.Now().Format(time.RFC3339)
+			err = client.DeletePod(pod.Metadata.Namespace, app)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.output == "json" {
+		printJSON(result)
 	} else {
-		//fmt.Println(ds)
+		fmt.Println(strings.ToLower(result["kind"]), app, "restarted")
 	}
+	return nil
+}
 
-	fmt.Println("name:\t\t", name)
-	fmt.Println("status:\t\t", status)
-	fmt.Println("ip:\t\t", ip)
-	fmt.Println("cpu-usage:\t", ds.CPUPerc)
-	fmt.Println("memory:\t\t", ds.Memory)
-	fmt.Println("memory-usage:\t", ds.MemPerc)
-	fmt.Println("block io:\t", ds.BlockIO)
+func kubeExec(client *kubeapi.Client, a *appArgs) error {
+	pod, err := getAppPod(client, a.args[0])
+	if err != nil {
+		return err
+	}
+	container := getContainer(pod, a.container)
+
+	if a.output != "json" {
+		code, err := client.Exec(pod.Metadata.Namespace, pod.Metadata.Name, container, a.cmd, os.Stdout, os.Stderr)
+		if err == nil && code != 0 {
+			os.Exit(code)
+		}
+		return err
+	}
 
+	var stdout, stderr bytes.Buffer
+	code, err := client.Exec(pod.Metadata.Namespace, pod.Metadata.Name, container, a.cmd, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	printJSON(map[string]interface{}{
+		"pod":       pod.Metadata.Name,
+		"container": container,
+		"command":   a.cmd,
+		"exitCode":  code,
+		"stdout":    stdout.String(),
+		"stderr":    stderr.String(),
+	})
+	if code != 0 {
+		os.Exit(code)
+	}
 	return nil
 }
 
-func kubeList() error {
-	fmt.Println("It will take some time to get list, please wait a moment.")
-	res, err := execBashCmd("kubectl get pods")
+func kubeRollout(client *kubeapi.Client, a *appArgs) error {
+	app := a.args[1]
+	w, err := client.GetWorkload("", app)
 	if err != nil {
-		fmt.Println(res, ",", err)
 		return err
 	}
-	fmt.Println(res)
-	return err
+
+	if a.args[0] == "undo" {
+		revision, err := client.Undo(w, a.toRevision)
+		if err != nil {
+			return err
+		}
+		if a.output == "json" {
+			printJSON(map[string]interface{}{"app": app, "kind": w.Kind, "revision": revision})
+		} else {
+			fmt.Println(strings.ToLower(w.Kind), app, "rolled back to revision", revision)
+		}
+		return nil
+	}
+
+	// 文本模式每次状态变化输出一行，JSON 模式只输出最终状态
+	deadline := time.Now().Add(a.timeout)
+	last := ""
+	for {
+		st, err := client.GetRolloutStatus(w)
+		if err != nil {
+			return err
+		}
+		if a.output != "json" && st.Message != last {
+			fmt.Println(st.Message)
+			last = st.Message
+		}
+		if st.Done || time.Now().After(deadline) {
+			if a.output == "json" {
+				printJSON(st)
+				if false == st.Done {
+					os.Exit(1)
+				}
+				return nil
+			}
+			if false == st.Done {
+				return errors.New("timed out waiting for rollout")
+			}
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// kubelet 通过 dockershim 使用 docker，容器统计直接从 Docker Engine API 读取；
+// 其它运行时读不到时退回 kubelet summary，没有块设备读写
+var gDocker = dockerapi.NewClient(dockerapi.DefSock, 30*time.Second)
+
+// Docker Engine API /containers/{id}/stats 中用到的字段
+type dockerStats struct {
+	CPUStats    dockerCPUStats `json:"cpu_stats"`
+	PreCPUStats dockerCPUStats `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage int64            `json:"usage"`
+		Stats map[string]int64 `json:"stats"`
+	} `json:"memory_stats"`
+	BlkioStats struct {
+		IoServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value int64  `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+type dockerCPUStats struct {
+	CPUUsage struct {
+		TotalUsage  int64   `json:"total_usage"`
+		PercpuUsage []int64 `json:"percpu_usage"`
+	} `json:"cpu_usage"`
+	SystemCPUUsage int64 `json:"system_cpu_usage"`
+	OnlineCPUs     int64 `json:"online_cpus"`
+}
+
+// 节点上所有 pod 的状态和资源使用，Usage 为 kubelet 统计的节点使用，Capacity 为节点容量，
+// Source 为 pod 统计的来源，docker、kubelet 或两者都有时 docker,kubelet
+type nodeStatus struct {
+	Node     string               `json:"node"`
+	Time     int64                `json:"time"`
+	Source   string               `json:"source,omitempty"`
+	Pods     []*kubeapi.PodStatus `json:"pods"`
+	Total    nodeResource         `json:"total"`
+	Usage    *nodeResource        `json:"usage,omitempty"`
+	Capacity *nodeResource        `json:"capacity,omitempty"`
+}
+
+type nodeResource struct {
+	Pods       int   `json:"pods,omitempty"`
+	CPU        int64 `json:"cpu"`
+	Memory     int64 `json:"memory"`
+	BlockRead  int64 `json:"blockRead,omitempty"`
+	BlockWrite int64 `json:"blockWrite,omitempty"`
+}
+
+// 与 docker stats 的计算方法相同：CPU 为两次采样的差值，内存不计页缓存
+func getDockerStats(id string) (*kubeapi.ContainerMetrics, error) {
+	ds := dockerStats{}
+	err := gDocker.Call("GET", "/containers/"+id+"/stats?stream=false", nil, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &kubeapi.ContainerMetrics{}
+	cpuDelta := ds.CPUStats.CPUUsage.TotalUsage - ds.PreCPUStats.CPUUsage.TotalUsage
+	sysDelta := ds.CPUStats.SystemCPUUsage - ds.PreCPUStats.SystemCPUUsage
+	cpus := ds.CPUStats.OnlineCPUs
+	if cpus == 0 {
+		cpus = int64(len(ds.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && sysDelta > 0 {
+		m.CPU = cpuDelta * cpus * 1000 / sysDelta
+	}
+	// cgroup v1 为 cache，v2 为 inactive_file
+	m.Memory = ds.MemoryStats.Usage
+	if v, ok := ds.MemoryStats.Stats["cache"]; ok {
+		m.Memory -= v
+	} else if v, ok := ds.MemoryStats.Stats["inactive_file"]; ok {
+		m.Memory -= v
+	}
+	for _, v := range ds.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(v.Op) {
+		case "read":
+			m.BlockRead += v.Value
+		case "write":
+			m.BlockWrite += v.Value
+		}
+	}
+	return m, nil
+}
+
+// docker 统计每次需要约 1 秒采样，所有容器并发读取
+func getPodDockerMetrics(st *kubeapi.PodStatus) (*kubeapi.PodMetrics, error) {
+	m := &kubeapi.PodMetrics{Source: "docker"}
+	lst := make([]*kubeapi.ContainerMetrics, len(st.Containers))
+	errs := make([]error, len(st.Containers))
+	var wg sync.WaitGroup
+	for k, v := range st.Containers {
+		if v.State != "Running" || len(v.ID) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(k int, id string) {
+			defer wg.Done()
+			lst[k], errs[k] = getDockerStats(id)
+		}(k, v.ID)
+	}
+	wg.Wait()
+
+	running := false
+	for k, v := range lst {
+		if errs[k] != nil {
+			return nil, errs[k]
+		}
+		if v == nil {
+			continue
+		}
+		running = true
+		v.Name = st.Containers[k].Name
+		m.CPU += v.CPU
+		m.Memory += v.Memory
+		m.BlockRead += v.BlockRead
+		m.BlockWrite += v.BlockWrite
+		m.Containers = append(m.Containers, *v)
+	}
+	if false == running {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// 节点名即主机名；docker 统计取不到时使用 kubelet summary，没有块设备读写
+func getNodeStatus(client *kubeapi.Client) (*nodeStatus, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	ns := &nodeStatus{Node: strings.ToLower(hostname), Time: time.Now().Unix()}
+	pods, err := client.ListNodePods(ns.Node)
+	if err != nil {
+		return nil, err
+	}
+	summary, _ := client.GetSummary(ns.Node)
+
+	ns.Pods = make([]*kubeapi.PodStatus, len(pods))
+	var wg sync.WaitGroup
+	for k := range pods {
+		ns.Pods[k] = kubeapi.GetPodStatus(&pods[k])
+		if ns.Pods[k].Phase != "Running" {
+			continue
+		}
+		wg.Add(1)
+		go func(st *kubeapi.PodStatus) {
+			defer wg.Done()
+			m, err := getPodDockerMetrics(st)
+			if err != nil && summary != nil {
+				m = summary.PodMetrics(st.Namespace, st.Name)
+			}
+			st.Metrics = m
+		}(ns.Pods[k])
+	}
+	wg.Wait()
+
+	sources := make(map[string]bool)
+	for _, st := range ns.Pods {
+		ns.Total.Pods++
+		if st.Metrics == nil {
+			continue
+		}
+		sources[st.Metrics.Source] = true
+		ns.Total.CPU += st.Metrics.CPU
+		ns.Total.Memory += st.Metrics.Memory
+		ns.Total.BlockRead += st.Metrics.BlockRead
+		ns.Total.BlockWrite += st.Metrics.BlockWrite
+	}
+	var lst []string
+	for k := range sources {
+		lst = append(lst, k)
+	}
+	sort.Strings(lst)
+	ns.Source = strings.Join(lst, ",")
+	if summary != nil {
+		cpu, mem := summary.NodeUsage()
+		ns.Usage = &nodeResource{CPU: cpu, Memory: mem}
+	}
+	if node, err := client.GetNode(ns.Node); err == nil {
+		ns.Capacity = &nodeResource{
+			CPU:    kubeapi.ParseQuantity(node.Status.Capacity["cpu"], true),
+			Memory: kubeapi.ParseQuantity(node.Status.Capacity["memory"], false),
+		}
+	}
+	return ns, nil
+}
+
+func kubeNodeStatus(client *kubeapi.Client, a *appArgs) error {
+	for {
+		ns, err := getNodeStatus(client)
+		if err != nil {
+			return err
+		}
+		switch {
+		case a.output == "json" && a.watch:
+			data, _ := json.Marshal(ns)
+			fmt.Println(string(data))
+		case a.output == "json":
+			printJSON(ns)
+		default:
+			if a.watch {
+				fmt.Print("\033[H\033[2J")
+			}
+			printNodeStatus(ns)
+		}
+		if false == a.watch {
+			return nil
+		}
+		time.Sleep(a.interval)
+	}
+}
+
+func printNodeStatus(ns *nodeStatus) {
+	var capacity nodeResource
+	if ns.Capacity != nil {
+		capacity = *ns.Capacity
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tREADY\tSTATUS\tRESTARTS\tCPU\tCPU%\tMEMORY\tMEM%\tBLOCK I/O")
+	total := &kubeapi.PodMetrics{Source: "kubelet", BlockRead: ns.Total.BlockRead, BlockWrite: ns.Total.BlockWrite}
+	for _, st := range ns.Pods {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t", st.Namespace, st.Name, st.Ready, st.Status, st.Restarts)
+		if st.Metrics == nil {
+			fmt.Fprintln(w, "-\t-\t-\t-\t-")
+			continue
+		}
+		if st.Metrics.Source == "docker" {
+			total.Source = "docker"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", formatCPU(st.Metrics.CPU), formatPercent(st.Metrics.CPU, capacity.CPU),
+			formatBytes(st.Metrics.Memory), formatPercent(st.Metrics.Memory, capacity.Memory), formatBlockIO(st.Metrics))
+	}
+	fmt.Fprintf(w, "TOTAL\t%d pods\t\t\t\t%s\t%s\t%s\t%s\t%s\n", ns.Total.Pods,
+		formatCPU(ns.Total.CPU), formatPercent(ns.Total.CPU, capacity.CPU),
+		formatBytes(ns.Total.Memory), formatPercent(ns.Total.Memory, capacity.Memory), formatBlockIO(total))
+	w.Flush()
+
+	fmt.Println()
+	fmt.Print("node: ", ns.Node)
+	if ns.Usage != nil {
+		fmt.Printf(", cpu %s(%s), memory %s(%s)", formatCPU(ns.Usage.CPU), formatPercent(ns.Usage.CPU, capacity.CPU),
+			formatBytes(ns.Usage.Memory), formatPercent(ns.Usage.Memory, capacity.Memory))
+	}
+	if ns.Capacity != nil {
+		fmt.Printf(", capacity cpu %s, memory %s", formatCPU(capacity.CPU), formatBytes(capacity.Memory))
+	}
+	fmt.Println()
+}
+
+func formatPercent(v, total int64) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(v)*100/float64(total))
+}
+
+// kubelet 统计没有块设备读写
+func formatBlockIO(m *kubeapi.PodMetrics) string {
+	if m.Source != "docker" {
+		return "-"
+	}
+	return formatBytes(m.BlockRead) + " / " + formatBytes(m.BlockWrite)
+}
+
+// 与 kubectl 相同的 AGE 格式：30s、5m、3h、2d
+func formatAge(t *time.Time) string {
+	if t == nil {
+		return "<unknown>"
+	}
+	d := time.Since(*t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+func formatCPU(milli int64) string {
+	return fmt.Sprintf("%dm", milli)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
 }
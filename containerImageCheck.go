@@ -1,32 +1,222 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"os/exec"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"dockerapi"
+	"github.com/ghodss/yaml"
+	"imgverify"
 )
 
+const help string = `
+containerImageCheck version2.0.0, command parameter:
+
+containerImageCheck -policy /usr/local/monitor/imagepolicy.yaml -once
+-policy: image gc policy file(yaml or json), reload every check
+-once: check once and exit
+-dryrun: only report, do not remove image, override policy
+-sock: docker unix socket, default /var/run/docker.sock
+-verify: verify image archive(docker save tar or OCI layout) signature with policy keydir/sigdir and exit
+
+policy:
+   interval: 10m              # check interval, min 10s
+   dryrun: false
+   allow: ["gcr.io/google_containers/*"]   # never remove, match repo:tag or repo, * for any
+   deny: ["*:test-*"]         # remove even if in keeplast or younger than minage
+   keeplast: 3                # keep newest N tags per repository, 0 for no limit
+   minage: 72h                # keep images younger than minage
+   signedonly: true           # verify cosign-style signatures with public keys in keydir
+   keydir: /usr/local/monitor/imagekeys   # trusted public keys, *.pub/*.pem, ECDSA or RSA
+   sigdir: /usr/local/monitor/imagesigs   # signatures, <digest>.sig (+ <digest>.payload)
+   unverified: remove         # unverified image action: remove, quarantine or keep
+   dangling: true             # remove <none>:<none> images older than minage
+   report: /var/log/containerImageCheck.log
+`
+
+const defPolicyFile string = "/usr/local/monitor/imagepolicy.yaml"
+const defQuarantineRepo string = "quarantine"
+const defReportFile string = "/var/log/containerImageCheck.log"
+const defReportFileSize int64 = 1024 * 1024
+const defCheckInterval time.Duration = 10 * time.Minute
+const defMinInterval time.Duration = 10 * time.Second
+const defAPITimeout time.Duration = 60 * time.Second
+const noneTag string = "<none>:<none>"
+
 var k8sNode = []string{
-	"REPOSITORY:TAG",
 	"gcr.io/google_containers/pause-amd64:3.0",
 	"gcr.io/google_containers/kube-proxy-amd64:v1.9.0",
 	"quay.io/coreos/flannel:v0.9.1-amd64",
 }
 
+// interval、minage 为 time.ParseDuration 格式，如 10m、72h
+type imagePolicy struct {
+	Interval   string   `json:"interval"`
+	DryRun     bool     `json:"dryrun"`
+	Allow      []string `json:"allow"`
+	Deny       []string `json:"deny"`
+	KeepLast   int      `json:"keeplast"`
+	MinAge     string   `json:"minage"`
+	SignedOnly bool     `json:"signedonly"`
+	KeyDir     string   `json:"keydir"`
+	SigDir     string   `json:"sigdir"`
+	Unverified string   `json:"unverified"`
+	Dangling   bool     `json:"dangling"`
+	Report     string   `json:"report"`
+
+	interval time.Duration
+	minAge   time.Duration
+	verifier *imgverify.Verifier
+	keyErr   error
+}
+
+// Docker Engine API /images/json 返回的字段
+type dockerImage struct {
+	Id          string
+	RepoTags    []string
+	RepoDigests []string
+	Created     int64
+	Size        int64
+}
+
+type dockerContainer struct {
+	Id      string
+	Names   []string
+	ImageID string
+	State   string
+}
+
+type dockerVersion struct {
+	Version    string
+	ApiVersion string
+}
+
+// 每个镜像标签一条决策，action 为 keep、remove、quarantine、dryrun 或 error
+type imageDecision struct {
+	Time   int64  `json:"time"`
+	Image  string `json:"image"`
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+var gDocker *dockerapi.Client
+
 func main() {
-	err := checkDocker()
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	policyFile := flagSet.String("policy", defPolicyFile, "image gc policy file")
+	once := flagSet.Bool("once", false, "check once and exit")
+	dryRun := flagSet.Bool("dryrun", false, "only report")
+	verify := flagSet.String("verify", "", "verify image archive signature")
+	sock := flagSet.String("sock", dockerapi.DefSock, "docker unix socket")
+	err := flagSet.Parse(os.Args[1:])
+	if err != nil {
+		fmt.Print(help)
+		os.Exit(1)
+	}
+	gDocker = dockerapi.NewClient(*sock, defAPITimeout)
+
+	if len(*verify) > 0 {
+		policy, _ := loadPolicy(*policyFile)
+		key, err := verifyArchive(policy, *verify)
+		if err != nil {
+			fmt.Println("verify failed: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("verify ok, key: ", key)
+		return
+	}
+
+	err = checkDocker()
 	if err != nil {
 		log.Println(err)
 	}
 
 	for {
-		checkImage()
-		log.Println("check docker")
-		time.Sleep(time.Millisecond * 100)
+		policy, err := loadPolicy(*policyFile)
+		if err != nil {
+			log.Println("loadPolicy 0x0001: ", err)
+		}
+		if *dryRun {
+			policy.DryRun = true
+		}
+
+		err = checkImage(policy)
+		if err != nil {
+			log.Println("checkImage 0x0001: ", err)
+		}
+		if *once {
+			return
+		}
+		time.Sleep(policy.interval)
+	}
+}
+
+// 策略文件不存在或格式错误时使用默认策略：只允许 k8sNode 中的镜像保留，其它只报告不删除
+func loadPolicy(fn string) (*imagePolicy, error) {
+	policy := &imagePolicy{DryRun: true}
+	content, err := ioutil.ReadFile(fn)
+	if err == nil {
+		content, err = yaml.YAMLToJSON(content)
+	}
+	if err == nil {
+		policy = &imagePolicy{}
+		err = json.Unmarshal(content, policy)
+		if err != nil {
+			policy = &imagePolicy{DryRun: true}
+		}
+	}
+
+	policy.Allow = append(policy.Allow, k8sNode...)
+	if len(policy.KeyDir) == 0 {
+		policy.KeyDir = imgverify.DefKeyDir
+	}
+	if len(policy.SigDir) == 0 {
+		policy.SigDir = imgverify.DefSigDir
+	}
+	if policy.Unverified != "quarantine" && policy.Unverified != "keep" {
+		policy.Unverified = "remove"
+	}
+	// 公钥加载失败时所有镜像都视为未验证
+	policy.verifier, policy.keyErr = imgverify.NewVerifier(policy.KeyDir, policy.SigDir)
+	if policy.keyErr != nil && policy.SignedOnly {
+		log.Println("loadPolicy keydir: ", policy.keyErr)
+	}
+	if len(policy.Report) == 0 {
+		policy.Report = defReportFile
 	}
+	policy.interval = defCheckInterval
+	if len(policy.Interval) > 0 {
+		d, e := time.ParseDuration(policy.Interval)
+		if e != nil {
+			log.Println("loadPolicy interval: ", e)
+		} else {
+			policy.interval = d
+		}
+	}
+	if policy.interval < defMinInterval {
+		policy.interval = defMinInterval
+	}
+	if len(policy.MinAge) > 0 {
+		d, e := time.ParseDuration(policy.MinAge)
+		if e != nil {
+			log.Println("loadPolicy minage: ", e)
+		} else {
+			policy.minAge = d
+		}
+	}
+	return policy, err
 }
 
 func formatString(str string) string {
@@ -36,136 +226,228 @@ func formatString(str string) string {
 	return str
 }
 
-func filterImage(str string) error {
-	for _, v := range k8sNode {
-		if v == str {
-			return nil
-		}
-	}
-
-	return errors.New("invalid image")
-}
-
 func checkDocker() error {
-	cmd := exec.Command("/bin/bash", "-c", "docker -v | awk '{print $3}'")
-	out, err := cmd.CombinedOutput()
+	ver := dockerVersion{}
+	err := gDocker.Call("GET", "/version", nil, &ver)
 	if err != nil {
-		log.Printf("请检测docker是否安装0x0001: %s(%s)\n", string(out), err.Error())
+		log.Printf("请检测docker是否安装0x0001: %s\n", err.Error())
 		return err
 	}
 
-	log.Println("Docker Version: ", formatString(string(out)))
-	trArr := strings.Split(formatString(string(out)), ".")
-	//log.Println(trArr, ",", len(trArr))
+	log.Println("Docker Version: ", ver.Version, ", API Version: ", ver.ApiVersion)
+	trArr := strings.Split(formatString(ver.Version), ".")
 	if len(trArr) > 1 {
 		majVer, _ := strconv.Atoi(trArr[0])
 		subVer, _ := strconv.Atoi(trArr[1])
-		//log.Println(majVer, ",", subVer)
-		if majVer > 16 {
-			if subVer > 11 {
-				return nil
-			}
+		if majVer > 17 || (majVer == 17 && subVer > 11) {
+			return nil
 		}
 	}
 
 	return errors.New("docker version lower, docker version at least 17.12.0")
 }
 
-func checkImage() error {
-	//cmd := exec.Command("/bin/bash", "-c", `docker images | awk '{printf("%s:%s\n",$1,$2)}'`)
-	cmd := exec.Command("/bin/bash", "-c", `docker images --format "{{.ID}}\t{{.Repository}}:{{.Tag}}"`)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Println("checkImage 0x0001: ", err)
-		return err
-	}
-
-	imgMap := make(map[string][]string)
-	trArr := strings.Split(string(out), "\n")
-	//log.Println(trArr)
-	for _, v := range trArr {
-		if v == "" || nil == filterImage(v) {
+// * 匹配任意字符（包括 /），? 匹配单个字符；不带 tag 的模式匹配该仓库所有 tag
+func matchPattern(patterns []string, name string) string {
+	repo := dockerapi.ImageRepo(name)
+	for _, v := range patterns {
+		expr := regexp.QuoteMeta(v)
+		expr = strings.Replace(expr, `\*`, `.*`, -1)
+		expr = strings.Replace(expr, `\?`, `.`, -1)
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
 			continue
 		}
+		if re.MatchString(name) || re.MatchString(repo) {
+			return v
+		}
+	}
+	return ""
+}
 
-		//log.Println(v)
-		items := strings.Split(string(v), "\t")
-		if len(items) > 1 {
-			cmd = exec.Command("docker", "trust", "view", items[1])
-			out, err = cmd.CombinedOutput()
-			if err != nil {
-				//log.Println("checkImage 0x0002: ", err)
-				//log.Println(string(out))
-				imgMap[items[0]] = append(imgMap[items[0]], items[1])
-			}
+// 签名载荷中的摘要可以是镜像 ID 或 RepoDigests 中的 manifest 摘要
+func verifyImage(policy *imagePolicy, img *dockerImage) (string, error) {
+	if policy.keyErr != nil {
+		return "", policy.keyErr
+	}
+	digests := []string{img.Id}
+	for _, v := range img.RepoDigests {
+		if i := strings.LastIndex(v, "@"); i >= 0 {
+			digests = append(digests, v[i+1:])
 		}
 	}
+	return policy.verifier.VerifyDigests(digests)
+}
+
+// 供 imgupdate 等在 docker load 之前调用
+func verifyArchive(policy *imagePolicy, fn string) (string, error) {
+	if policy.keyErr != nil {
+		return "", policy.keyErr
+	}
+	return policy.verifier.VerifyArchive(fn)
+}
 
-	for k, v := range imgMap {
-		//log.Println(k, ",", v)
-		if len(v) > 1 {
-			for _, img := range v {
-				cmd = exec.Command("/bin/bash", "-c", "docker ps -a | grep "+img+" | awk '{print $1}'")
-				out, err = cmd.CombinedOutput()
+func checkImage(policy *imagePolicy) error {
+	var images []dockerImage
+	err := gDocker.Call("GET", "/images/json", nil, &images)
+	if err != nil {
+		return err
+	}
+	var containers []dockerContainer
+	err = gDocker.Call("GET", "/containers/json?all=1", nil, &containers)
+	if err != nil {
+		return err
+	}
+
+	decisions := decideImages(policy, images, containers, time.Now())
+	removed := 0
+	for k, v := range decisions {
+		if v.Action == "quarantine" {
+			if policy.DryRun {
+				decisions[k].Action = "dryrun"
+				decisions[k].Reason = "quarantine, " + v.Reason
+			} else {
+				err = quarantineImage(v.Image)
 				if err != nil {
-					//log.Println("checkImage 0x0004: ", err)
-					cmd = exec.Command("/bin/bash", "-c", "docker rmi "+img)
-					out, err = cmd.CombinedOutput()
-					if err != nil {
-						log.Println("checkImage 0x0005: ", err)
-					} else {
-						log.Println("remove image ", img)
-					}
-					continue
+					decisions[k].Action = "error"
+					decisions[k].Reason += ", " + err.Error()
 				}
-
-				containers := string(out)
-				log.Println(containers)
-				removeImage(containers, img)
 			}
-		} else {
-			cmd = exec.Command("/bin/bash", "-c", "docker ps -a | grep "+k+" | awk '{print $1}'")
-			out, err = cmd.CombinedOutput()
-			if err != nil {
-				//log.Println("checkImage 0x0009: ", err)
-				cmd = exec.Command("/bin/bash", "-c", "docker rmi "+k)
-				out, err = cmd.CombinedOutput()
+		}
+		if v.Action == "remove" {
+			if policy.DryRun {
+				decisions[k].Action = "dryrun"
+			} else {
+				// 有 tag 的按 tag 删除，只有最后一个 tag 被删除时镜像才会真正删除
+				name := v.Image
+				if name == noneTag {
+					name = v.ID
+				}
+				err = gDocker.Call("DELETE", "/images/"+name, nil, nil)
 				if err != nil {
-					log.Println("checkImage 0x0007: ", err)
+					decisions[k].Action = "error"
+					decisions[k].Reason += ", " + err.Error()
 				} else {
-					log.Println("remove image ", v)
+					removed++
 				}
-				continue
 			}
-
-			containers := string(out)
-			log.Println(containers)
-			removeImage(containers, k)
 		}
+		writeReport(policy, &decisions[k])
 	}
+
+	log.Printf("checkImage: images=%d, decisions=%d, removed=%d, dryrun=%v\n", len(images), len(decisions), removed, policy.DryRun)
 	return nil
 }
 
-func removeImage(containers, img string) error {
-	cmd := exec.Command("/bin/bash", "-c", "docker stop "+containers)
-	out, err := cmd.CombinedOutput()
-	_ = out
+// 隔离为 quarantine/<repo>:<tag> 后删除原 tag，原名称不能再被使用，需要时可以人工恢复
+func quarantineImage(name string) error {
+	repo := dockerapi.ImageRepo(name)
+	tag := strings.TrimPrefix(name, repo)
+	tag = strings.TrimPrefix(tag, ":")
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+	// 仓库地址中的端口不能出现在仓库名中
+	query := url.Values{"repo": {defQuarantineRepo + "/" + strings.Replace(repo, ":", "_", -1)}, "tag": {tag}}
+	err := gDocker.Call("POST", "/images/"+name+"/tag?"+query.Encode(), nil, nil)
 	if err != nil {
-		//log.Println("checkImage 0x0010: ", err)
+		return err
+	}
+	return gDocker.Call("DELETE", "/images/"+name, nil, nil)
+}
+
+// 判断顺序：allow、使用中、已隔离、deny、minage、signedonly、keeplast，都不满足时保留
+func decideImages(policy *imagePolicy, images []dockerImage, containers []dockerContainer, now time.Time) []imageDecision {
+	inUse := make(map[string][]string)
+	for _, v := range containers {
+		inUse[v.ImageID] = append(inUse[v.ImageID], strings.TrimPrefix(strings.Join(v.Names, ","), "/"))
+	}
+
+	// 每个仓库的 tag 按镜像创建时间从新到旧排序，用于 keeplast
+	created := make(map[string]int64)
+	repos := make(map[string][]string)
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag != noneTag {
+				created[tag] = img.Created
+				repos[dockerapi.ImageRepo(tag)] = append(repos[dockerapi.ImageRepo(tag)], tag)
+			}
+		}
+	}
+	rank := make(map[string]int)
+	for _, lst := range repos {
+		sort.SliceStable(lst, func(i, j int) bool {
+			return created[lst[i]] > created[lst[j]]
+		})
+		for i, tag := range lst {
+			rank[tag] = i
+		}
 	}
-	cmd = exec.Command("/bin/bash", "-c", "docker rm "+containers)
-	out, err = cmd.CombinedOutput()
-	_ = out
+
+	var decisions []imageDecision
+	for i := range images {
+		img := &images[i]
+		tags := img.RepoTags
+		if len(tags) == 0 {
+			tags = []string{noneTag}
+		}
+		age := now.Sub(time.Unix(img.Created, 0))
+		var key string
+		var verifyErr error
+		if policy.SignedOnly {
+			key, verifyErr = verifyImage(policy, img)
+		}
+		for _, tag := range tags {
+			d := imageDecision{Time: now.Unix(), Image: tag, ID: img.Id, Action: "keep"}
+			if p := matchPattern(policy.Allow, tag); len(p) > 0 && tag != noneTag {
+				d.Reason = "allow " + p
+			} else if names, ok := inUse[img.Id]; ok {
+				d.Reason = "in use by " + strings.Join(names, ",")
+			} else if strings.HasPrefix(tag, defQuarantineRepo+"/") {
+				d.Reason = "quarantined"
+			} else if p := matchPattern(policy.Deny, tag); len(p) > 0 && tag != noneTag {
+				d.Action, d.Reason = "remove", "deny "+p
+			} else if age < policy.minAge {
+				d.Reason = fmt.Sprintf("age %s < minage %s", age.Truncate(time.Second).String(), policy.minAge.String())
+			} else if tag == noneTag {
+				if policy.Dangling {
+					d.Action, d.Reason = "remove", "dangling"
+				} else {
+					d.Reason = "dangling, not enabled"
+				}
+			} else if policy.SignedOnly && verifyErr != nil {
+				d.Reason = "unverified: " + verifyErr.Error()
+				if policy.Unverified != "keep" {
+					d.Action = policy.Unverified
+				}
+			} else if n := rank[tag]; policy.KeepLast > 0 && n >= policy.KeepLast {
+				d.Action, d.Reason = "remove", fmt.Sprintf("keeplast %d, rank %d", policy.KeepLast, n+1)
+			} else if len(key) > 0 {
+				d.Reason = "verified by " + key
+			} else {
+				d.Reason = "policy"
+			}
+			decisions = append(decisions, d)
+		}
+	}
+	return decisions
+}
+
+// 报告按 JSON 行追加，超过 defReportFileSize 时轮转为 .1
+func writeReport(policy *imagePolicy, d *imageDecision) {
+	log.Printf("image %s(%s): %s, %s\n", d.Image, dockerapi.ShortID(d.ID), d.Action, d.Reason)
+	data, err := json.Marshal(d)
 	if err != nil {
-		//log.Println("checkImage 0x0011: ", err)
+		return
+	}
+	if fi, err := os.Stat(policy.Report); err == nil && fi.Size() > defReportFileSize {
+		os.Rename(policy.Report, policy.Report+".1")
 	}
-	cmd = exec.Command("/bin/bash", "-c", "docker rmi "+img)
-	out, err = cmd.CombinedOutput()
-	_ = out
+	fd, err := os.OpenFile(policy.Report, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		log.Println("checkImage 0x0012: ", err)
-	} else {
-		log.Println("remove image ", img)
+		log.Println("writeReport 0x0001: ", err)
+		return
 	}
-	return nil
+	defer fd.Close()
+	fd.Write(append(data, '\n'))
 }
@@ -0,0 +1,158 @@
+package dockerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefSock string = "/var/run/docker.sock"
+
+// Docker Engine API 客户端，通过 unix socket 访问，路径不带版本号时使用服务端默认版本
+type Client struct {
+	http   *http.Client
+	stream *http.Client
+}
+
+// docker load、docker build 返回的 JSON 消息流
+type StreamMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux struct {
+		ID string `json:"ID"`
+	} `json:"aux"`
+}
+
+// timeout 为 0 时不设超时，Stream 耗时不确定，始终不设超时
+func NewClient(sock string, timeout time.Duration) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}
+	return &Client{
+		http:   &http.Client{Timeout: timeout, Transport: transport},
+		stream: &http.Client{Transport: transport},
+	}
+}
+
+// 发送请求并读取响应，非 2xx 时返回服务端的错误消息
+func (c *Client) Do(method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://docker"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rsp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return nil, Error(method, path, rsp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// body 不为 nil 时以 JSON 发送，响应以 JSON 解析到 v
+func (c *Client) Call(method, path string, body, v interface{}) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	data, err := c.Do(method, path, contentType, reader)
+	if err != nil {
+		return err
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 逐条处理 load、build 的 JSON 消息，消息中的 error 作为失败返回
+func (c *Client) Stream(path, contentType string, body io.Reader, fn func(*StreamMessage)) error {
+	req, err := http.NewRequest("POST", "http://docker"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	rsp, err := c.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return Error("POST", path, rsp.StatusCode, data)
+	}
+	dec := json.NewDecoder(rsp.Body)
+	for {
+		msg := StreamMessage{}
+		err = dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(msg.Error) > 0 {
+			return errors.New(strings.TrimSpace(msg.Error))
+		}
+		fn(&msg)
+	}
+}
+
+// 错误响应为 {"message": "..."}，不是 JSON 时使用原始内容
+func Error(method, path string, code int, data []byte) error {
+	msg := struct{ Message string }{}
+	json.Unmarshal(data, &msg)
+	if len(msg.Message) == 0 {
+		msg.Message = strings.TrimSpace(string(data))
+	}
+	return fmt.Errorf("%s %s: %d %s", method, path, code, msg.Message)
+}
+
+// repo:tag 中取 repo，注意仓库地址中可能带端口
+func ImageRepo(name string) string {
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return name
+	}
+	return name[:i]
+}
+
+// 镜像和容器 ID 去掉 sha256: 前缀后取前 12 位
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
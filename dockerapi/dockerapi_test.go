@@ -0,0 +1,136 @@
+package dockerapi
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在临时目录的 unix socket 上启动测试服务
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	dir, err := ioutil.TempDir("", "dockerapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	})
+	return NewClient(sock, 5*time.Second)
+}
+
+func TestCall(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte(`{"Version":"19.03.8","ApiVersion":"1.40"}`))
+		case "/containers/create":
+			data, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != "application/json" || false == strings.Contains(string(data), `"Image":"a:1"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"c1"}`))
+		case "/containers/c1/start":
+			w.WriteHeader(http.StatusNoContent)
+		case "/images/missing/json":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image: missing"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("server error\n"))
+		}
+	})
+
+	ver := struct{ Version, ApiVersion string }{}
+	if err := c.Call("GET", "/version", nil, &ver); err != nil || ver.Version != "19.03.8" || ver.ApiVersion != "1.40" {
+		t.Fatalf("version: %+v, %v", ver, err)
+	}
+	created := struct{ Id string }{}
+	if err := c.Call("POST", "/containers/create", map[string]string{"Image": "a:1"}, &created); err != nil || created.Id != "c1" {
+		t.Fatalf("create: %+v, %v", created, err)
+	}
+	if err := c.Call("POST", "/containers/c1/start", nil, &created); err != nil {
+		t.Fatal("start: ", err)
+	}
+
+	err := c.Call("GET", "/images/missing/json", nil, nil)
+	if err == nil || err.Error() != "GET /images/missing/json: 404 No such image: missing" {
+		t.Fatal("missing: ", err)
+	}
+	err = c.Call("GET", "/other", nil, nil)
+	if err == nil || err.Error() != "GET /other: 500 server error" {
+		t.Fatal("other: ", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/load":
+			w.Write([]byte(`{"stream":"Loaded image: a:1\n"}` + "\n" + `{"stream":"Loaded image ID: sha256:01\n"}`))
+		case "/build":
+			w.Write([]byte(`{"stream":"Step 1/2\n"}{"error":"no such file\n","errorDetail":{"message":"no such file"}}{"stream":"Step 2/2\n"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"bad request"}`))
+		}
+	})
+
+	var lines []string
+	fn := func(msg *StreamMessage) {
+		lines = append(lines, strings.TrimSpace(msg.Stream))
+	}
+	err := c.Stream("/images/load", "application/x-tar", strings.NewReader("tar"), fn)
+	if err != nil || strings.Join(lines, ",") != "Loaded image: a:1,Loaded image ID: sha256:01" {
+		t.Fatalf("load: %q, %v", lines, err)
+	}
+
+	lines = nil
+	err = c.Stream("/build", "application/x-tar", strings.NewReader("tar"), fn)
+	if err == nil || err.Error() != "no such file" || len(lines) != 1 {
+		t.Fatalf("build: %q, %v", lines, err)
+	}
+	err = c.Stream("/other", "application/x-tar", nil, fn)
+	if err == nil || err.Error() != "POST /other: 400 bad request" {
+		t.Fatal("other: ", err)
+	}
+}
+
+func TestImageRepo(t *testing.T) {
+	cases := map[string]string{
+		"basic_img-arm:1.0":             "basic_img-arm",
+		"basic_img-arm":                 "basic_img-arm",
+		"registry:5000/app":             "registry:5000/app",
+		"registry:5000/app:2.1":         "registry:5000/app",
+		"registry:5000/team/app:latest": "registry:5000/team/app",
+	}
+	for name, repo := range cases {
+		if v := ImageRepo(name); v != repo {
+			t.Errorf("%s: got %s, want %s", name, v, repo)
+		}
+	}
+}
+
+func TestShortID(t *testing.T) {
+	if v := ShortID("sha256:0123456789abcdef0123"); v != "0123456789ab" {
+		t.Fatal(v)
+	}
+	if v := ShortID("abc"); v != "abc" {
+		t.Fatal(v)
+	}
+}
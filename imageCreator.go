@@ -1,28 +1,89 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"appsign"
+	"github.com/ghodss/yaml"
+	"imgverify"
 )
 
 var dockerfile = `FROM mxpan/alpine-arm:1.0
 `
+
+const defAppsExtFolder string = "/usr/local/extapps"
+const defMonitorCfg string = "/usr/local/monitor/monitor.cfg"
+const defAppCfgFile string = "app.cfg"
+const defAppSignFile string = "sign.cfg"
+const defAppVersionFile string = "version.cfg"
+const defHookPreInstall string = "preinstall"
+const defHookPostInstall string = "postinstall"
+const defCPUThreshold int = 90
+const defMemThreshold int = 90
+const defCPULimit int = 90
+const defMemLimit int = 90
+const defDiskThreshold int = 512
+
 var cmdArgDesr = `
 Usage imageCreator [OPTIONS]
 Options:
    -t: docker image 'name:tag' format (default [])
    -f: file absoulte path
+   -base: base image, OCI layout directory/tar or 'docker save' tar, build without docker daemon
+   -spec: image spec yaml, build without docker daemon, -t/-o/-format override the spec
+   -app: appSignTool package(name.tar), verify sign and pre-install to /usr/local/extapps,
+         enable it in /usr/local/monitor/monitor.cfg, multiple groups, need -base or -spec
+   -o: output file or directory when -base/-spec is set (default name_tag.tar)
+   -format: output format when -base/-spec is set, docker ('docker load' tar) or oci,
+            multi-arch spec only support oci (default docker)
+
+Image spec yaml:
+   tag: mxpan/app:1.0
+   base: /images/alpine-arm.tar          # default base image
+   bases:                                # base image per arch
+     arm64: /images/alpine-arm64.tar
+     amd64: /images/alpine-amd64.tar
+   archs: [arm, arm64, amd64]            # arm, arm64, amd64
+   files:
+     - src: bin/app                      # relative to spec file
+       srcs: {arm64: bin/app-arm64, amd64: bin/app-amd64}
+       dst: /home/app
+       mode: 0755
+     - src: conf
+       dst: /home/conf
+   env: [APP_HOME=/home]
+   workdir: /home
+   user: "0:0"
+   labels: {version: "1.0"}
+   expose: [8080, 53/udp]
+   entrypoint: [/home/app]
+   cmd: [-c, /home/conf/app.cfg]
+   apps: [pkg/hello.tar]                 # appctl app packages
+   monitorcfg: /usr/local/monitor/monitor.cfg
+   output: app.tar
+   format: oci
  `
 
 func checkFileIsExist(filename string) bool {
@@ -142,21 +203,1277 @@ func genDockerfile(filePath string, progName string) (err error) {
 	return err
 }
 
+const ociLayoutFile string = "oci-layout"
+const ociIndexFile string = "index.json"
+const dockerManifestFile string = "manifest.json"
+
+const (
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// docker save 生成的 manifest.json 条目
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// 镜像描述文件，相对路径以描述文件所在目录为准；archs 为空时按基础镜像本身的架构生成单个镜像
+type imageSpec struct {
+	Tag        string            `json:"tag"`
+	Base       string            `json:"base"`
+	Bases      map[string]string `json:"bases,omitempty"`
+	Archs      []string          `json:"archs,omitempty"`
+	Files      []specFile        `json:"files"`
+	Env        []string          `json:"env,omitempty"`
+	WorkDir    string            `json:"workdir,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Expose     []specPort        `json:"expose,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	Format     string            `json:"format,omitempty"`
+	Apps       []string          `json:"apps,omitempty"`
+	MonitorCfg string            `json:"monitorcfg,omitempty"`
+}
+
+type StringArray []string
+
+func (s *StringArray) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *StringArray) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// app.cfg 中预装需要的字段
+type appPkgCfg struct {
+	BinName       string            `json:"binname"`
+	Hooks         map[string]string `json:"hooks,omitempty"`
+	CPUThreshold  int               `json:"cputhreshold,omitempty"`
+	MemThreshold  int               `json:"memthreshold,omitempty"`
+	DiskThreshold int               `json:"diskthreshold,omitempty"`
+	CPULimit      int               `json:"cpulimit,omitempty"`
+	MemLimit      int               `json:"memlimit,omitempty"`
+}
+
+type appPkgFile struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// 与 appctl-daemon 安装一致：应用名取包文件名，包内文件都在 <应用名>/ 下
+type appPackage struct {
+	name    string
+	pkg     string
+	cfg     appPkgCfg
+	files   []appPkgFile
+	version string
+	hash    string
+}
+
+// 逐层写入 tar，上级目录只写一次
+type layerWriter struct {
+	buf  bytes.Buffer
+	tw   *tar.Writer
+	dirs map[string]bool
+}
+
+// srcs 按架构指定源文件，没有对应架构时用 src；mode 为 0 时沿用源文件权限
+type specFile struct {
+	Src  string            `json:"src"`
+	Srcs map[string]string `json:"srcs,omitempty"`
+	Dst  string            `json:"dst"`
+	Mode fileMode          `json:"mode,omitempty"`
+}
+
+// yaml 中 0755 转为 JSON 后是十进制数字，加引号的 "0755" 按八进制解析
+type fileMode int64
+
+func (m *fileMode) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	base := 10
+	if strings.HasPrefix(str, `"`) {
+		str = strings.Trim(str, `"`)
+		base = 8
+	}
+	v, err := strconv.ParseInt(str, base, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %s", string(data))
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+// 端口可以写成 8080 或 "53/udp"
+type specPort string
+
+func (p *specPort) UnmarshalJSON(data []byte) error {
+	*p = specPort(strings.Trim(string(data), `"`))
+	return nil
+}
+
+var gArchPlatforms = map[string]ociPlatform{
+	"arm":   {Architecture: "arm", OS: "linux", Variant: "v7"},
+	"arm64": {Architecture: "arm64", OS: "linux", Variant: "v8"},
+	"amd64": {Architecture: "amd64", OS: "linux"},
+}
+
+// data 为原样保存的层内容，可能是 gzip 压缩的；diffID 为解压后 tar 的 sha256
+type imageLayer struct {
+	data   []byte
+	digest string
+	diffID string
+}
+
+// config 按 map 解析，保留基础镜像中未识别的字段
+type imageData struct {
+	config map[string]interface{}
+	layers []imageLayer
+}
+
+// 基础镜像可以是 OCI layout 目录、OCI layout tar 或 docker save 生成的 tar，arch 不为空时按架构选择并校验
+func loadBaseImage(base, arch string) (*imageData, error) {
+	fi, err := os.Stat(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var read func(name string) ([]byte, error)
+	if fi.IsDir() {
+		read = func(name string) ([]byte, error) {
+			return ioutil.ReadFile(filepath.Join(base, name))
+		}
+	} else {
+		files, err := readTarFiles(base)
+		if err != nil {
+			return nil, err
+		}
+		read = func(name string) ([]byte, error) {
+			data, ok := files[path.Clean(name)]
+			if !ok {
+				return nil, fmt.Errorf("%s not found in %s", name, base)
+			}
+			return data, nil
+		}
+	}
+
+	var img *imageData
+	if _, err = read(dockerManifestFile); err == nil {
+		img, err = loadDockerImage(read)
+	} else if _, err = read(ociIndexFile); err == nil {
+		img, err = loadOCIImage(read, arch)
+	} else {
+		return nil, fmt.Errorf("%s is not an OCI layout or docker save tar", base)
+	}
+	if err != nil || arch == "" {
+		return img, err
+	}
+
+	// 基础镜像未标明架构时按 arch 补齐
+	p := gArchPlatforms[arch]
+	if v, _ := img.config["architecture"].(string); len(v) > 0 && v != p.Architecture {
+		return nil, fmt.Errorf("base image %s is %s, not %s", base, v, arch)
+	}
+	img.config["architecture"] = p.Architecture
+	if v, _ := img.config["os"].(string); len(v) == 0 {
+		img.config["os"] = p.OS
+	}
+	if v, _ := img.config["variant"].(string); len(v) == 0 && len(p.Variant) > 0 {
+		img.config["variant"] = p.Variant
+	}
+	return img, nil
+}
+
+func readTarFiles(fn string) (map[string][]byte, error) {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(fl)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(hdr.Name)] = data
+	}
+	return files, nil
+}
+
+func loadDockerImage(read func(string) ([]byte, error)) (*imageData, error) {
+	data, _ := read(dockerManifestFile)
+	var lst []dockerManifest
+	err := json.Unmarshal(data, &lst)
+	if err != nil {
+		return nil, err
+	}
+	if len(lst) == 0 {
+		return nil, errors.New("manifest.json is empty")
+	}
+
+	img := &imageData{}
+	data, err = read(lst[0].Config)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &img.config)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range lst[0].Layers {
+		data, err = read(v)
+		if err != nil {
+			return nil, err
+		}
+		layer := imageLayer{data: data, digest: sha256Digest(data)}
+		layer.diffID, err = getDiffID(data)
+		if err != nil {
+			return nil, err
+		}
+		img.layers = append(img.layers, layer)
+	}
+	return img, nil
+}
+
+func loadOCIImage(read func(string) ([]byte, error), arch string) (*imageData, error) {
+	data, _ := read(ociIndexFile)
+	var idx ociIndex
+	err := json.Unmarshal(data, &idx)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := selectManifest(idx.Manifests, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多架构镜像为嵌套的 index，逐层按架构选择
+	for desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerList {
+		data, err = readBlob(read, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		idx = ociIndex{}
+		err = json.Unmarshal(data, &idx)
+		if err != nil {
+			return nil, err
+		}
+		desc, err = selectManifest(idx.Manifests, arch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err = readBlob(read, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var mf ociManifest
+	err = json.Unmarshal(data, &mf)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &imageData{}
+	data, err = readBlob(read, mf.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &img.config)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range mf.Layers {
+		data, err = readBlob(read, v.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layer := imageLayer{data: data, digest: v.Digest}
+		layer.diffID, err = getDiffID(data)
+		if err != nil {
+			return nil, err
+		}
+		img.layers = append(img.layers, layer)
+	}
+	return img, nil
+}
+
+// arch 为空时取第一个，没有 platform 的条目视为匹配
+func selectManifest(lst []ociDescriptor, arch string) (ociDescriptor, error) {
+	if len(lst) == 0 {
+		return ociDescriptor{}, errors.New("index has no manifest")
+	}
+	if arch == "" {
+		return lst[0], nil
+	}
+	for _, v := range lst {
+		if v.Platform == nil || v.Platform.Architecture == arch {
+			return v, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no %s manifest in index", arch)
+}
+
+// blob 的路径和内容校验见 imgverify.ReadBlob
+func readBlob(read func(string) ([]byte, error), digest string) ([]byte, error) {
+	data, err := imgverify.ReadBlob(func(name string) []byte {
+		data, _ := read(name)
+		return data
+	}, digest)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %s", digest, err.Error())
+	}
+	return data, nil
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func isGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func getLayerTar(data []byte) ([]byte, error) {
+	if !isGzip(data) {
+		return data, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+func getDiffID(data []byte) (string, error) {
+	if !isGzip(data) {
+		return sha256Digest(data), nil
+	}
+	tarData, err := getLayerTar(data)
+	if err != nil {
+		return "", err
+	}
+	return sha256Digest(tarData), nil
+}
+
+// 所有文件放在一个新层中，目标路径的上级目录自动创建，目录按文件名顺序递归加入，
+// 属主统一为 root，时间取源文件的修改时间，相同输入生成相同的层
+func addFilesLayer(img *imageData, files []specFile, arch string) error {
+	lw := newLayerWriter()
+	var history []string
+	for _, v := range files {
+		src := v.Src
+		if s, ok := v.Srcs[arch]; ok {
+			src = s
+		}
+		if src == "" {
+			return fmt.Errorf("file %s has no source for %s", v.Dst, arch)
+		}
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		dst := strings.TrimPrefix(path.Clean(v.Dst), "/")
+		if strings.HasSuffix(v.Dst, "/") && !fi.IsDir() {
+			dst = path.Join(dst, filepath.Base(src))
+		}
+		history = append(history, src+" /"+dst)
+
+		err = lw.addDir(path.Dir(dst))
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(src, func(fn string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(src, fn)
+			name := path.Join(dst, filepath.ToSlash(rel))
+			if info.IsDir() {
+				if lw.dirs[name] {
+					return nil
+				}
+				lw.dirs[name] = true
+			}
+			return addTarEntry(lw.tw, fn, name, info, v.Mode)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return lw.finish(img, "COPY "+strings.Join(history, ", "))
+}
+
+func newLayerWriter() *layerWriter {
+	lw := &layerWriter{dirs: make(map[string]bool)}
+	lw.tw = tar.NewWriter(&lw.buf)
+	return lw
+}
+
+func (lw *layerWriter) addDir(name string) error {
+	if name == "." || name == "/" || name == "" || lw.dirs[name] {
+		return nil
+	}
+	err := lw.addDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	lw.dirs[name] = true
+	return lw.tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(0, 0)})
+}
+
+func (lw *layerWriter) addFile(name string, mode int64, mtime time.Time, data []byte) error {
+	err := lw.addDir(path.Dir(name))
+	if err == nil {
+		err = lw.tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(data)), ModTime: mtime})
+	}
+	if err == nil {
+		_, err = lw.tw.Write(data)
+	}
+	return err
+}
+
+// 压缩后追加到镜像，同时更新 rootfs.diff_ids 和 history
+func (lw *layerWriter) finish(img *imageData, createdBy string) error {
+	err := lw.tw.Close()
+	if err != nil {
+		return err
+	}
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(lw.buf.Bytes())
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	layer := imageLayer{data: gzBuf.Bytes(), digest: sha256Digest(gzBuf.Bytes()), diffID: sha256Digest(lw.buf.Bytes())}
+	img.layers = append(img.layers, layer)
+
+	rootfs, _ := img.config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, layer.diffID)
+	img.config["rootfs"] = rootfs
+	addHistory(img, createdBy, false)
+	return nil
+}
+
+func getPackageAppName(pkg string) string {
+	appName := strings.TrimSuffix(pkg, ".gz")
+	appName = strings.TrimSuffix(appName, ".tgz")
+	appName = strings.TrimSuffix(appName, ".tar")
+	return appName
+}
+
+// 包可以是 gzip 压缩或未压缩的 tar，只接受 <应用名>/ 下的相对路径
+func loadAppPackage(fn string) (*appPackage, error) {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+
+	pkg := &appPackage{pkg: filepath.Base(fn)}
+	pkg.name = getPackageAppName(pkg.pkg)
+	var r io.Reader = bufio.NewReader(fl)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err.Error())
+		}
+		name := path.Clean(hdr.Name)
+		if !isPackagePath(name, pkg.name) {
+			return nil, fmt.Errorf("%s: %s not in %s/", fn, hdr.Name, pkg.name)
+		}
+		// 软链接只能指向包内
+		if hdr.Typeflag == tar.TypeLink || (hdr.Typeflag == tar.TypeSymlink && !isPackagePath(path.Join(path.Dir(name), hdr.Linkname), pkg.name)) {
+			return nil, fmt.Errorf("%s: unsupported link %s", fn, hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Name = name
+		pkg.files = append(pkg.files, appPkgFile{hdr: hdr, data: data})
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			files[name] = data
+		}
+	}
+
+	err = json.Unmarshal(files[pkg.name+"/"+defAppCfgFile], &pkg.cfg)
+	if err != nil || len(pkg.cfg.BinName) == 0 {
+		return nil, fmt.Errorf("%s: invalid %s", fn, defAppCfgFile)
+	}
+	bin, ok := files[pkg.name+"/bin/"+pkg.cfg.BinName]
+	if !ok {
+		return nil, fmt.Errorf("%s: bin/%s not found", fn, pkg.cfg.BinName)
+	}
+	sum := md5.Sum(bin)
+	pkg.hash = hex.EncodeToString(sum[:])
+	pkg.version = strings.TrimSpace(string(files[pkg.name+"/"+defAppVersionFile]))
+
+	read := func(script string) ([]byte, error) {
+		content, ok := files[path.Join(pkg.name, script)]
+		if !ok {
+			return nil, fmt.Errorf("hook script %s not in package", script)
+		}
+		return content, nil
+	}
+	_, err = appsign.VerifyPackage(sum[:], files[pkg.name+"/"+defAppCfgFile], pkg.cfg.Hooks, read, files[pkg.name+"/"+defAppSignFile])
+	if err != nil {
+		return nil, fmt.Errorf("%s: verify sign failed: %s", fn, err.Error())
+	}
+	return pkg, nil
+}
+
+func isPackagePath(name, appName string) bool {
+	name = path.Clean(name)
+	return name == appName || strings.HasPrefix(name, appName+"/")
+}
+
+// 应用预装到 /usr/local/extapps，并在基础镜像的 monitor.cfg 中启用，容器启动后由 appctl-daemon 直接拉起，
+// preinstall/postinstall 钩子在拉起前执行
+func addAppsLayer(img *imageData, pkgs []*appPackage, monitorCfg string) error {
+	lw := newLayerWriter()
+	extDir := strings.TrimPrefix(defAppsExtFolder, "/")
+	err := lw.addDir(extDir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, pkg := range pkgs {
+		for _, v := range pkg.files {
+			hdr := *v.hdr
+			hdr.Name = path.Join(extDir, hdr.Name)
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+			if hdr.Typeflag == tar.TypeDir {
+				if lw.dirs[hdr.Name] {
+					continue
+				}
+				lw.dirs[hdr.Name] = true
+				hdr.Name += "/"
+			} else {
+				err = lw.addDir(path.Dir(hdr.Name))
+				if err != nil {
+					return err
+				}
+			}
+			err = lw.tw.WriteHeader(&hdr)
+			if err == nil {
+				_, err = lw.tw.Write(v.data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		names = append(names, pkg.name)
+	}
+
+	name := strings.TrimPrefix(path.Clean(monitorCfg), "/")
+	data, err := seedMonitorCfg(findImageFile(img, name), pkgs)
+	if err != nil {
+		return err
+	}
+	err = lw.addFile(name, 0644, time.Unix(0, 0), data)
+	if err != nil {
+		return err
+	}
+	return lw.finish(img, "INSTALL "+strings.Join(names, ", "))
+}
+
+// 按层顺序查找镜像中的文件，后面的层覆盖前面的，whiteout 表示已删除
+func findImageFile(img *imageData, name string) []byte {
+	var data []byte
+	whiteout := path.Join(path.Dir(name), ".wh."+path.Base(name))
+	for _, v := range img.layers {
+		layer, err := getLayerTar(v.data)
+		if err != nil {
+			continue
+		}
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			switch path.Clean(hdr.Name) {
+			case name:
+				data, _ = ioutil.ReadAll(tr)
+			case whiteout:
+				data = nil
+			}
+		}
+	}
+	return data
+}
+
+// 保留 monitor.cfg 中已有的配置和其它应用，同名应用替换为启用状态
+func seedMonitorCfg(content []byte, pkgs []*appPackage) ([]byte, error) {
+	lst := make(map[string]interface{})
+	if len(content) > 0 {
+		err := json.Unmarshal(content, &lst)
+		if err != nil {
+			return nil, fmt.Errorf("base image monitor.cfg: %s", err.Error())
+		}
+	}
+	if _, ok := lst["cputhreshold"]; !ok {
+		lst["cputhreshold"] = defCPUThreshold
+		lst["memthreshold"] = defMemThreshold
+		lst["diskthreshold"] = defDiskThreshold
+	}
+	diskThreshold := defDiskThreshold
+	if v, ok := lst["diskthreshold"].(float64); ok && v > 0 {
+		diskThreshold = int(v)
+	}
+
+	old, _ := lst["items"].([]interface{})
+	items := []interface{}{}
+	for _, v := range old {
+		item, _ := v.(map[string]interface{})
+		name, _ := item["name"].(string)
+		if getAppPackage(pkgs, name) == nil {
+			items = append(items, v)
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, pkg := range pkgs {
+		item := map[string]interface{}{
+			"pid":           0,
+			"name":          pkg.name,
+			"path":          path.Join(defAppsExtFolder, pkg.name, "bin", pkg.cfg.BinName),
+			"cmd":           1,
+			"status":        1,
+			"enable":        1,
+			"starttime":     0,
+			"logstarttime":  now,
+			"logendtime":    now,
+			"cputhreshold":  getCfgValue(pkg.cfg.CPUThreshold, defCPUThreshold),
+			"memthreshold":  getCfgValue(pkg.cfg.MemThreshold, defMemThreshold),
+			"cpulimit":      getCfgValue(pkg.cfg.CPULimit, defCPULimit),
+			"memlimit":      getCfgValue(pkg.cfg.MemLimit, defMemLimit),
+			"cpurate":       0,
+			"memrate":       0,
+			"diskthreshold": getCfgValue(pkg.cfg.DiskThreshold, diskThreshold),
+			"diskusage":     0,
+			"version":       pkg.version,
+			"hash":          pkg.hash,
+			"package":       pkg.pkg,
+			"url":           "",
+			"param":         "",
+			"logfile":       "",
+		}
+		// 预装时没有执行安装钩子，由 appctl-daemon 首次加载时执行
+		var hooks []string
+		for _, hook := range []string{defHookPreInstall, defHookPostInstall} {
+			if len(pkg.cfg.Hooks[hook]) > 0 {
+				hooks = append(hooks, hook)
+			}
+		}
+		if len(hooks) > 0 {
+			item["pendinghooks"] = hooks
+		}
+		items = append(items, item)
+	}
+	lst["items"] = items
+	return json.Marshal(lst)
+}
+
+func getAppPackage(pkgs []*appPackage, name string) *appPackage {
+	for _, v := range pkgs {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func getCfgValue(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// mode 只作用于普通文件，目录和符号链接保留原属性
+func addTarEntry(tw *tar.Writer, fn, name string, info os.FileInfo, mode fileMode) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(fn)
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	hdr.ModTime = info.ModTime().UTC().Truncate(time.Second)
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if info.Mode().IsRegular() && mode != 0 {
+		hdr.Mode = int64(mode)
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	fl, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+	_, err = io.Copy(tw, fl)
+	return err
+}
+
+// 与 Dockerfile 一致：设置 ENTRYPOINT 而未设置 CMD 时清空基础镜像的 Cmd；env 同名的覆盖
+func applyImageConfig(img *imageData, spec *imageSpec) {
+	if len(spec.Env) == 0 && len(spec.WorkDir) == 0 && len(spec.User) == 0 && len(spec.Labels) == 0 &&
+		len(spec.Expose) == 0 && len(spec.Entrypoint) == 0 && len(spec.Cmd) == 0 {
+		return
+	}
+	cfg, _ := img.config["config"].(map[string]interface{})
+	if cfg == nil {
+		cfg = make(map[string]interface{})
+	}
+
+	if len(spec.Env) > 0 {
+		var env []interface{}
+		old, _ := cfg["Env"].([]interface{})
+		for _, v := range old {
+			str, _ := v.(string)
+			key := strings.SplitN(str, "=", 2)[0]
+			if !containsEnvKey(spec.Env, key) {
+				env = append(env, str)
+			}
+		}
+		for _, v := range spec.Env {
+			env = append(env, v)
+		}
+		cfg["Env"] = env
+	}
+	if len(spec.WorkDir) > 0 {
+		cfg["WorkingDir"] = spec.WorkDir
+	}
+	if len(spec.User) > 0 {
+		cfg["User"] = spec.User
+	}
+	if len(spec.Labels) > 0 {
+		labels, _ := cfg["Labels"].(map[string]interface{})
+		if labels == nil {
+			labels = make(map[string]interface{})
+		}
+		for k, v := range spec.Labels {
+			labels[k] = v
+		}
+		cfg["Labels"] = labels
+	}
+	if len(spec.Expose) > 0 {
+		ports, _ := cfg["ExposedPorts"].(map[string]interface{})
+		if ports == nil {
+			ports = make(map[string]interface{})
+		}
+		for _, v := range spec.Expose {
+			port := string(v)
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			ports[port] = struct{}{}
+		}
+		cfg["ExposedPorts"] = ports
+	}
+	if len(spec.Entrypoint) > 0 {
+		cfg["Entrypoint"] = spec.Entrypoint
+		delete(cfg, "Cmd")
+	}
+	if len(spec.Cmd) > 0 {
+		cfg["Cmd"] = spec.Cmd
+	}
+	img.config["config"] = cfg
+
+	var desc []string
+	if len(spec.Entrypoint) > 0 {
+		desc = append(desc, "ENTRYPOINT "+toJSONString(spec.Entrypoint))
+	}
+	if len(spec.Cmd) > 0 {
+		desc = append(desc, "CMD "+toJSONString(spec.Cmd))
+	}
+	if len(desc) == 0 {
+		desc = append(desc, "CONFIG")
+	}
+	addHistory(img, strings.Join(desc, " "), true)
+}
+
+func containsEnvKey(env []string, key string) bool {
+	for _, v := range env {
+		if strings.SplitN(v, "=", 2)[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+func toJSONString(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func addHistory(img *imageData, createdBy string, empty bool) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	item := map[string]interface{}{"created": now, "created_by": createdBy}
+	if empty {
+		item["empty_layer"] = true
+	}
+	history, _ := img.config["history"].([]interface{})
+	img.config["history"] = append(history, item)
+	img.config["created"] = now
+}
+
+// 输出 docker load 可以直接导入的 tar，层统一为未压缩的 layer.tar
+func writeDockerArchive(img *imageData, imgTag, out string) error {
+	config, err := json.Marshal(img.config)
+	if err != nil {
+		return err
+	}
+	configName := strings.TrimPrefix(sha256Digest(config), "sha256:") + ".json"
+
+	return writeTarOutput(out, func(write func(string, []byte) error) error {
+		mf := dockerManifest{Config: configName, RepoTags: []string{imgTag}}
+		for _, v := range img.layers {
+			data, err := getLayerTar(v.data)
+			if err != nil {
+				return err
+			}
+			name := strings.TrimPrefix(v.diffID, "sha256:") + "/layer.tar"
+			err = write(name, data)
+			if err != nil {
+				return err
+			}
+			mf.Layers = append(mf.Layers, name)
+		}
+		err := write(configName, config)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal([]dockerManifest{mf})
+		return write(dockerManifestFile, data)
+	})
+}
+
+// out 以 .tar 结尾时输出 OCI layout 的 tar，否则输出到目录；多个镜像时 index.json 指向多架构 index
+func writeOCILayout(imgs []*imageData, imgTag, out string) error {
+	build := func(write func(string, []byte) error) error {
+		writeBlob := func(mediaType string, data []byte) (ociDescriptor, error) {
+			desc := ociDescriptor{MediaType: mediaType, Digest: sha256Digest(data), Size: int64(len(data))}
+			err := write(path.Join("blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:")), data)
+			return desc, err
+		}
+
+		writeImage := func(img *imageData) (ociDescriptor, error) {
+			config, err := json.Marshal(img.config)
+			if err != nil {
+				return ociDescriptor{}, err
+			}
+			mf := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+			mf.Config, err = writeBlob(mediaTypeOCIConfig, config)
+			if err != nil {
+				return ociDescriptor{}, err
+			}
+			for _, v := range img.layers {
+				mediaType := mediaTypeOCILayer
+				if isGzip(v.data) {
+					mediaType = mediaTypeOCILayerGz
+				}
+				desc, err := writeBlob(mediaType, v.data)
+				if err != nil {
+					return ociDescriptor{}, err
+				}
+				mf.Layers = append(mf.Layers, desc)
+			}
+
+			data, _ := json.Marshal(&mf)
+			desc, err := writeBlob(mediaTypeOCIManifest, data)
+			if err != nil {
+				return ociDescriptor{}, err
+			}
+			osName, _ := img.config["os"].(string)
+			arch, _ := img.config["architecture"].(string)
+			variant, _ := img.config["variant"].(string)
+			if len(osName) > 0 && len(arch) > 0 {
+				desc.Platform = &ociPlatform{Architecture: arch, OS: osName, Variant: variant}
+			}
+			return desc, nil
+		}
+
+		var descs []ociDescriptor
+		for _, v := range imgs {
+			desc, err := writeImage(v)
+			if err != nil {
+				return err
+			}
+			descs = append(descs, desc)
+		}
+		desc := descs[0]
+		if len(descs) > 1 {
+			data, _ := json.Marshal(&ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: descs})
+			var err error
+			desc, err = writeBlob(mediaTypeOCIIndex, data)
+			if err != nil {
+				return err
+			}
+		}
+		desc.Annotations = map[string]string{"org.opencontainers.image.ref.name": getImageTag(imgTag)}
+
+		err := write(ociLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`))
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(&ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{desc}})
+		return write(ociIndexFile, data)
+	}
+
+	if strings.HasSuffix(out, ".tar") {
+		return writeTarOutput(out, build)
+	}
+	return build(func(name string, data []byte) error {
+		fn := filepath.Join(out, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fn), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(fn, data, 0644)
+	})
+}
+
+func writeTarOutput(out string, build func(write func(string, []byte) error) error) error {
+	fd, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	tw := tar.NewWriter(fd)
+	// 相同内容的层只写一次
+	written := make(map[string]bool)
+	mtime := time.Now()
+	err = build(func(name string, data []byte) error {
+		if written[name] {
+			return nil
+		}
+		written[name] = true
+		err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: mtime})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+// name:tag 中取 tag，没有时为 latest；注意仓库地址中可能带端口
+func getImageTag(imgTag string) string {
+	i := strings.LastIndex(imgTag, ":")
+	if i < 0 || strings.Contains(imgTag[i:], "/") {
+		return "latest"
+	}
+	return imgTag[i+1:]
+}
+
+func loadImageSpec(fn string) (*imageSpec, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	spec := &imageSpec{}
+	err = json.Unmarshal(data, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(fn)
+	abs := func(p string) string {
+		if len(p) == 0 || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	spec.Base = abs(spec.Base)
+	spec.Output = abs(spec.Output)
+	for i, v := range spec.Apps {
+		spec.Apps[i] = abs(v)
+	}
+	for k, v := range spec.Bases {
+		spec.Bases[k] = abs(v)
+	}
+	for i := range spec.Files {
+		spec.Files[i].Src = abs(spec.Files[i].Src)
+		for k, v := range spec.Files[i].Srcs {
+			spec.Files[i].Srcs[k] = abs(v)
+		}
+	}
+	return spec, nil
+}
+
+// archs 未配置时取 bases 中的架构，都没有时按基础镜像本身的架构生成单个镜像
+func checkImageSpec(spec *imageSpec) error {
+	if len(spec.Tag) == 0 {
+		return errors.New("image tag is empty")
+	}
+	if len(spec.Archs) == 0 {
+		for k := range spec.Bases {
+			spec.Archs = append(spec.Archs, k)
+		}
+		sort.Strings(spec.Archs)
+	}
+	if len(spec.Archs) == 0 {
+		spec.Archs = []string{""}
+	}
+	for _, v := range spec.Archs {
+		if _, ok := gArchPlatforms[v]; !ok && v != "" {
+			return fmt.Errorf("unsupported arch %s", v)
+		}
+		if len(spec.Base) == 0 && len(spec.Bases[v]) == 0 {
+			return fmt.Errorf("no base image for %s", v)
+		}
+	}
+	for _, v := range spec.Files {
+		if !path.IsAbs(v.Dst) {
+			return fmt.Errorf("file dst %s is not absolute", v.Dst)
+		}
+	}
+	if len(spec.Files) == 0 && len(spec.Apps) == 0 {
+		return errors.New("no files or apps")
+	}
+	if len(spec.MonitorCfg) == 0 {
+		spec.MonitorCfg = defMonitorCfg
+	}
+
+	if len(spec.Format) == 0 {
+		spec.Format = "docker"
+		if len(spec.Archs) > 1 {
+			spec.Format = "oci"
+		}
+	}
+	if spec.Format != "docker" && spec.Format != "oci" {
+		return fmt.Errorf("unsupported format %s", spec.Format)
+	}
+	if spec.Format == "docker" && len(spec.Archs) > 1 {
+		return errors.New("multi-arch image only support oci format")
+	}
+	if len(spec.Output) == 0 {
+		spec.Output = strings.NewReplacer("/", "_", ":", "_").Replace(spec.Tag) + ".tar"
+	}
+	return nil
+}
+
+func buildNativeImage(spec *imageSpec) error {
+	// 应用包先全部校验签名，任一失败都不生成镜像
+	var pkgs []*appPackage
+	for _, v := range spec.Apps {
+		pkg, err := loadAppPackage(v)
+		if err != nil {
+			return err
+		}
+		if getAppPackage(pkgs, pkg.name) != nil {
+			return fmt.Errorf("app %s duplicated", pkg.name)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	var imgs []*imageData
+	for _, arch := range spec.Archs {
+		base := spec.Base
+		if v, ok := spec.Bases[arch]; ok {
+			base = v
+		}
+		img, err := loadBaseImage(base, arch)
+		if err != nil {
+			return err
+		}
+		if len(spec.Files) > 0 {
+			err = addFilesLayer(img, spec.Files, arch)
+			if err != nil {
+				return err
+			}
+		}
+		if len(pkgs) > 0 {
+			err = addAppsLayer(img, pkgs, spec.MonitorCfg)
+			if err != nil {
+				return err
+			}
+		}
+		applyImageConfig(img, spec)
+		imgs = append(imgs, img)
+	}
+
+	if spec.Format == "oci" {
+		return writeOCILayout(imgs, spec.Tag, spec.Output)
+	}
+	return writeDockerArchive(imgs[0], spec.Tag, spec.Output)
+}
+
+func buildSpecImage(spec *imageSpec) {
+	err := checkImageSpec(spec)
+	if err == nil {
+		err = buildNativeImage(spec)
+	}
+	if err != nil {
+		fmt.Println("image build error: ", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("image build finish: ", spec.Output)
+}
+
 func main() {
 	imgTag := flag.String("t", "", "docker image 'name:tag' format (default [])")
 	progPath := flag.String("f", "", "file absoule path")
+	base := flag.String("base", "", "base image, OCI layout or docker save tar")
+	specPath := flag.String("spec", "", "image spec yaml")
+	outPath := flag.String("o", "", "output file or directory")
+	format := flag.String("format", "", "output format, docker or oci")
+	apps := StringArray{}
+	flag.Var(&apps, "app", "appSignTool package")
 	flag.Parse()
 	//fmt.Println(*imgTag, *progPath)
-	if *imgTag == "" || *progPath == "" {
+	if *specPath != "" {
+		spec, err := loadImageSpec(*specPath)
+		if err != nil {
+			fmt.Println("load image spec error: ", err.Error())
+			os.Exit(1)
+		}
+		if *imgTag != "" {
+			spec.Tag = *imgTag
+		}
+		if *outPath != "" {
+			spec.Output = *outPath
+		}
+		if *format != "" {
+			spec.Format = *format
+		}
+		spec.Apps = append(spec.Apps, apps...)
+		buildSpecImage(spec)
+		return
+	}
+
+	if *imgTag == "" || (*progPath == "" && len(apps) == 0) {
 		fmt.Println(cmdArgDesr)
 		return
 	}
 
+	// 只预装应用包时不需要 -f
+	if len(apps) > 0 && *progPath == "" {
+		buildSpecImage(&imageSpec{Tag: *imgTag, Base: *base, Apps: apps, Output: *outPath, Format: *format})
+		return
+	}
+
 	if !checkFileIsExist(*progPath) {
 		fmt.Println("file %s not exist, please check")
 		return
 	}
 
+	// 指定基础镜像时直接生成镜像文件，不依赖 docker 服务
+	if *base != "" || len(apps) > 0 {
+		progName := path.Base(*progPath)
+		spec := &imageSpec{
+			Tag:        *imgTag,
+			Base:       *base,
+			Files:      []specFile{{Src: *progPath, Dst: "/home/" + progName, Mode: 0755}},
+			Entrypoint: []string{"/home/" + progName},
+			Output:     *outPath,
+			Format:     *format,
+			Apps:       apps,
+		}
+		buildSpecImage(spec)
+		return
+	}
+
 	progName := path.Base(*progPath)
 	//fmt.Println(progName)
 	cmd := exec.Command("docker", "info")
@@ -0,0 +1,389 @@
+package main
+
+// go test -vet=off imageCreator.go imageCreator_test.go
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBaseFile string = "etc/base.txt"
+
+func makeLayerTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for k, v := range files {
+		err := tw.WriteHeader(&tar.Header{Name: k, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(v)), ModTime: time.Unix(0, 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(v))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testBaseConfig(diffID, arch string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"architecture": arch,
+		"os":           "linux",
+		"config":       map[string]interface{}{"Env": []string{"PATH=/bin"}, "Cmd": []string{"/bin/sh"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+	})
+	return data
+}
+
+func writeTestFile(t *testing.T, fn string, data []byte) {
+	err := os.MkdirAll(filepath.Dir(fn), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(fn, data, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 单层 gzip 压缩的 OCI layout 目录，返回层的 digest
+func writeTestOCIBase(t *testing.T, dir string) string {
+	return writeTestArchBase(t, dir, "amd64")
+}
+
+func writeTestArchBase(t *testing.T, dir, arch string) string {
+	layerTar := makeLayerTar(t, map[string]string{testBaseFile: "base " + arch})
+	layer := gzipData(t, layerTar)
+	config := testBaseConfig(sha256Digest(layerTar), arch)
+
+	writeBlob := func(mediaType string, data []byte) ociDescriptor {
+		desc := ociDescriptor{MediaType: mediaType, Digest: sha256Digest(data), Size: int64(len(data))}
+		writeTestFile(t, filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:")), data)
+		return desc
+	}
+	mf := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	mf.Config = writeBlob(mediaTypeOCIConfig, config)
+	mf.Layers = []ociDescriptor{writeBlob(mediaTypeOCILayerGz, layer)}
+	data, _ := json.Marshal(&mf)
+	desc := writeBlob(mediaTypeOCIManifest, data)
+	desc.Platform = &ociPlatform{Architecture: arch, OS: "linux"}
+
+	data, _ = json.Marshal(&ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{desc}})
+	writeTestFile(t, filepath.Join(dir, ociIndexFile), data)
+	writeTestFile(t, filepath.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	return sha256Digest(layer)
+}
+
+// docker save 格式的 tar，层为未压缩的 layer.tar
+func writeTestDockerBase(t *testing.T, fn string) string {
+	layer := makeLayerTar(t, map[string]string{testBaseFile: "base"})
+	diffID := sha256Digest(layer)
+	layerName := strings.TrimPrefix(diffID, "sha256:") + "/layer.tar"
+	mf, _ := json.Marshal([]dockerManifest{{Config: "config.json", RepoTags: []string{"base:1.0"}, Layers: []string{layerName}}})
+
+	err := writeTarOutput(fn, func(write func(string, []byte) error) error {
+		err := write(layerName, layer)
+		if err == nil {
+			err = write("config.json", testBaseConfig(diffID, "amd64"))
+		}
+		if err == nil {
+			err = write(dockerManifestFile, mf)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diffID
+}
+
+func buildTestImage(t *testing.T, base, format, out string) *imageData {
+	dir := filepath.Dir(out)
+	src := filepath.Join(dir, "run.sh")
+	writeTestFile(t, src, []byte("#!/bin/sh\nexec sleep 1\n"))
+
+	spec := &imageSpec{
+		Tag:        "test/app:1.0",
+		Base:       base,
+		Archs:      []string{"amd64"},
+		Files:      []specFile{{Src: src, Dst: "/app/", Mode: 0755}},
+		Entrypoint: []string{"/app/run.sh"},
+		Format:     format,
+		Output:     out,
+	}
+	err := checkImageSpec(spec)
+	if err == nil {
+		err = buildNativeImage(spec)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := loadBaseImage(out, "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// 重新加载生成的镜像：层 digest、diff_ids 与层内容一致，基础层不变，新层包含文件，Entrypoint 覆盖 Cmd
+func checkTestImage(t *testing.T, img *imageData, baseLayer string) {
+	if len(img.layers) != 2 {
+		t.Fatalf("layers %d, want 2", len(img.layers))
+	}
+	rootfs, _ := img.config["rootfs"].(map[string]interface{})
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	if len(diffIDs) != len(img.layers) {
+		t.Fatalf("diff_ids %v", diffIDs)
+	}
+	for k, v := range img.layers {
+		if v.digest != sha256Digest(v.data) {
+			t.Errorf("layer %d digest %s mismatch", k, v.digest)
+		}
+		tarData, err := getLayerTar(v.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diffIDs[k] != sha256Digest(tarData) || v.diffID != diffIDs[k] {
+			t.Errorf("layer %d diff_id %v, layer %s", k, diffIDs[k], v.diffID)
+		}
+	}
+	if img.layers[0].digest != baseLayer {
+		t.Errorf("base layer %s, want %s", img.layers[0].digest, baseLayer)
+	}
+
+	tarData, _ := getLayerTar(img.layers[1].data)
+	tr := tar.NewReader(bytes.NewReader(tarData))
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Clean(hdr.Name) == "app/run.sh" {
+			found = hdr.Mode == 0755
+		}
+	}
+	if !found {
+		t.Error("app/run.sh not in layer or mode not 0755")
+	}
+
+	cfg, _ := img.config["config"].(map[string]interface{})
+	if toJSONString(cfg["Entrypoint"]) != `["/app/run.sh"]` || cfg["Cmd"] != nil {
+		t.Errorf("Entrypoint %v, Cmd %v", cfg["Entrypoint"], cfg["Cmd"])
+	}
+	if toJSONString(cfg["Env"]) != `["PATH=/bin"]` || img.config["architecture"] != "amd64" {
+		t.Errorf("base config lost: %v", img.config)
+	}
+}
+
+func TestBuildFromOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageCreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base")
+	baseLayer := writeTestOCIBase(t, base)
+	img := buildTestImage(t, base, "oci", filepath.Join(dir, "out.tar"))
+	checkTestImage(t, img, baseLayer)
+}
+
+func TestBuildFromDockerSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageCreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.tar")
+	baseLayer := writeTestDockerBase(t, base)
+	img := buildTestImage(t, base, "docker", filepath.Join(dir, "out.tar"))
+	checkTestImage(t, img, baseLayer)
+}
+
+// 基础镜像中被篡改的层在加载时报错
+func TestLoadBaseTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageCreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseLayer := writeTestOCIBase(t, dir)
+	fn := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(baseLayer, "sha256:"))
+	writeTestFile(t, fn, gzipData(t, makeLayerTar(t, map[string]string{testBaseFile: "evil"})))
+	if _, err = loadBaseImage(dir, "amd64"); err == nil {
+		t.Fatal("tampered base image loaded")
+	}
+}
+
+// 在层中查找文件，返回 tar 头和内容
+func readLayerFile(t *testing.T, layer []byte, name string) (*tar.Header, string) {
+	tarData, err := getLayerTar(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(tarData))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Clean(hdr.Name) == name {
+			data, _ := ioutil.ReadAll(tr)
+			return hdr, string(data)
+		}
+	}
+}
+
+const testMultiArchSpec string = `
+tag: test/multi:1.0
+bases:
+  amd64: base-amd64
+  arm: base-arm
+files:
+  - srcs:
+      amd64: bin/amd64/run
+      arm: bin/arm/run
+    dst: /app/
+    mode: 0755
+entrypoint: ["/app/run"]
+output: out
+`
+
+// yaml 描述文件按架构选择基础镜像和源文件，输出多架构 OCI index
+func TestBuildMultiArchSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageCreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archs := []string{"amd64", "arm"}
+	for _, arch := range archs {
+		writeTestArchBase(t, filepath.Join(dir, "base-"+arch), arch)
+		writeTestFile(t, filepath.Join(dir, "bin", arch, "run"), []byte("run "+arch))
+	}
+	writeTestFile(t, filepath.Join(dir, "image.yaml"), []byte(testMultiArchSpec))
+
+	spec, err := loadImageSpec(filepath.Join(dir, "image.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Files[0].Mode != 0755 || spec.Files[0].Srcs["arm"] != filepath.Join(dir, "bin", "arm", "run") {
+		t.Fatalf("spec files %+v", spec.Files)
+	}
+	err = checkImageSpec(spec)
+	if err == nil {
+		err = buildNativeImage(spec)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Format != "oci" || toJSONString(spec.Archs) != `["amd64","arm"]` {
+		t.Fatalf("format %s, archs %v", spec.Format, spec.Archs)
+	}
+
+	// 顶层 index.json 指向多架构 index
+	out := filepath.Join(dir, "out")
+	data, _ := ioutil.ReadFile(filepath.Join(out, ociIndexFile))
+	var idx ociIndex
+	json.Unmarshal(data, &idx)
+	if len(idx.Manifests) != 1 || idx.Manifests[0].MediaType != mediaTypeOCIIndex {
+		t.Fatalf("index.json %s", data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(out, "blobs", "sha256", strings.TrimPrefix(idx.Manifests[0].Digest, "sha256:")))
+	idx = ociIndex{}
+	json.Unmarshal(data, &idx)
+	if len(idx.Manifests) != 2 {
+		t.Fatalf("multi-arch index %s", data)
+	}
+	for k, v := range idx.Manifests {
+		if v.Platform == nil || v.Platform.Architecture != archs[k] || v.Platform.OS != "linux" {
+			t.Errorf("manifest %d platform %+v", k, v.Platform)
+		}
+	}
+
+	for _, arch := range archs {
+		img, err := loadBaseImage(out, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.config["architecture"] != arch || len(img.layers) != 2 {
+			t.Fatalf("%s image arch %v, layers %d", arch, img.config["architecture"], len(img.layers))
+		}
+		if _, base := readLayerFile(t, img.layers[0].data, testBaseFile); base != "base "+arch {
+			t.Errorf("%s base layer %q", arch, base)
+		}
+		hdr, content := readLayerFile(t, img.layers[1].data, "app/run")
+		if hdr == nil || hdr.Mode != 0755 || content != "run "+arch {
+			t.Errorf("%s app/run %v %q", arch, hdr, content)
+		}
+	}
+}
+
+// 基础镜像的架构与 bases 中的 key 不一致，或某个架构没有源文件时报错
+func TestBuildMultiArchMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageCreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestArchBase(t, filepath.Join(dir, "base-amd64"), "amd64")
+	writeTestDockerBase(t, filepath.Join(dir, "base-arm.tar"))
+	src := filepath.Join(dir, "run")
+	writeTestFile(t, src, []byte("run"))
+
+	spec := &imageSpec{
+		Tag:    "test/multi:1.0",
+		Bases:  map[string]string{"amd64": filepath.Join(dir, "base-amd64"), "arm": filepath.Join(dir, "base-arm.tar")},
+		Files:  []specFile{{Src: src, Dst: "/app/"}},
+		Output: filepath.Join(dir, "out"),
+	}
+	err = checkImageSpec(spec)
+	if err == nil {
+		err = buildNativeImage(spec)
+	}
+	if err == nil || !strings.Contains(err.Error(), "is amd64, not arm") {
+		t.Errorf("arch mismatch err=%v", err)
+	}
+
+	spec.Bases["arm"] = spec.Bases["amd64"]
+	spec.Files = []specFile{{Srcs: map[string]string{"amd64": src}, Dst: "/app/"}}
+	if err = buildNativeImage(spec); err == nil || !strings.Contains(err.Error(), "no arm manifest") {
+		t.Errorf("arm from amd64 index err=%v", err)
+	}
+	spec.Archs = []string{"amd64"}
+	spec.Format = "docker"
+	spec.Files[0].Srcs = map[string]string{"arm": src}
+	if err = buildNativeImage(spec); err == nil || !strings.Contains(err.Error(), "no source for amd64") {
+		t.Errorf("missing source err=%v", err)
+	}
+}
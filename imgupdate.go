@@ -0,0 +1,556 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dockerapi"
+	"imgverify"
+)
+
+const help string = `
+imgupdate version1.0.0, command parameter:
+
+imgupdate [options] update /path/basic_img-arm.tar
+imgupdate [options] build /path/dockerfile-folder
+imgupdate [options] rollback
+-image: image name, default basic_img-arm:1.0
+-sock: docker unix socket, default /var/run/docker.sock
+-keydir: trusted public keys for image signature, default /usr/local/monitor/imagekeys
+-sigdir: image signatures, default /usr/local/monitor/imagesigs
+-noverify: do not verify image archive signature before load
+-smoke: smoke test command run in the new image, default "appctl -version container"
+-timeout: smoke test timeout, default 30s
+
+update: verify and load the image archive under a temporary tag, smoke test it,
+        then swap tags, recreate containers with their old run options and keep
+        the previous image as <image>-rollback
+build: build the folder(Dockerfile, appctl, appctl-daemon...) under a temporary tag, then as update
+rollback: swap the image and <image>-rollback, recreate containers
+`
+
+const defImageName string = "basic_img-arm:1.0"
+const defSmokeCmd string = "appctl -version container"
+const defSmokeName string = "imgupdate-smoke"
+const defUpdateSuffix string = "-update"
+const defRollbackSuffix string = "-rollback"
+const defSmokeTimeout time.Duration = 30 * time.Second
+const defStopTimeout int = 10
+const defAPITimeout time.Duration = 60 * time.Second
+
+// Docker Engine API /images/{name}/json 中用到的字段
+type dockerImage struct {
+	Id       string
+	RepoTags []string
+}
+
+type dockerContainer struct {
+	Id      string
+	Names   []string
+	Image   string
+	ImageID string
+	State   string
+}
+
+// Config、HostConfig 原样保存，重建容器时只替换镜像
+type containerInspect struct {
+	Id     string
+	Name   string
+	Image  string
+	Config map[string]interface{}
+	State  struct {
+		Running bool
+	}
+	HostConfig      map[string]interface{}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAMConfig interface{}
+			Links      []string
+			Aliases    []string
+		}
+	}
+}
+
+type updateOptions struct {
+	image    string
+	keyDir   string
+	sigDir   string
+	noVerify bool
+	smoke    string
+	timeout  time.Duration
+}
+
+var gDocker *dockerapi.Client
+
+func main() {
+	opt := updateOptions{}
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagSet.StringVar(&opt.image, "image", defImageName, "image name")
+	sock := flagSet.String("sock", dockerapi.DefSock, "docker unix socket")
+	flagSet.StringVar(&opt.keyDir, "keydir", imgverify.DefKeyDir, "trusted public keys")
+	flagSet.StringVar(&opt.sigDir, "sigdir", imgverify.DefSigDir, "image signatures")
+	flagSet.BoolVar(&opt.noVerify, "noverify", false, "do not verify image signature")
+	flagSet.StringVar(&opt.smoke, "smoke", defSmokeCmd, "smoke test command")
+	flagSet.DurationVar(&opt.timeout, "timeout", defSmokeTimeout, "smoke test timeout")
+	err := flagSet.Parse(os.Args[1:])
+	if err != nil || flagSet.NArg() == 0 {
+		fmt.Print(help)
+		os.Exit(1)
+	}
+	gDocker = dockerapi.NewClient(*sock, defAPITimeout)
+	if false == strings.Contains(opt.image, ":") {
+		opt.image += ":latest"
+	}
+
+	args := flagSet.Args()
+	switch args[0] {
+	case "update":
+		if len(args) != 2 {
+			fmt.Print(help)
+			os.Exit(1)
+		}
+		err = updateImage(&opt, args[1])
+	case "build":
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		err = buildImage(&opt, dir)
+	case "rollback":
+		err = rollbackImage(&opt)
+	default:
+		// 兼容 updimg.sh 的用法：imgupdate /path/image.tar
+		if len(args) == 1 && strings.HasSuffix(args[0], ".tar") {
+			err = updateImage(&opt, args[0])
+			break
+		}
+		fmt.Print(help)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println("imgupdate failed: ", err)
+		os.Exit(1)
+	}
+}
+
+func updateImage(opt *updateOptions, fn string) error {
+	// 一次只更新一个镜像，多个镜像的文件在 docker load 之前拒绝，避免导入未更新的镜像
+	images, err := imgverify.ArchiveImages(fn)
+	if err != nil {
+		return err
+	}
+	if len(images) > 1 {
+		return fmt.Errorf("%s contains %d images, only one image is allowed", fn, len(images))
+	}
+	if false == opt.noVerify {
+		v, err := imgverify.NewVerifier(opt.keyDir, opt.sigDir)
+		if err != nil {
+			return fmt.Errorf("verify: %s", err.Error())
+		}
+		key, err := v.VerifyArchive(fn)
+		if err != nil {
+			return fmt.Errorf("verify %s: %s", fn, err.Error())
+		}
+		fmt.Println("verify ok, key: ", key)
+	}
+
+	oldID := getImageID(opt.image)
+	fl, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	fmt.Println("load image: ", fn)
+	var loaded []string
+	err = gDocker.Stream("/images/load?quiet=1", "application/x-tar", fl, func(msg *dockerapi.StreamMessage) {
+		line := strings.TrimSpace(msg.Stream)
+		if strings.HasPrefix(line, "Loaded image ID: ") {
+			loaded = append(loaded, strings.TrimPrefix(line, "Loaded image ID: "))
+		} else if strings.HasPrefix(line, "Loaded image: ") {
+			loaded = append(loaded, strings.TrimPrefix(line, "Loaded image: "))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	newID := ""
+	for _, v := range loaded {
+		id := getImageID(v)
+		if len(id) == 0 || id == newID {
+			continue
+		}
+		if len(newID) > 0 {
+			return fmt.Errorf("%s contains more than one image", fn)
+		}
+		newID = id
+	}
+	if len(newID) == 0 {
+		return fmt.Errorf("%s: no image loaded", fn)
+	}
+
+	// docker load 会直接把同名标签移到新镜像，验证通过前先恢复
+	err = tagImage(newID, opt.image+defUpdateSuffix)
+	if err != nil {
+		return err
+	}
+	if getImageID(opt.image) == newID && newID != oldID {
+		if len(oldID) > 0 {
+			err = tagImage(oldID, opt.image)
+		} else {
+			err = untagImage(opt.image)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return installImage(opt, newID)
+}
+
+// 替代 docker-build.sh
+func buildImage(opt *updateOptions, dir string) error {
+	for _, v := range []string{"appctl", "appctl-daemon"} {
+		fn := filepath.Join(dir, v)
+		if _, err := os.Stat(fn); err == nil {
+			os.Chmod(fn, 0755)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBuildContext(pw, dir))
+	}()
+	defer pr.Close()
+
+	fmt.Println("build image: ", dir)
+	query := url.Values{"t": {opt.image + defUpdateSuffix}, "rm": {"1"}}
+	err := gDocker.Stream("/build?"+query.Encode(), "application/x-tar", pr, func(msg *dockerapi.StreamMessage) {
+		fmt.Print(msg.Stream)
+	})
+	if err != nil {
+		return err
+	}
+
+	newID := getImageID(opt.image + defUpdateSuffix)
+	if len(newID) == 0 {
+		return errors.New("build: no image built")
+	}
+	return installImage(opt, newID)
+}
+
+// 新镜像已经打上 -update 临时标签：冒烟测试通过后切换标签并重建容器，失败时删除临时标签
+func installImage(opt *updateOptions, newID string) error {
+	tmpTag := opt.image + defUpdateSuffix
+	oldID := getImageID(opt.image)
+	if newID == oldID {
+		untagImage(tmpTag)
+		fmt.Println("image not changed: ", opt.image, dockerapi.ShortID(newID))
+		return nil
+	}
+
+	version, err := smokeTest(opt, tmpTag)
+	if err != nil {
+		untagImage(tmpTag)
+		return fmt.Errorf("smoke test: %s", err.Error())
+	}
+	fmt.Println("smoke test ok, version: ", version)
+
+	prevID := getImageID(opt.image + defRollbackSuffix)
+	err = swapImage(opt.image, newID, oldID)
+	if err != nil {
+		return err
+	}
+	untagImage(tmpTag)
+
+	// 上上个版本已经没有标签，不再使用时删除
+	if len(prevID) > 0 && prevID != oldID && prevID != newID {
+		err = gDocker.Call("DELETE", "/images/"+prevID, nil, nil)
+		if err != nil {
+			log.Println("installImage 0x0001: ", err)
+		}
+	}
+
+	fmt.Println("update ok, image: ", opt.image, dockerapi.ShortID(newID), ", version: ", version)
+	return nil
+}
+
+func rollbackImage(opt *updateOptions) error {
+	prevID := getImageID(opt.image + defRollbackSuffix)
+	if len(prevID) == 0 {
+		return fmt.Errorf("no rollback image %s", opt.image+defRollbackSuffix)
+	}
+	curID := getImageID(opt.image)
+
+	err := swapImage(opt.image, prevID, curID)
+	if err != nil {
+		return err
+	}
+	fmt.Println("rollback ok, image: ", opt.image, dockerapi.ShortID(prevID))
+	return nil
+}
+
+// image 指向 newID，oldID 保留为 -rollback，使用 oldID 的容器用原参数重建；
+// 重建失败时恢复标签和旧容器，已经重建的容器再用旧镜像重建回去
+func swapImage(image, newID, oldID string) error {
+	var containers []dockerContainer
+	err := gDocker.Call("GET", "/containers/json?all=1", nil, &containers)
+	if err != nil {
+		return err
+	}
+
+	err = tagImage(newID, image)
+	if err != nil {
+		return err
+	}
+	if len(oldID) == 0 {
+		return nil
+	}
+	err = tagImage(oldID, image+defRollbackSuffix)
+	if err != nil {
+		return err
+	}
+
+	var recreated []string
+	for _, c := range containers {
+		if c.ImageID != oldID || isSmokeContainer(c.Names) {
+			continue
+		}
+		id, err := recreateContainer(c.Id, image)
+		if err != nil {
+			tagImage(oldID, image)
+			tagImage(newID, image+defRollbackSuffix)
+			for _, v := range recreated {
+				_, rerr := recreateContainer(v, image)
+				if rerr != nil {
+					log.Println("swapImage 0x0001: ", rerr)
+				}
+			}
+			return err
+		}
+		recreated = append(recreated, id)
+	}
+	return nil
+}
+
+func isSmokeContainer(names []string) bool {
+	for _, v := range names {
+		if strings.TrimPrefix(v, "/") == defSmokeName {
+			return true
+		}
+	}
+	return false
+}
+
+// 旧容器停止并改名，新容器创建启动成功后再删除旧容器，返回新容器 ID
+func recreateContainer(id, image string) (string, error) {
+	info := containerInspect{}
+	err := gDocker.Call("GET", "/containers/"+id+"/json", nil, &info)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+	fmt.Println("recreate container: ", name)
+
+	body := info.Config
+	if body == nil {
+		body = make(map[string]interface{})
+	}
+	body["Image"] = image
+	// 未指定 hostname 时为容器 ID 前缀，新容器使用自己的 ID
+	if hostname, _ := body["Hostname"].(string); len(hostname) > 0 && strings.HasPrefix(info.Id, hostname) {
+		delete(body, "Hostname")
+	}
+	body["HostConfig"] = info.HostConfig
+	endpoints := make(map[string]interface{})
+	for k, v := range info.NetworkSettings.Networks {
+		endpoints[k] = map[string]interface{}{"IPAMConfig": v.IPAMConfig, "Links": v.Links, "Aliases": v.Aliases}
+	}
+	body["NetworkingConfig"] = map[string]interface{}{"EndpointsConfig": endpoints}
+
+	backup := name + "-imgupdate-old"
+	if info.State.Running {
+		err = gDocker.Call("POST", fmt.Sprintf("/containers/%s/stop?t=%d", id, defStopTimeout), nil, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = gDocker.Call("POST", "/containers/"+id+"/rename?name="+url.QueryEscape(backup), nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	created := struct{ Id string }{}
+	err = gDocker.Call("POST", "/containers/create?name="+url.QueryEscape(name), body, &created)
+	if err == nil && info.State.Running {
+		err = gDocker.Call("POST", "/containers/"+created.Id+"/start", nil, nil)
+	}
+	if err != nil {
+		if len(created.Id) > 0 {
+			gDocker.Call("DELETE", "/containers/"+created.Id+"?force=1", nil, nil)
+		}
+		gDocker.Call("POST", "/containers/"+id+"/rename?name="+url.QueryEscape(name), nil, nil)
+		if info.State.Running {
+			gDocker.Call("POST", "/containers/"+id+"/start", nil, nil)
+		}
+		return "", fmt.Errorf("recreate container %s: %s", name, err.Error())
+	}
+
+	err = gDocker.Call("DELETE", "/containers/"+id, nil, nil)
+	if err != nil {
+		log.Println("recreateContainer 0x0001: ", err)
+	}
+	return created.Id, nil
+}
+
+// 与 updimg.sh 相同：后台运行镜像，在容器中执行 appctl -version container，
+// appctl-daemon 启动需要时间，超时前重试
+func smokeTest(opt *updateOptions, image string) (string, error) {
+	gDocker.Call("DELETE", "/containers/"+defSmokeName+"?force=1", nil, nil)
+
+	created := struct{ Id string }{}
+	body := map[string]interface{}{"Image": image, "Tty": true, "OpenStdin": true}
+	err := gDocker.Call("POST", "/containers/create?name="+defSmokeName, body, &created)
+	if err != nil {
+		return "", err
+	}
+	defer gDocker.Call("DELETE", "/containers/"+created.Id+"?force=1", nil, nil)
+
+	err = gDocker.Call("POST", "/containers/"+created.Id+"/start", nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(opt.timeout)
+	for {
+		out, err := execContainer(created.Id, strings.Fields(opt.smoke))
+		if err == nil && len(out) > 0 {
+			return out, nil
+		}
+		if err == nil {
+			err = errors.New("no output")
+		}
+		info := containerInspect{}
+		if gDocker.Call("GET", "/containers/"+created.Id+"/json", nil, &info) == nil && false == info.State.Running {
+			return "", errors.New("container exited")
+		}
+		if time.Now().After(deadline) {
+			return "", err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func execContainer(id string, cmd []string) (string, error) {
+	created := struct{ Id string }{}
+	body := map[string]interface{}{"AttachStdout": true, "AttachStderr": true, "Tty": true, "Cmd": cmd}
+	err := gDocker.Call("POST", "/containers/"+id+"/exec", body, &created)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := gDocker.Do("POST", "/exec/"+created.Id+"/start", "application/json", strings.NewReader(`{"Detach":false,"Tty":true}`))
+	if err != nil {
+		return "", fmt.Errorf("exec %s: %s", strings.Join(cmd, " "), err.Error())
+	}
+	out := strings.TrimSpace(string(data))
+
+	state := struct {
+		ExitCode int
+	}{}
+	err = gDocker.Call("GET", "/exec/"+created.Id+"/json", nil, &state)
+	if err != nil {
+		return "", err
+	}
+	if state.ExitCode != 0 {
+		return "", fmt.Errorf("exec %s: exit %d %s", strings.Join(cmd, " "), state.ExitCode, out)
+	}
+	return out, nil
+}
+
+func getImageID(name string) string {
+	img := dockerImage{}
+	if gDocker.Call("GET", "/images/"+name+"/json", nil, &img) != nil {
+		return ""
+	}
+	return img.Id
+}
+
+func tagImage(id, name string) error {
+	query := url.Values{"repo": {dockerapi.ImageRepo(name)}, "tag": {name[len(dockerapi.ImageRepo(name))+1:]}}
+	return gDocker.Call("POST", "/images/"+id+"/tag?"+query.Encode(), nil, nil)
+}
+
+// 只删除标签，镜像还有其它标签或被容器使用时保留
+func untagImage(name string) error {
+	return gDocker.Call("DELETE", "/images/"+name+"?noprune=1", nil, nil)
+}
+
+// docker build 上下文：目录打包为 tar，按 .dockerignore 的文件名跳过
+func writeBuildContext(w io.Writer, dir string) error {
+	ignore := make(map[string]bool)
+	if data, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore")); err == nil {
+		for _, v := range strings.Split(string(data), "\n") {
+			v = strings.TrimSpace(v)
+			if len(v) > 0 && false == strings.HasPrefix(v, "#") && v != "Dockerfile" {
+				ignore[filepath.Clean(v)] = true
+			}
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, fn)
+		if err != nil || name == "." {
+			return err
+		}
+		if ignore[name] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(fn)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		err = tw.WriteHeader(hdr)
+		if err != nil || false == fi.Mode().IsRegular() {
+			return err
+		}
+
+		fl, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		_, err = io.Copy(tw, fl)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,425 @@
+package imgverify
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DefKeyDir string = "/usr/local/monitor/imagekeys"
+const DefSigDir string = "/usr/local/monitor/imagesigs"
+
+// OCI index、manifest 和 config 的大小上限
+const defMaxIndexSize int64 = 4 << 20
+
+// cosign 签名载荷类型
+const CosignType string = "cosign container image signature"
+
+var ErrNoSignature = errors.New("signature not found")
+
+// cosign simple signing 载荷，只使用 critical 部分
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional,omitempty"`
+}
+
+// 签名文件可以是 {"payload": base64, "signature": base64} 的 JSON，
+// 也可以是 cosign sign --output-signature 生成的 base64 签名加同名 .payload 载荷文件
+type Signature struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+type publicKey struct {
+	name string
+	key  crypto.PublicKey
+}
+
+type Verifier struct {
+	SigDir string
+	keys   []publicKey
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// keyDir 下的 *.pub、*.pem 都作为信任的公钥，支持 ECDSA 和 RSA
+func NewVerifier(keyDir, sigDir string) (*Verifier, error) {
+	v := &Verifier{SigDir: sigDir}
+	files, err := ioutil.ReadDir(keyDir)
+	if err != nil {
+		return v, err
+	}
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if fi.IsDir() || (ext != ".pub" && ext != ".pem") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(keyDir, fi.Name()))
+		if err != nil {
+			return v, err
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return v, fmt.Errorf("%s: %s", fi.Name(), err.Error())
+		}
+		v.keys = append(v.keys, publicKey{name: fi.Name(), key: key})
+	}
+	if len(v.keys) == 0 {
+		return v, fmt.Errorf("no public key in %s", keyDir)
+	}
+	return v, nil
+}
+
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("unsupported public key type")
+}
+
+func LoadSignature(fn string) (*Signature, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSignature
+		}
+		return nil, err
+	}
+	sig := &Signature{}
+	if json.Unmarshal(data, sig) == nil && len(sig.Payload) > 0 && len(sig.Signature) > 0 {
+		return sig, nil
+	}
+
+	sig.Signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid signature", fn)
+	}
+	sig.Payload, err = ioutil.ReadFile(strings.TrimSuffix(fn, ".sig") + ".payload")
+	if err != nil {
+		return nil, fmt.Errorf("%s: payload: %s", fn, err.Error())
+	}
+	return sig, nil
+}
+
+// 校验签名并检查载荷中的摘要属于 digests，返回验证通过的公钥文件名
+func (v *Verifier) Verify(sig *Signature, digests []string) (string, error) {
+	payload := Payload{}
+	err := json.Unmarshal(sig.Payload, &payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid payload: %s", err.Error())
+	}
+	if payload.Critical.Type != CosignType {
+		return "", fmt.Errorf("invalid payload type %s", payload.Critical.Type)
+	}
+	digest := payload.Critical.Image.DockerManifestDigest
+	if !containsDigest(digests, digest) {
+		return "", fmt.Errorf("payload digest %s not match image", digest)
+	}
+
+	hashed := sha256.Sum256(sig.Payload)
+	for _, k := range v.keys {
+		if verifyHash(k.key, hashed[:], sig.Signature) {
+			return k.name, nil
+		}
+	}
+	return "", errors.New("no trusted key verify the signature")
+}
+
+func verifyHash(key crypto.PublicKey, hashed, signature []byte) bool {
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		es := ecdsaSignature{}
+		if _, err := asn1.Unmarshal(signature, &es); err != nil || es.R == nil || es.S == nil {
+			return false
+		}
+		return ecdsa.Verify(pub, hashed, es.R, es.S)
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, signature) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(pub, crypto.SHA256, hashed, signature, nil) == nil
+	}
+	return false
+}
+
+func containsDigest(digests []string, digest string) bool {
+	for _, v := range digests {
+		if v == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// 已导入 docker 的镜像：依次在 sigdir 中查找 <摘要>.sig，digests 为镜像 ID 和 RepoDigests 中的摘要
+func (v *Verifier) VerifyDigests(digests []string) (string, error) {
+	for _, d := range digests {
+		sig, err := LoadSignature(filepath.Join(v.SigDir, strings.TrimPrefix(d, "sha256:")+".sig"))
+		if err == ErrNoSignature {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return v.Verify(sig, digests)
+	}
+	return "", ErrNoSignature
+}
+
+// 镜像文件（docker save tar、OCI layout 目录或 tar）中的每个镜像都要验证通过：
+// 先用同目录的 <文件>.sig，不匹配时再按该镜像的摘要查 sigdir，返回验证通过的公钥文件名
+func (v *Verifier) VerifyArchive(fn string) (string, error) {
+	images, err := ArchiveImages(fn)
+	if err != nil {
+		return "", err
+	}
+	sig, err := LoadSignature(strings.TrimSuffix(fn, "/") + ".sig")
+	if err != nil && err != ErrNoSignature {
+		return "", err
+	}
+
+	var keys []string
+	for _, img := range images {
+		var key string
+		if sig != nil {
+			key, err = v.Verify(sig, img.Digests)
+			if err != nil {
+				if k, e := v.VerifyDigests(img.Digests); e == nil {
+					key, err = k, nil
+				}
+			}
+		} else {
+			key, err = v.VerifyDigests(img.Digests)
+		}
+		if err != nil {
+			return "", fmt.Errorf("image %s: %s", img.Digests[0], err.Error())
+		}
+		if !containsDigest(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return strings.Join(keys, ","), nil
+}
+
+// 镜像文件中的一个镜像，Digests 为可以被签名的摘要
+type ArchiveImage struct {
+	Digests []string
+}
+
+// OCI index 和 manifest 中用到的字段
+type ociContent struct {
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// 返回镜像文件中的镜像：docker save 的 manifest.json 条目为 config 摘要（即镜像 ID），
+// OCI layout 的 index.json 条目为 manifest/index 摘要及其中的 config 摘要，
+// 两者有相同摘要时是同一个镜像（docker 25 以后 docker save 同时生成两种索引）；
+// OCI 的 blob 都按内容重新计算摘要，不信任 index.json 中的声明
+func ArchiveImages(fn string) ([]ArchiveImage, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	read := func(name string) []byte {
+		if fi.IsDir() {
+			data, _ := ioutil.ReadFile(filepath.Join(fn, name))
+			return data
+		}
+		return files[path.Clean(name)]
+	}
+	if !fi.IsDir() {
+		err = readTarIndex(fn, files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var images []ArchiveImage
+	if data := read("manifest.json"); len(data) > 0 {
+		var lst []struct{ Config string }
+		err = json.Unmarshal(data, &lst)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range lst {
+			config := read(m.Config)
+			if len(config) == 0 {
+				return nil, fmt.Errorf("%s: config %s not found", fn, m.Config)
+			}
+			images = addArchiveImage(images, []string{sha256Digest(config)})
+		}
+	}
+	if data := read("index.json"); len(data) > 0 {
+		idx := ociContent{}
+		err = json.Unmarshal(data, &idx)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range idx.Manifests {
+			digests, err := ociDigests(read, m.Digest, true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", fn, err.Error())
+			}
+			images = addArchiveImage(images, digests)
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s is not an image archive", fn)
+	}
+	return images, nil
+}
+
+// 返回 digest 及其中嵌套的 manifest 和 config 摘要；多架构 index 可能只带了部分平台的 blob，缺少的跳过
+func ociDigests(read func(string) []byte, digest string, required bool) ([]string, error) {
+	data, err := ReadBlob(read, digest)
+	if err == ErrBlobNotFound && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %s", digest, err.Error())
+	}
+	content := ociContent{}
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %s", digest, err.Error())
+	}
+
+	digests := []string{digest}
+	if len(content.Config.Digest) > 0 {
+		_, err = ReadBlob(read, content.Config.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("blob %s: %s", content.Config.Digest, err.Error())
+		}
+		digests = append(digests, content.Config.Digest)
+	}
+	for _, m := range content.Manifests {
+		lst, err := ociDigests(read, m.Digest, false)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, lst...)
+	}
+	return digests, nil
+}
+
+// 只支持 sha256，读取 blobs/sha256/<hex> 并校验内容
+// 按 OCI layout 读取 blobs/sha256/<摘要>，只接受 64 位十六进制的 sha256 摘要并校验内容，
+// imageCreator 读取基础镜像时也使用
+func ReadBlob(read func(string) []byte, digest string) ([]byte, error) {
+	sum := strings.TrimPrefix(digest, "sha256:")
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 || sum == digest {
+		return nil, errors.New("unsupported digest")
+	}
+	data := read(path.Join("blobs", "sha256", sum))
+	if len(data) == 0 {
+		return nil, ErrBlobNotFound
+	}
+	if sha256Digest(data) != digest {
+		return nil, errors.New("digest mismatch")
+	}
+	return data, nil
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// 与已有镜像有相同摘要时合并为一个镜像
+func addArchiveImage(images []ArchiveImage, digests []string) []ArchiveImage {
+	idx := -1
+	for k, img := range images {
+		for _, d := range digests {
+			if containsDigest(img.Digests, d) {
+				idx = k
+			}
+		}
+	}
+	if idx < 0 {
+		images = append(images, ArchiveImage{})
+		idx = len(images) - 1
+	}
+	for _, d := range digests {
+		if !containsDigest(images[idx].Digests, d) {
+			images[idx].Digests = append(images[idx].Digests, d)
+		}
+	}
+	sort.Strings(images[idx].Digests)
+	return images
+}
+
+// 只读取 manifest.json、index.json、json 配置和 blobs 下不超过 defMaxIndexSize 的文件，大的层文件跳过
+func readTarIndex(fn string, files map[string][]byte) error {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	tr := tar.NewReader(fl)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		isBlob := strings.HasPrefix(name, "blobs/") && hdr.Size <= defMaxIndexSize
+		if hdr.Typeflag != tar.TypeReg || (!strings.HasSuffix(name, ".json") && path.Dir(name) != "." && !isBlob) {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files[name] = data
+	}
+}
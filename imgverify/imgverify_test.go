@@ -0,0 +1,246 @@
+package imgverify
+
+import (
+	"archive/tar"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testEnv struct {
+	dir      string
+	key      *ecdsa.PrivateKey
+	verifier *Verifier
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "imgverify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &testEnv{dir: dir}
+	env.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&env.key.PublicKey)
+	writeFile(t, filepath.Join(dir, "keys", "test.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	os.MkdirAll(filepath.Join(dir, "sigs"), os.ModePerm)
+	env.verifier, err = NewVerifier(filepath.Join(dir, "keys"), filepath.Join(dir, "sigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// 在 sigdir 中写入 <摘要>.sig
+func (env *testEnv) sign(t *testing.T, digest string) {
+	payload := Payload{}
+	payload.Critical.Type = CosignType
+	payload.Critical.Image.DockerManifestDigest = digest
+	data, _ := json.Marshal(&payload)
+	hashed := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, env.key, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := Signature{Payload: data}
+	sig.Signature, _ = asn1.Marshal(ecdsaSignature{R: r, S: s})
+	data, _ = json.Marshal(&sig)
+	writeFile(t, filepath.Join(env.dir, "sigs", strings.TrimPrefix(digest, "sha256:")+".sig"), data)
+}
+
+func writeFile(t *testing.T, fn string, data []byte) {
+	err := os.MkdirAll(filepath.Dir(fn), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(fn, data, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, fn string, files map[string][]byte) {
+	fl, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	tw := tar.NewWriter(fl)
+	for k, v := range files {
+		tw.WriteHeader(&tar.Header{Name: k, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(v))})
+		tw.Write(v)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func blobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// docker save 格式，每个 config 一个镜像，返回镜像 ID
+func dockerSaveFiles(configs ...string) (map[string][]byte, []string) {
+	files := make(map[string][]byte)
+	var lst []map[string]interface{}
+	var ids []string
+	for _, v := range configs {
+		id := sha256Digest([]byte(v))
+		name := strings.TrimPrefix(id, "sha256:") + ".json"
+		files[name] = []byte(v)
+		lst = append(lst, map[string]interface{}{"Config": name, "RepoTags": []string{"app:1.0"}, "Layers": []string{}})
+		ids = append(ids, id)
+	}
+	files["manifest.json"], _ = json.Marshal(lst)
+	return files, ids
+}
+
+// OCI layout，返回 manifest 摘要和 config 摘要
+func ociLayoutFiles(config string) (map[string][]byte, string, string) {
+	files := make(map[string][]byte)
+	configDigest := sha256Digest([]byte(config))
+	files[blobName(configDigest)] = []byte(config)
+	mf, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        map[string]interface{}{"digest": configDigest},
+		"layers":        []interface{}{},
+	})
+	mfDigest := sha256Digest(mf)
+	files[blobName(mfDigest)] = mf
+	files["index.json"], _ = json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{map[string]interface{}{"digest": mfDigest}},
+	})
+	files["oci-layout"] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	return files, mfDigest, configDigest
+}
+
+func TestVerifyDockerArchive(t *testing.T) {
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+
+	fn := filepath.Join(env.dir, "one.tar")
+	files, ids := dockerSaveFiles(`{"os":"linux"}`)
+	writeTar(t, fn, files)
+	if _, err := env.verifier.VerifyArchive(fn); err == nil || !strings.Contains(err.Error(), ErrNoSignature.Error()) {
+		t.Fatalf("unsigned archive err=%v", err)
+	}
+	env.sign(t, ids[0])
+	if key, err := env.verifier.VerifyArchive(fn); err != nil || key != "test.pub" {
+		t.Fatalf("signed archive key=%s, err=%v", key, err)
+	}
+
+	// 只有一个镜像签名时整个文件不通过
+	fn = filepath.Join(env.dir, "two.tar")
+	files, ids = dockerSaveFiles(`{"os":"linux"}`, `{"os":"linux","unsigned":true}`)
+	writeTar(t, fn, files)
+	images, err := ArchiveImages(fn)
+	if err != nil || len(images) != 2 {
+		t.Fatalf("images %v, err=%v", images, err)
+	}
+	if _, err = env.verifier.VerifyArchive(fn); err == nil || !strings.Contains(err.Error(), ids[1]) {
+		t.Fatalf("partly signed archive err=%v", err)
+	}
+	env.sign(t, ids[1])
+	if _, err = env.verifier.VerifyArchive(fn); err != nil {
+		t.Fatalf("all signed archive err=%v", err)
+	}
+}
+
+func TestVerifyOCILayout(t *testing.T) {
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+
+	files, mfDigest, configDigest := ociLayoutFiles(`{"os":"linux"}`)
+	dir := filepath.Join(env.dir, "layout")
+	for k, v := range files {
+		writeFile(t, filepath.Join(dir, k), v)
+	}
+	images, err := ArchiveImages(dir)
+	if err != nil || len(images) != 1 || len(images[0].Digests) != 2 {
+		t.Fatalf("images %v, err=%v", images, err)
+	}
+	env.sign(t, mfDigest)
+	if _, err = env.verifier.VerifyArchive(dir); err != nil {
+		t.Fatalf("signed layout err=%v", err)
+	}
+
+	// index.json 中的摘要与 blob 内容不符
+	writeFile(t, filepath.Join(dir, blobName(mfDigest)), []byte(`{"schemaVersion":2,"config":{"digest":"`+configDigest+`"},"layers":[{"digest":"sha256:evil"}]}`))
+	if _, err = env.verifier.VerifyArchive(dir); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("tampered manifest err=%v", err)
+	}
+	writeFile(t, filepath.Join(dir, blobName(mfDigest)), files[blobName(mfDigest)])
+	writeFile(t, filepath.Join(dir, blobName(configDigest)), []byte(`{"os":"evil"}`))
+	if _, err = env.verifier.VerifyArchive(dir); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("tampered config err=%v", err)
+	}
+	os.Remove(filepath.Join(dir, blobName(mfDigest)))
+	if _, err = ArchiveImages(dir); err == nil {
+		t.Fatal("missing manifest blob accepted")
+	}
+}
+
+// docker 25 以后的 docker save 同时有 manifest.json 和 index.json，是同一个镜像
+func TestArchiveImagesMerged(t *testing.T) {
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+
+	config := `{"os":"linux"}`
+	files, mfDigest, configDigest := ociLayoutFiles(config)
+	save, ids := dockerSaveFiles(config)
+	for k, v := range save {
+		files[k] = v
+	}
+	fn := filepath.Join(env.dir, "both.tar")
+	writeTar(t, fn, files)
+
+	images, err := ArchiveImages(fn)
+	if err != nil || len(images) != 1 {
+		t.Fatalf("images %v, err=%v", images, err)
+	}
+	if ids[0] != configDigest || !containsDigest(images[0].Digests, mfDigest) || !containsDigest(images[0].Digests, configDigest) {
+		t.Fatalf("digests %v", images[0].Digests)
+	}
+	env.sign(t, configDigest)
+	if _, err = env.verifier.VerifyArchive(fn); err != nil {
+		t.Fatalf("signed by image ID err=%v", err)
+	}
+}
+
+func TestReadBlob(t *testing.T) {
+	data := []byte("blob")
+	digest := sha256Digest(data)
+	read := func(name string) []byte {
+		if name == blobName(digest) {
+			return data
+		}
+		return nil
+	}
+	if got, err := ReadBlob(read, digest); err != nil || string(got) != "blob" {
+		t.Fatalf("readBlob %q, err=%v", got, err)
+	}
+	for _, v := range []string{"sha256:../../etc/passwd", "sha512:" + strings.Repeat("0", 128), strings.TrimPrefix(digest, "sha256:")} {
+		if _, err := ReadBlob(read, v); err == nil {
+			t.Errorf("ReadBlob(%s) accepted", v)
+		}
+	}
+	if _, err := ReadBlob(read, "sha256:"+strings.Repeat("0", 64)); err != ErrBlobNotFound {
+		t.Errorf("missing blob err=%v", err)
+	}
+	data = []byte("tampered")
+	if _, err := ReadBlob(read, digest); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("tampered blob err=%v", err)
+	}
+}
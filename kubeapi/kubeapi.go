@@ -0,0 +1,315 @@
+package kubeapi
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// kubeadm 部署的 TTU 上 apiserver 与证书的默认位置，与 https-client.go 使用的证书相同
+const DefServer string = "https://127.0.0.1:6443"
+const DefPkiDir string = "/etc/kubernetes/pki"
+const DefNamespace string = "default"
+const defTimeout time.Duration = 30 * time.Second
+
+// 依次查找的 kubeconfig，KUBECONFIG 环境变量优先
+var DefKubeconfigs = []string{
+	"~/.kube/config",
+	"/etc/kubernetes/admin.conf",
+	"/etc/kubernetes/kubelet.conf",
+}
+
+type Config struct {
+	Server    string
+	CA        []byte
+	Cert      []byte
+	Key       []byte
+	Token     string
+	Insecure  bool
+	Namespace string
+}
+
+type Client struct {
+	Server    string
+	Namespace string
+	token     string
+	tls       *tls.Config
+	http      *http.Client
+	stream    *http.Client // logs -f 等长连接不设超时
+}
+
+// apiserver 返回的 Status 错误
+type StatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.Code == http.StatusNotFound
+}
+
+// kubeconfig 中用到的字段，证书可以是文件路径或 base64 内容
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+func LoadKubeconfig(fn string) (*Config, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	kc := kubeconfig{}
+	err = yaml.Unmarshal(data, &kc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err.Error())
+	}
+	if len(kc.Contexts) == 0 {
+		return nil, fmt.Errorf("%s: no context", fn)
+	}
+
+	ctx := kc.Contexts[0].Context
+	for _, v := range kc.Contexts {
+		if v.Name == kc.CurrentContext {
+			ctx = v.Context
+		}
+	}
+	cfg := &Config{Namespace: ctx.Namespace}
+	dir := filepath.Dir(fn)
+	for _, v := range kc.Clusters {
+		if v.Name != ctx.Cluster {
+			continue
+		}
+		cfg.Server = v.Cluster.Server
+		cfg.Insecure = v.Cluster.InsecureSkipTLSVerify
+		cfg.CA, err = readData(dir, v.Cluster.CertificateAuthority, v.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range kc.Users {
+		if v.Name != ctx.User {
+			continue
+		}
+		cfg.Cert, err = readData(dir, v.User.ClientCertificate, v.User.ClientCertificateData)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Key, err = readData(dir, v.User.ClientKey, v.User.ClientKeyData)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Token = v.User.Token
+		if len(v.User.TokenFile) > 0 {
+			token, err := readData(dir, v.User.TokenFile, "")
+			if err != nil {
+				return nil, err
+			}
+			cfg.Token = strings.TrimSpace(string(token))
+		}
+	}
+	if len(cfg.Server) == 0 {
+		return nil, fmt.Errorf("%s: no server for context %s", fn, kc.CurrentContext)
+	}
+	return cfg, nil
+}
+
+// kubeconfig 中的相对路径相对于 kubeconfig 所在目录
+func readData(dir, fn, data string) ([]byte, error) {
+	if len(data) > 0 {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if len(fn) == 0 {
+		return nil, nil
+	}
+	if false == filepath.IsAbs(fn) {
+		fn = filepath.Join(dir, fn)
+	}
+	return ioutil.ReadFile(fn)
+}
+
+// 没有 kubeconfig 时使用 pki 目录下的 ca.crt 和 apiserver-kubelet-client 证书
+func LoadCertDir(dir, server string) (*Config, error) {
+	cfg := &Config{Server: server}
+	var err error
+	cfg.CA, err = ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Cert, err = ioutil.ReadFile(filepath.Join(dir, "apiserver-kubelet-client.crt"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Key, err = ioutil.ReadFile(filepath.Join(dir, "apiserver-kubelet-client.key"))
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// fn 为空时按 KUBECONFIG、DefKubeconfigs、DefPkiDir 的顺序查找
+func LoadConfig(fn string) (*Config, error) {
+	if len(fn) > 0 {
+		return LoadKubeconfig(fn)
+	}
+	lst := DefKubeconfigs
+	if env := os.Getenv("KUBECONFIG"); len(env) > 0 {
+		lst = append(filepath.SplitList(env), lst...)
+	}
+	for _, v := range lst {
+		if strings.HasPrefix(v, "~/") {
+			v = filepath.Join(os.Getenv("HOME"), v[2:])
+		}
+		if _, err := os.Stat(v); err == nil {
+			return LoadKubeconfig(v)
+		}
+	}
+	return LoadCertDir(DefPkiDir, DefServer)
+}
+
+func NewClient(cfg *Config) (*Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if len(cfg.CA) > 0 {
+		pool := x509.NewCertPool()
+		if false == pool.AppendCertsFromPEM(cfg.CA) {
+			return nil, errors.New("invalid ca certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cfg.Cert) > 0 {
+		cert, err := tls.X509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	tr := &http.Transport{TLSClientConfig: tlsConfig}
+	c := &Client{
+		Server:    strings.TrimSuffix(cfg.Server, "/"),
+		Namespace: cfg.Namespace,
+		token:     cfg.Token,
+		tls:       tlsConfig,
+		http:      &http.Client{Transport: tr, Timeout: defTimeout},
+		stream:    &http.Client{Transport: tr},
+	}
+	if len(c.Namespace) == 0 {
+		c.Namespace = DefNamespace
+	}
+	return c, nil
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.Server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// body 不为 nil 时以 JSON 发送，v 不为 nil 时解析返回的 JSON
+func (c *Client) Do(method, path string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	return c.DoRaw(method, path, reader, "application/json", v)
+}
+
+// merge patch、strategic merge patch 等需要指定 Content-Type 时使用
+func (c *Client) DoRaw(method, path string, body io.Reader, contentType string, v interface{}) error {
+	req, err := c.newRequest(method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return statusError(rsp.StatusCode, data)
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *Client) Get(path string, v interface{}) error {
+	return c.Do("GET", path, nil, v)
+}
+
+func statusError(code int, data []byte) error {
+	se := &StatusError{}
+	if json.Unmarshal(data, se) != nil || len(se.Message) == 0 {
+		se.Message = strings.TrimSpace(string(data))
+	}
+	se.Code = code
+	if len(se.Reason) == 0 {
+		se.Reason = http.StatusText(code)
+	}
+	return se
+}
@@ -0,0 +1,613 @@
+package kubeapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+const testToken string = "test-token"
+
+const testKubeconfig string = `apiVersion: v1
+kind: Config
+current-context: edge
+clusters:
+- name: other
+  cluster:
+    server: https://10.0.0.1:6443
+- name: local
+  cluster:
+    server: SERVER
+    certificate-authority-data: CADATA
+contexts:
+- name: admin
+  context:
+    cluster: other
+    user: admin
+- name: edge
+  context:
+    cluster: local
+    user: edge
+    namespace: apps
+users:
+- name: admin
+  user:
+    token: admin-token
+- name: edge
+  user:
+    tokenFile: token
+`
+
+// 写入 kubeconfig 和相对路径的 token 文件，server 和 CA 取自 httptest.Server
+func writeKubeconfig(t *testing.T, ts *httptest.Server) string {
+	dir, err := ioutil.TempDir("", "kubeapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	content := strings.NewReplacer("SERVER", ts.URL, "CADATA", base64.StdEncoding.EncodeToString(ca)).Replace(testKubeconfig)
+	fn := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(fn, []byte(content), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "token"), []byte(testToken+"\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// 模拟 apiserver：校验 token，按路径返回 routes 中的 JSON，其它路径返回 404 Status
+func newTestServer(t *testing.T, routes map[string]string) (*httptest.Server, *Client) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind":"Status","code":401,"reason":"Unauthorized","message":"Unauthorized"}`))
+			return
+		}
+		body, ok := routes[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","code":404,"reason":"NotFound","message":"` + r.URL.Path + ` not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+
+	fn := writeKubeconfig(t, ts)
+	defer os.RemoveAll(filepath.Dir(fn))
+	cfg, err := LoadKubeconfig(fn)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	c, err := NewClient(cfg)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return ts, c
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	fn := writeKubeconfig(t, ts)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	cfg, err := LoadKubeconfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server != ts.URL || cfg.Namespace != "apps" || cfg.Token != testToken {
+		t.Errorf("config server=%s, namespace=%s, token=%q", cfg.Server, cfg.Namespace, cfg.Token)
+	}
+	if block, _ := pem.Decode(cfg.CA); block == nil || string(block.Bytes) != string(ts.Certificate().Raw) {
+		t.Error("certificate-authority-data not decoded")
+	}
+
+	dir := filepath.Dir(fn)
+	cases := map[string]string{
+		"empty":     "apiVersion: v1\nkind: Config\n",
+		"noserver":  "current-context: a\ncontexts:\n- name: a\n  context:\n    cluster: missing\n",
+		"badbase64": strings.Replace(testKubeconfig, "CADATA", "not-base64", 1),
+	}
+	for k, v := range cases {
+		ioutil.WriteFile(filepath.Join(dir, k), []byte(v), 0600)
+		if _, err := LoadKubeconfig(filepath.Join(dir, k)); err == nil {
+			t.Errorf("%s kubeconfig accepted", k)
+		}
+	}
+}
+
+const testPod string = `{
+  "metadata": {"name": "web", "namespace": "apps"},
+  "spec": {"nodeName": "ttu1", "containers": [{"name": "app", "image": "app:1.0"}, {"name": "sidecar", "image": "proxy:2.0"}]},
+  "status": {"phase": "Running", "podIP": "10.244.0.5",
+    "containerStatuses": [
+      {"name": "app", "ready": true, "restartCount": 1, "image": "app:1.0", "containerID": "docker://abc123",
+       "state": {"running": {"startedAt": "2024-01-02T03:04:05Z"}}},
+      {"name": "sidecar", "ready": false, "restartCount": 4, "image": "proxy:2.0", "containerID": "containerd://def456",
+       "state": {"waiting": {"reason": "CrashLoopBackOff", "message": "back-off"}}}]}
+}`
+
+func TestGetPod(t *testing.T) {
+	ts, c := newTestServer(t, map[string]string{"/api/v1/namespaces/apps/pods/web": testPod})
+	defer ts.Close()
+
+	pod, err := c.GetPod("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := GetPodStatus(pod)
+	if st.Name != "web" || st.Node != "ttu1" || st.IP != "10.244.0.5" || st.Phase != "Running" {
+		t.Errorf("status %+v", st)
+	}
+	if st.Status != "CrashLoopBackOff" || st.Ready != "1/2" || st.Restarts != 5 {
+		t.Errorf("status=%s, ready=%s, restarts=%d", st.Status, st.Ready, st.Restarts)
+	}
+	if len(st.Containers) != 2 || st.Containers[0].ID != "abc123" || st.Containers[0].State != "Running" ||
+		st.Containers[1].ID != "def456" || st.Containers[1].State != "Waiting" {
+		t.Errorf("containers %+v", st.Containers)
+	}
+
+	_, err = c.GetPod("other", "web")
+	if !IsNotFound(err) {
+		t.Errorf("missing pod err=%v", err)
+	}
+	c.token = "wrong"
+	_, err = c.GetPod("", "web")
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusUnauthorized || se.Reason != "Unauthorized" {
+		t.Errorf("unauthorized err=%v", err)
+	}
+}
+
+func TestGetPodStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		pod    string
+		status string
+		state  string
+		reason string
+	}{
+		{"running", `{"status":{"phase":"Running","containerStatuses":[{"name":"a","ready":true,"state":{"running":{}}}]}}`,
+			"Running", "Running", ""},
+		{"pulling", `{"status":{"phase":"Pending","containerStatuses":[{"name":"a","state":{"waiting":{"reason":"ImagePullBackOff"}}}]}}`,
+			"ImagePullBackOff", "Waiting", "ImagePullBackOff"},
+		{"oomkilled", `{"status":{"phase":"Running","containerStatuses":[{"name":"a","state":{"terminated":{"exitCode":137,"reason":"OOMKilled"}}}]}}`,
+			"OOMKilled", "Terminated", "OOMKilled"},
+		{"exitcode", `{"status":{"phase":"Failed","containerStatuses":[{"name":"a","state":{"terminated":{"exitCode":2}}}]}}`,
+			"ExitCode:2", "Terminated", "ExitCode:2"},
+		{"completed", `{"status":{"phase":"Succeeded","containerStatuses":[{"name":"a","state":{"terminated":{"exitCode":0,"reason":"Completed"}}}]}}`,
+			"Succeeded", "Terminated", "Completed"},
+		{"evicted", `{"status":{"phase":"Failed","reason":"Evicted"}}`,
+			"Evicted", "", ""},
+		{"terminating", `{"metadata":{"deletionTimestamp":"2024-01-02T03:04:05Z"},"status":{"phase":"Running","containerStatuses":[{"name":"a","ready":true,"state":{"running":{}}}]}}`,
+			"Terminating", "Running", ""},
+	}
+	for _, v := range cases {
+		pod := &Pod{}
+		if err := json.Unmarshal([]byte(v.pod), pod); err != nil {
+			t.Fatalf("%s: %s", v.name, err.Error())
+		}
+		st := GetPodStatus(pod)
+		if st.Status != v.status {
+			t.Errorf("%s: status %s, want %s", v.name, st.Status, v.status)
+		}
+		if len(st.Containers) > 0 && (st.Containers[0].State != v.state || st.Containers[0].Reason != v.reason) {
+			t.Errorf("%s: container %+v", v.name, st.Containers[0])
+		}
+	}
+}
+
+const testSummary string = `{
+  "node": {"nodeName": "ttu1", "cpu": {"usageNanoCores": 1500000000}, "memory": {"workingSetBytes": 1073741824}},
+  "pods": [
+    {"podRef": {"name": "db", "namespace": "apps"}, "cpu": {"usageNanoCores": 1000000}, "memory": {"workingSetBytes": 1024}},
+    {"podRef": {"name": "web", "namespace": "apps"}, "cpu": {"usageNanoCores": 250000000}, "memory": {"workingSetBytes": 67108864},
+     "containers": [{"name": "app", "cpu": {"usageNanoCores": 200000000}, "memory": {"workingSetBytes": 50331648}},
+                    {"name": "sidecar", "cpu": {}, "memory": {}}]}]
+}`
+
+func TestGetPodMetrics(t *testing.T) {
+	pod := &Pod{}
+	json.Unmarshal([]byte(testPod), pod)
+	metricsPath := "/apis/metrics.k8s.io/v1beta1/namespaces/apps/pods/web"
+	summaryPath := "/api/v1/nodes/ttu1/proxy/stats/summary"
+
+	ts, c := newTestServer(t, map[string]string{
+		metricsPath: `{"metadata":{"name":"web"},"containers":[{"name":"app","usage":{"cpu":"250m","memory":"64Mi"}},{"name":"sidecar","usage":{"cpu":"1500000n","memory":"1Ki"}}]}`,
+		summaryPath: testSummary,
+	})
+	m, err := c.GetPodMetrics(pod)
+	ts.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != "metrics-server" || m.CPU != 252 || m.Memory != 64<<20+1024 || len(m.Containers) != 2 {
+		t.Errorf("metrics-server %+v", m)
+	}
+
+	// 没有部署 metrics-server 时读取 kubelet summary
+	ts, c = newTestServer(t, map[string]string{summaryPath: testSummary})
+	defer ts.Close()
+	m, err = c.GetPodMetrics(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != "kubelet" || m.CPU != 250 || m.Memory != 64<<20 || len(m.Containers) != 2 {
+		t.Errorf("kubelet %+v", m)
+	}
+	if m.Containers[0].CPU != 200 || m.Containers[0].Memory != 48<<20 || m.Containers[1].CPU != 0 {
+		t.Errorf("kubelet containers %+v", m.Containers)
+	}
+
+	summary, err := c.GetSummary("ttu1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu, mem := summary.NodeUsage(); cpu != 1500 || mem != 1<<30 {
+		t.Errorf("node usage cpu=%d, mem=%d", cpu, mem)
+	}
+
+	missing := &Pod{}
+	missing.Metadata.Name, missing.Metadata.Namespace, missing.Spec.NodeName = "gone", "apps", "ttu1"
+	if _, err = c.GetPodMetrics(missing); err == nil {
+		t.Error("metrics for pod not in summary")
+	}
+	missing.Spec.NodeName = ""
+	if _, err = c.GetPodMetrics(missing); !IsNotFound(err) {
+		t.Errorf("unscheduled pod err=%v", err)
+	}
+}
+
+func TestNodeStatus(t *testing.T) {
+	ts, c := newTestServer(t, map[string]string{
+		"/api/v1/pods?fieldSelector=spec.nodeName%3Dttu1": `{"items":[
+			{"metadata":{"name":"web","namespace":"apps"},"spec":{"nodeName":"ttu1"},"status":{"phase":"Running"}},
+			{"metadata":{"name":"coredns","namespace":"kube-system"},"spec":{"nodeName":"ttu1"},"status":{"phase":"Pending"}}]}`,
+		"/api/v1/pods?fieldSelector=spec.nodeName%3Dttu2": `{"items":[]}`,
+		"/api/v1/nodes/ttu1":                              `{"metadata":{"name":"ttu1"},"status":{"capacity":{"cpu":"4","memory":"2Gi"},"allocatable":{"cpu":"3800m"}}}`,
+	})
+	defer ts.Close()
+
+	pods, err := c.ListNodePods("ttu1")
+	if err != nil || len(pods) != 2 {
+		t.Fatalf("pods %+v, %v", pods, err)
+	}
+	if pods[0].Metadata.Name != "web" || pods[1].Metadata.Namespace != "kube-system" || pods[1].Status.Phase != "Pending" {
+		t.Errorf("pods %+v", pods)
+	}
+	if pods, err = c.ListNodePods("ttu2"); err != nil || len(pods) != 0 {
+		t.Errorf("empty node %+v, %v", pods, err)
+	}
+
+	node, err := c.GetNode("ttu1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ParseQuantity(node.Status.Capacity["cpu"], true) != 4000 || ParseQuantity(node.Status.Capacity["memory"], false) != 2<<30 ||
+		node.Status.Allocatable["cpu"] != "3800m" {
+		t.Errorf("node %+v", node)
+	}
+	if _, err = c.GetNode("ttu2"); !IsNotFound(err) {
+		t.Errorf("missing node err=%v", err)
+	}
+
+	summary := &Summary{}
+	if cpu, mem := summary.NodeUsage(); cpu != 0 || mem != 0 {
+		t.Errorf("empty summary cpu=%d, mem=%d", cpu, mem)
+	}
+	json.Unmarshal([]byte(`{"node":{"cpu":{"usageNanoCores":2500000},"memory":{"workingSetBytes":4096}}}`), summary)
+	if cpu, mem := summary.NodeUsage(); cpu != 2 || mem != 4096 {
+		t.Errorf("node usage cpu=%d, mem=%d", cpu, mem)
+	}
+}
+
+func TestParseQuantity(t *testing.T) {
+	cases := []struct {
+		str   string
+		milli bool
+		value int64
+	}{
+		{"", false, 0},
+		{"128974848", false, 128974848},
+		{"64Mi", false, 64 << 20},
+		{"1.5Gi", false, 3 << 29},
+		{"2Ki", false, 2048},
+		{"1k", false, 1000},
+		{"1M", false, 1000000},
+		{"2", true, 2000},
+		{"0.5", true, 500},
+		{"250m", true, 250},
+		{"1500000n", true, 2},
+		{"100u", true, 0},
+		{"750u", true, 1},
+		{" 100m ", true, 100},
+		{"abc", false, 0},
+		{"1Xi", false, 0},
+	}
+	for _, v := range cases {
+		if got := ParseQuantity(v.str, v.milli); got != v.value {
+			t.Errorf("ParseQuantity(%q, %v) = %d, want %d", v.str, v.milli, got, v.value)
+		}
+	}
+}
+
+func TestExecResult(t *testing.T) {
+	cases := []struct {
+		data string
+		code int
+		err  string
+	}{
+		{`{"metadata":{},"status":"Success"}`, 0, ""},
+		{`{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: exit status 3","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"3"}]}}`, 3, ""},
+		{`{"status":"Failure","message":"exit status 127","reason":"NonZeroExitCode","details":{"causes":[{"reason":"Other","message":"x"},{"reason":"ExitCode","message":"127"}]}}`, 127, ""},
+		{`{"status":"Failure","message":"bad exit code","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"abc"}]}}`, -1, "bad exit code"},
+		{`{"status":"Failure","message":"container not found","reason":"InternalError"}`, -1, "container not found"},
+	}
+	for _, v := range cases {
+		code, err := execResult([]byte(v.data))
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if code != v.code || msg != v.err {
+			t.Errorf("execResult(%s) = %d, %q, want %d, %q", v.data, code, msg, v.code, v.err)
+		}
+	}
+	if _, err := execResult([]byte("not json")); err == nil {
+		t.Error("invalid status accepted")
+	}
+}
+
+func TestSelectRevision(t *testing.T) {
+	cases := []struct {
+		nums     []int64
+		revision int64
+		want     int64
+		err      string
+	}{
+		{[]int64{1, 3, 2}, 0, 2, ""},
+		{[]int64{5, 7}, 0, 5, ""},
+		{[]int64{2, 4, 3}, 2, 2, ""},
+		{nil, 0, 0, "no rollout history found"},
+		{[]int64{4}, 0, 0, "no previous revision to roll back to"},
+		{[]int64{1, 3, 2}, 3, 0, "revision 3 is the current revision"},
+		{[]int64{1, 3, 2}, 5, 0, "revision 5 not found"},
+	}
+	for _, v := range cases {
+		got, err := selectRevision(v.nums, v.revision)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if got != v.want || msg != v.err {
+			t.Errorf("selectRevision(%v, %d) = %d, %q, want %d, %q", v.nums, v.revision, got, msg, v.want, v.err)
+		}
+	}
+}
+
+// 按文档解析 GenerateApp 的输出，返回 kind 列表和 kind/name 到对象的映射
+func parseManifest(t *testing.T, data []byte) ([]string, map[string]interface{}) {
+	var kinds []string
+	objs := make(map[string]interface{})
+	for _, doc := range splitDocuments(data) {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			t.Fatal(err)
+		}
+		kind, _ := obj["kind"].(string)
+		name, _ := getField(obj, "metadata", "name").(string)
+		kinds = append(kinds, kind)
+		objs[kind+"/"+name] = obj
+	}
+	return kinds, objs
+}
+
+func TestGenerateApp(t *testing.T) {
+	cases := []struct {
+		name  string
+		spec  AppSpec
+		kinds string
+		check func(t *testing.T, objs map[string]interface{})
+	}{
+		{"plain", AppSpec{Name: "web", Image: "web:1"}, "Deployment", func(t *testing.T, objs map[string]interface{}) {
+			d := objs["Deployment/web"]
+			if v := getField(d, "spec", "replicas"); v != float64(1) {
+				t.Errorf("replicas %v", v)
+			}
+			if v := getField(d, "spec", "strategy"); v != nil {
+				t.Errorf("strategy %v", v)
+			}
+			if v := getField(d, "spec", "template", "spec", "volumes"); v != nil {
+				t.Errorf("volumes %v", v)
+			}
+		}},
+		{"config", AppSpec{Name: "app", Namespace: "edge", Kind: "daemonset", Image: "app:2",
+			Env:   map[string]string{"LOG_LEVEL": "debug"},
+			Files: map[string]string{"app.conf": "port=80\n", "LOG_LEVEL": "file"}},
+			"ConfigMap,ConfigMap,DaemonSet", func(t *testing.T, objs map[string]interface{}) {
+				env := objs["ConfigMap/app-env"]
+				files := objs["ConfigMap/app-files"]
+				if v := getField(env, "data"); len(v.(map[string]interface{})) != 1 || getField(env, "data", "LOG_LEVEL") != "debug" {
+					t.Errorf("env data %v", v)
+				}
+				if v := getField(files, "data"); len(v.(map[string]interface{})) != 2 || getField(files, "data", "LOG_LEVEL") != "file" {
+					t.Errorf("files data %v", v)
+				}
+				if v := getField(env, "metadata", "namespace"); v != "edge" {
+					t.Errorf("namespace %v", v)
+				}
+				ds := objs["DaemonSet/app"]
+				if v := getField(ds, "spec", "replicas"); v != nil {
+					t.Errorf("daemonset replicas %v", v)
+				}
+				c := getField(ds, "spec", "template", "spec", "containers").([]interface{})[0]
+				from := getField(c, "envFrom").([]interface{})
+				if len(from) != 1 || getField(from[0], "configMapRef", "name") != "app-env" {
+					t.Errorf("envFrom %v", from)
+				}
+				vols := getField(ds, "spec", "template", "spec", "volumes").([]interface{})
+				if len(vols) != 1 || getField(vols[0], "configMap", "name") != "app-files" {
+					t.Errorf("volumes %v", vols)
+				}
+				mounts := getField(c, "volumeMounts").([]interface{})
+				if len(mounts) != 1 || getField(mounts[0], "mountPath") != "/etc/app" {
+					t.Errorf("mounts %v", mounts)
+				}
+			}},
+		{"devices", AppSpec{Name: "serial", Image: "serial:1", Replicas: 2, Node: "edge1", HostNetwork: true,
+			Devices:  []string{"/dev/ttyS1", "/dev/usb/ttyS1:/dev/ttyS2", "/dev/serial/ttyS1", "/dev/_"},
+			CPULimit: "500m", MemRequest: "64Mi"},
+			"Deployment", func(t *testing.T, objs map[string]interface{}) {
+				d := objs["Deployment/serial"]
+				if v := getField(d, "spec", "strategy", "type"); v != "Recreate" {
+					t.Errorf("strategy %v", v)
+				}
+				pod := getField(d, "spec", "template", "spec")
+				if getField(pod, "hostNetwork") != true || getField(pod, "nodeSelector", nodeSelectorKey) != "edge1" {
+					t.Errorf("pod spec %v", pod)
+				}
+				var names []string
+				for _, v := range getField(pod, "volumes").([]interface{}) {
+					names = append(names, getField(v, "name").(string))
+				}
+				if strings.Join(names, ",") != "dev-ttys1,dev-ttys1-2,dev-ttys1-3,dev" {
+					t.Errorf("volume names %v", names)
+				}
+				c := getField(pod, "containers").([]interface{})[0]
+				if getField(c, "securityContext", "privileged") != true {
+					t.Error("not privileged")
+				}
+				if getField(c, "resources", "limits", "cpu") != "500m" || getField(c, "resources", "requests", "memory") != "64Mi" {
+					t.Errorf("resources %v", getField(c, "resources"))
+				}
+				mounts := getField(c, "volumeMounts").([]interface{})
+				if getField(mounts[1], "mountPath") != "/dev/ttyS2" {
+					t.Errorf("mounts %v", mounts)
+				}
+			}},
+	}
+	for _, v := range cases {
+		data, err := GenerateApp(&v.spec)
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		kinds, objs := parseManifest(t, data)
+		if strings.Join(kinds, ",") != v.kinds {
+			t.Errorf("%s: kinds %v, want %s", v.name, kinds, v.kinds)
+			continue
+		}
+		if _, err = ValidateManifest(data); err != nil {
+			t.Errorf("%s: generated manifest invalid: %v", v.name, err)
+		}
+		v.check(t, objs)
+	}
+}
+
+func TestGenerateAppInvalid(t *testing.T) {
+	cases := []struct {
+		spec AppSpec
+		err  string
+	}{
+		{AppSpec{Name: "Web", Image: "web:1"}, "invalid app name Web"},
+		{AppSpec{Name: "web"}, "image is required"},
+		{AppSpec{Name: "web", Image: "web:1", Kind: "job"}, "unsupported kind job"},
+		{AppSpec{Name: "web", Image: "web:1", Env: map[string]string{"A B": "1"}}, "invalid env name A B"},
+		{AppSpec{Name: "web", Image: "web:1", Files: map[string]string{"a/b": "1"}}, "invalid config file name a/b"},
+		{AppSpec{Name: "web", Image: "web:1", Devices: []string{"ttyS1"}}, "invalid device ttyS1"},
+		{AppSpec{Name: "web", Image: "web:1", CPURequest: "1x"}, "invalid resource quantity 1x"},
+		{AppSpec{Name: "web", Image: "web:1", MemRequest: "1Gi", MemLimit: "512Mi"}, "memory request 1Gi greater than limit 512Mi"},
+	}
+	for _, v := range cases {
+		_, err := GenerateApp(&v.spec)
+		if err == nil || false == strings.HasPrefix(err.Error(), v.err) {
+			t.Errorf("%+v: err %v, want %s", v.spec, err, v.err)
+		}
+	}
+}
+
+const testWorkload string = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: LABEL
+    spec:
+      volumes:
+      - name: data
+        hostPath:
+          path: /data
+      containers:
+      - name: web
+        image: IMAGE
+        resources:
+          requests:
+            cpu: CPU
+          limits:
+            cpu: 1
+        volumeMounts:
+        - name: MOUNT
+          mountPath: /data
+`
+
+func TestValidateManifest(t *testing.T) {
+	workload := func(label, image, cpu, mount string) string {
+		return strings.NewReplacer("LABEL", label, "IMAGE", image, "CPU", cpu, "MOUNT", mount).Replace(testWorkload)
+	}
+	valid := workload("web", "web:1", "500m", "data")
+	cases := []struct {
+		name  string
+		data  string
+		kinds string
+		err   string
+	}{
+		{"workload", valid, "Deployment", ""},
+		{"multi", "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web-env\ndata:\n  PORT: \"80\"\n---\n" + valid + "---\n", "ConfigMap,Deployment", ""},
+		{"service", "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n", "Service", ""},
+		{"empty", "---\n", "", "no kubernetes object found"},
+		{"syntax", "kind: [\n", "", "document 1: "},
+		{"no name", "apiVersion: v1\nkind: ConfigMap\n", "", "document 1: apiVersion, kind and metadata.name are required"},
+		{"apps version", strings.Replace(valid, "apps/v1", "extensions/v1beta1", 1), "", "Deployment web: apiVersion extensions/v1beta1 not supported"},
+		{"selector", workload("api", "web:1", "500m", "data"), "", "Deployment web: selector app=web does not match template labels"},
+		{"image", workload("web", "", "500m", "data"), "", "Deployment web: container web: image is required"},
+		{"resources", workload("web", "web:1", "2", "data"), "", "Deployment web: container web: cpu request 2 greater than limit 1"},
+		{"mount", workload("web", "web:1", "500m", "logs"), "", `Deployment web: container web: volume "logs" not found`},
+		{"configmap value", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\ndata:\n  PORT: 80\n", "", "ConfigMap c: data PORT must be a string"},
+		{"configmap key", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\ndata:\n  a/b: x\n", "", "ConfigMap c: invalid data key a/b"},
+	}
+	for _, v := range cases {
+		objs, err := ValidateManifest([]byte(v.data))
+		if len(v.err) > 0 {
+			if err == nil || false == strings.HasPrefix(err.Error(), v.err) {
+				t.Errorf("%s: err %v, want %s", v.name, err, v.err)
+			}
+			continue
+		}
+		var kinds []string
+		for _, o := range objs {
+			kinds = append(kinds, o.Kind)
+		}
+		if err != nil || strings.Join(kinds, ",") != v.kinds {
+			t.Errorf("%s: %v, %v, want %s", v.name, kinds, err, v.kinds)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package kubeapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// container init 的应用描述，Env 写入 <Name>-env ConfigMap，Files 写入 <Name>-files ConfigMap，
+// 分开存放使 envFrom 不会把配置文件内容也导入为环境变量
+type AppSpec struct {
+	Name        string
+	Namespace   string
+	Kind        string
+	Image       string
+	Replicas    int
+	Node        string
+	HostNetwork bool
+	CPURequest  string
+	CPULimit    string
+	MemRequest  string
+	MemLimit    string
+	Devices     []string
+	Env         map[string]string
+	Files       map[string]string
+	ConfigDir   string
+}
+
+// 清单中一个文档的概要
+type ManifestObject struct {
+	APIVersion string
+	Kind       string
+	Name       string
+}
+
+const nodeSelectorKey string = "kubernetes.io/hostname"
+
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+var quantity = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(n|u|m|k|M|G|T|Ki|Mi|Gi|Ti)?$`)
+var configKey = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+var invalidVolumeChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// 生成 Deployment 或 DaemonSet，有配置时前面加 ConfigMap，文档之间以 --- 分隔
+func GenerateApp(spec *AppSpec) ([]byte, error) {
+	err := checkAppSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{"app": spec.Name}
+	envName := spec.Name + "-env"
+	filesName := spec.Name + "-files"
+
+	container := map[string]interface{}{
+		"name":            spec.Name,
+		"image":           spec.Image,
+		"imagePullPolicy": "IfNotPresent",
+	}
+	podSpec := map[string]interface{}{}
+	var volumes, mounts []interface{}
+
+	resources := map[string]interface{}{}
+	if req := resourceList(spec.CPURequest, spec.MemRequest); len(req) > 0 {
+		resources["requests"] = req
+	}
+	if limit := resourceList(spec.CPULimit, spec.MemLimit); len(limit) > 0 {
+		resources["limits"] = limit
+	}
+	if len(resources) > 0 {
+		container["resources"] = resources
+	}
+
+	// 设备以 hostPath 挂载，容器需要特权才能访问；不同目录下的同名设备卷名加序号区分
+	used := make(map[string]bool)
+	for _, v := range spec.Devices {
+		host, dst := splitDevice(v)
+		base := strings.TrimSuffix("dev-"+volumeName(path.Base(host)), "-")
+		name := base
+		for k := 2; used[name]; k++ {
+			name = fmt.Sprintf("%s-%d", base, k)
+		}
+		used[name] = true
+		volumes = append(volumes, map[string]interface{}{
+			"name":     name,
+			"hostPath": map[string]interface{}{"path": host},
+		})
+		mounts = append(mounts, map[string]interface{}{"name": name, "mountPath": dst})
+	}
+	if len(spec.Devices) > 0 {
+		container["securityContext"] = map[string]interface{}{"privileged": true}
+	}
+
+	if len(spec.Env) > 0 {
+		container["envFrom"] = []interface{}{
+			map[string]interface{}{"configMapRef": map[string]interface{}{"name": envName}},
+		}
+	}
+	if len(spec.Files) > 0 {
+		var items []interface{}
+		for _, k := range sortedKeys(spec.Files) {
+			items = append(items, map[string]interface{}{"key": k, "path": k})
+		}
+		volumes = append(volumes, map[string]interface{}{
+			"name":      "config",
+			"configMap": map[string]interface{}{"name": filesName, "items": items},
+		})
+		mounts = append(mounts, map[string]interface{}{"name": "config", "mountPath": spec.ConfigDir})
+	}
+
+	if len(mounts) > 0 {
+		container["volumeMounts"] = mounts
+		podSpec["volumes"] = volumes
+	}
+	podSpec["containers"] = []interface{}{container}
+	if len(spec.Node) > 0 {
+		podSpec["nodeSelector"] = map[string]string{nodeSelectorKey: spec.Node}
+	}
+	if spec.HostNetwork {
+		podSpec["hostNetwork"] = true
+		podSpec["dnsPolicy"] = "ClusterFirstWithHostNet"
+	}
+
+	workloadSpec := map[string]interface{}{
+		"selector": map[string]interface{}{"matchLabels": labels},
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": labels},
+			"spec":     podSpec,
+		},
+	}
+	// 主机网络端口、设备不能被新旧两个 pod 同时占用，先停旧的再启动新的
+	if spec.Kind == KindDeployment {
+		workloadSpec["replicas"] = spec.Replicas
+		if spec.HostNetwork || len(spec.Devices) > 0 {
+			workloadSpec["strategy"] = map[string]interface{}{"type": "Recreate"}
+		}
+	}
+
+	var docs []interface{}
+	if len(spec.Env) > 0 {
+		docs = append(docs, configMap(spec, envName, labels, spec.Env))
+	}
+	if len(spec.Files) > 0 {
+		docs = append(docs, configMap(spec, filesName, labels, spec.Files))
+	}
+	docs = append(docs, map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       spec.Kind,
+		"metadata":   objectMeta(spec, spec.Name, labels),
+		"spec":       workloadSpec,
+	})
+
+	var buf bytes.Buffer
+	for k, v := range docs {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if k > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+func checkAppSpec(spec *AppSpec) error {
+	if len(spec.Name) > 63 || false == dnsLabel.MatchString(spec.Name) {
+		return fmt.Errorf("invalid app name %s, use lower case letters, digits and '-'", spec.Name)
+	}
+	if len(spec.Image) == 0 {
+		return errors.New("image is required")
+	}
+	switch strings.ToLower(spec.Kind) {
+	case "", "deployment":
+		spec.Kind = KindDeployment
+	case "daemonset":
+		spec.Kind = KindDaemonSet
+	default:
+		return fmt.Errorf("unsupported kind %s, use deployment or daemonset", spec.Kind)
+	}
+	if spec.Replicas <= 0 {
+		spec.Replicas = 1
+	}
+	if len(spec.ConfigDir) == 0 {
+		spec.ConfigDir = "/etc/" + spec.Name
+	}
+	for k := range spec.Env {
+		if false == configKey.MatchString(k) {
+			return fmt.Errorf("invalid env name %s", k)
+		}
+	}
+	for k := range spec.Files {
+		if false == configKey.MatchString(k) {
+			return fmt.Errorf("invalid config file name %s", k)
+		}
+	}
+	for _, v := range spec.Devices {
+		host, dst := splitDevice(v)
+		if false == path.IsAbs(host) || false == path.IsAbs(dst) {
+			return fmt.Errorf("invalid device %s, use /dev/xxx or /dev/host:/dev/container", v)
+		}
+	}
+	return checkResources(spec.CPURequest, spec.CPULimit, spec.MemRequest, spec.MemLimit)
+}
+
+func checkResources(cpuRequest, cpuLimit, memRequest, memLimit string) error {
+	for _, v := range []string{cpuRequest, cpuLimit, memRequest, memLimit} {
+		if len(v) > 0 && false == quantity.MatchString(v) {
+			return fmt.Errorf("invalid resource quantity %s", v)
+		}
+	}
+	if len(cpuRequest) > 0 && len(cpuLimit) > 0 && ParseQuantity(cpuRequest, true) > ParseQuantity(cpuLimit, true) {
+		return fmt.Errorf("cpu request %s greater than limit %s", cpuRequest, cpuLimit)
+	}
+	if len(memRequest) > 0 && len(memLimit) > 0 && ParseQuantity(memRequest, false) > ParseQuantity(memLimit, false) {
+		return fmt.Errorf("memory request %s greater than limit %s", memRequest, memLimit)
+	}
+	return nil
+}
+
+func objectMeta(spec *AppSpec, name string, labels map[string]string) map[string]interface{} {
+	meta := map[string]interface{}{"name": name, "labels": labels}
+	if len(spec.Namespace) > 0 {
+		meta["namespace"] = spec.Namespace
+	}
+	return meta
+}
+
+func configMap(spec *AppSpec, name string, labels map[string]string, data map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   objectMeta(spec, name, labels),
+		"data":       data,
+	}
+}
+
+func resourceList(cpu, mem string) map[string]string {
+	lst := make(map[string]string)
+	if len(cpu) > 0 {
+		lst["cpu"] = cpu
+	}
+	if len(mem) > 0 {
+		lst["memory"] = mem
+	}
+	return lst
+}
+
+// /dev/ttyS1 或 /dev/ttyS1:/dev/ttyS0（主机:容器）
+func splitDevice(dev string) (string, string) {
+	if i := strings.Index(dev, ":"); i >= 0 {
+		return dev[:i], dev[i+1:]
+	}
+	return dev, dev
+}
+
+func volumeName(name string) string {
+	name = strings.ToLower(name)
+	name = invalidVolumeChars.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-")
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 离线检查清单：每个文档可以转换为 JSON，有 apiVersion、kind、metadata.name，
+// 并对 Deployment、DaemonSet、ConfigMap 做常见错误检查
+func ValidateManifest(data []byte) ([]ManifestObject, error) {
+	var objs []ManifestObject
+	for k, doc := range splitDocuments(data) {
+		obj := map[string]interface{}{}
+		err := yaml.Unmarshal(doc, &obj)
+		if err != nil {
+			return objs, fmt.Errorf("document %d: %s", k+1, err.Error())
+		}
+		if len(obj) == 0 {
+			continue
+		}
+
+		mo := ManifestObject{}
+		mo.APIVersion, _ = obj["apiVersion"].(string)
+		mo.Kind, _ = obj["kind"].(string)
+		mo.Name, _ = getField(obj, "metadata", "name").(string)
+		if len(mo.APIVersion) == 0 || len(mo.Kind) == 0 || len(mo.Name) == 0 {
+			return objs, fmt.Errorf("document %d: apiVersion, kind and metadata.name are required", k+1)
+		}
+
+		switch mo.Kind {
+		case KindDeployment, KindDaemonSet:
+			err = validateWorkload(obj)
+		case "ConfigMap":
+			err = validateConfigMap(obj)
+		}
+		if err != nil {
+			return objs, fmt.Errorf("%s %s: %s", mo.Kind, mo.Name, err.Error())
+		}
+		objs = append(objs, mo)
+	}
+	if len(objs) == 0 {
+		return objs, errors.New("no kubernetes object found")
+	}
+	return objs, nil
+}
+
+func splitDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	var cur []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimRight(line, "\r"), "---") {
+			docs = append(docs, []byte(strings.Join(cur, "\n")))
+			cur = nil
+			continue
+		}
+		cur = append(cur, line)
+	}
+	return append(docs, []byte(strings.Join(cur, "\n")))
+}
+
+func getField(obj interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := obj.(map[string]interface{})
+		if false == ok {
+			return nil
+		}
+		obj = m[k]
+	}
+	return obj
+}
+
+func validateWorkload(obj map[string]interface{}) error {
+	if obj["apiVersion"] != "apps/v1" {
+		return fmt.Errorf("apiVersion %v not supported, use apps/v1", obj["apiVersion"])
+	}
+	selector, _ := getField(obj, "spec", "selector", "matchLabels").(map[string]interface{})
+	if len(selector) == 0 {
+		return errors.New("spec.selector.matchLabels is required")
+	}
+	labels, _ := getField(obj, "spec", "template", "metadata", "labels").(map[string]interface{})
+	for k, v := range selector {
+		if labels[k] != v {
+			return fmt.Errorf("selector %s=%v does not match template labels", k, v)
+		}
+	}
+
+	podSpec := getField(obj, "spec", "template", "spec")
+	volumes := make(map[string]bool)
+	lst, _ := getField(podSpec, "volumes").([]interface{})
+	for _, v := range lst {
+		name, _ := getField(v, "name").(string)
+		if len(name) == 0 {
+			return errors.New("volume name is required")
+		}
+		volumes[name] = true
+	}
+
+	containers, _ := getField(podSpec, "containers").([]interface{})
+	if len(containers) == 0 {
+		return errors.New("spec.template.spec.containers is required")
+	}
+	names := make(map[string]bool)
+	for _, c := range containers {
+		name, _ := getField(c, "name").(string)
+		if false == dnsLabel.MatchString(name) || names[name] {
+			return fmt.Errorf("invalid or duplicate container name %q", name)
+		}
+		names[name] = true
+		if image, _ := getField(c, "image").(string); len(image) == 0 {
+			return fmt.Errorf("container %s: image is required", name)
+		}
+		err := checkResources(quantityField(c, "requests", "cpu"), quantityField(c, "limits", "cpu"),
+			quantityField(c, "requests", "memory"), quantityField(c, "limits", "memory"))
+		if err != nil {
+			return fmt.Errorf("container %s: %s", name, err.Error())
+		}
+		mounts, _ := getField(c, "volumeMounts").([]interface{})
+		for _, m := range mounts {
+			if v, _ := getField(m, "name").(string); false == volumes[v] {
+				return fmt.Errorf("container %s: volume %q not found", name, v)
+			}
+		}
+	}
+	return nil
+}
+
+// 数量可以写成数字或字符串
+func quantityField(c interface{}, keys ...string) string {
+	switch v := getField(c, append([]string{"resources"}, keys...)...).(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// data 的值必须是字符串，数字、布尔值需要加引号
+func validateConfigMap(obj map[string]interface{}) error {
+	data, _ := obj["data"].(map[string]interface{})
+	for k, v := range data {
+		if false == configKey.MatchString(k) {
+			return fmt.Errorf("invalid data key %s", k)
+		}
+		if _, ok := v.(string); false == ok {
+			return fmt.Errorf("data %s must be a string, quote the value", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package kubeapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// core/v1 Pod 中用到的字段
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name  string `json:"name"`
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string            `json:"phase"`
+		Reason            string            `json:"reason"`
+		PodIP             string            `json:"podIP"`
+		HostIP            string            `json:"hostIP"`
+		StartTime         *time.Time        `json:"startTime"`
+		ContainerStatuses []containerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type ObjectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	UID               string            `json:"uid,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp,omitempty"`
+	OwnerReferences   []struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"ownerReferences,omitempty"`
+}
+
+type containerStatus struct {
+	Name         string `json:"name"`
+	Ready        bool   `json:"ready"`
+	RestartCount int    `json:"restartCount"`
+	Image        string `json:"image"`
+	ContainerID  string `json:"containerID"`
+	State        struct {
+		Running *struct {
+			StartedAt *time.Time `json:"startedAt"`
+		} `json:"running"`
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+		Terminated *struct {
+			ExitCode int    `json:"exitCode"`
+			Reason   string `json:"reason"`
+		} `json:"terminated"`
+	} `json:"state"`
+}
+
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// container status/list 输出的结构化状态，Metrics 取不到时为 nil
+type PodStatus struct {
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"`
+	Node       string            `json:"node"`
+	Phase      string            `json:"phase"`
+	Status     string            `json:"status"`
+	IP         string            `json:"ip"`
+	Ready      string            `json:"ready"`
+	Restarts   int               `json:"restarts"`
+	StartTime  *time.Time        `json:"startTime,omitempty"`
+	Containers []ContainerStatus `json:"containers"`
+	Metrics    *PodMetrics       `json:"metrics,omitempty"`
+}
+
+type ContainerStatus struct {
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	Image    string `json:"image"`
+	Ready    bool   `json:"ready"`
+	Restarts int    `json:"restarts"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// CPU 单位为 millicore，内存、块设备读写为字节，Source 为 metrics-server、kubelet 或 docker，
+// 只有 docker 统计有块设备读写
+type PodMetrics struct {
+	CPU        int64              `json:"cpu"`
+	Memory     int64              `json:"memory"`
+	BlockRead  int64              `json:"blockRead"`
+	BlockWrite int64              `json:"blockWrite"`
+	Source     string             `json:"source"`
+	Containers []ContainerMetrics `json:"containers,omitempty"`
+}
+
+type ContainerMetrics struct {
+	Name       string `json:"name"`
+	CPU        int64  `json:"cpu"`
+	Memory     int64  `json:"memory"`
+	BlockRead  int64  `json:"blockRead"`
+	BlockWrite int64  `json:"blockWrite"`
+}
+
+// core/v1 Node 中用到的字段，容量为 resource.Quantity 字符串
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   struct {
+		Capacity    map[string]string `json:"capacity"`
+		Allocatable map[string]string `json:"allocatable"`
+	} `json:"status"`
+}
+
+// metrics.k8s.io/v1beta1 PodMetrics
+type podMetricsItem struct {
+	Metadata   ObjectMeta `json:"metadata"`
+	Containers []struct {
+		Name  string            `json:"name"`
+		Usage map[string]string `json:"usage"`
+	} `json:"containers"`
+}
+
+// kubelet /stats/summary 中用到的字段
+type Summary struct {
+	Node struct {
+		NodeName string   `json:"nodeName"`
+		CPU      cpuStats `json:"cpu"`
+		Memory   memStats `json:"memory"`
+	} `json:"node"`
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"podRef"`
+		CPU        cpuStats `json:"cpu"`
+		Memory     memStats `json:"memory"`
+		Containers []struct {
+			Name   string   `json:"name"`
+			CPU    cpuStats `json:"cpu"`
+			Memory memStats `json:"memory"`
+		} `json:"containers"`
+	} `json:"pods"`
+}
+
+type cpuStats struct {
+	UsageNanoCores *int64 `json:"usageNanoCores"`
+}
+
+type memStats struct {
+	WorkingSetBytes *int64 `json:"workingSetBytes"`
+}
+
+func (c *Client) podPath(ns, name string) string {
+	if len(ns) == 0 {
+		ns = c.Namespace
+	}
+	return "/api/v1/namespaces/" + ns + "/pods/" + name
+}
+
+func (c *Client) GetPod(ns, name string) (*Pod, error) {
+	pod := &Pod{}
+	err := c.Get(c.podPath(ns, name), pod)
+	if err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// ns 为空时为客户端默认命名空间，node 不为空时只列出该节点上的 pod
+func (c *Client) ListPods(ns, node, labelSelector string) ([]Pod, error) {
+	if len(ns) == 0 {
+		ns = c.Namespace
+	}
+	query := url.Values{}
+	if len(node) > 0 {
+		query.Set("fieldSelector", "spec.nodeName="+node)
+	}
+	if len(labelSelector) > 0 {
+		query.Set("labelSelector", labelSelector)
+	}
+	path := "/api/v1/namespaces/" + ns + "/pods"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	lst := PodList{}
+	err := c.Get(path, &lst)
+	return lst.Items, err
+}
+
+// 所有命名空间中运行在 node 上的 pod
+func (c *Client) ListNodePods(node string) ([]Pod, error) {
+	query := url.Values{"fieldSelector": {"spec.nodeName=" + node}}
+	lst := PodList{}
+	err := c.Get("/api/v1/pods?"+query.Encode(), &lst)
+	return lst.Items, err
+}
+
+func (c *Client) GetNode(name string) (*Node, error) {
+	node := &Node{}
+	err := c.Get("/api/v1/nodes/"+name, node)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// 与 kubectl get pod 的 STATUS 列规则相同：优先显示容器的等待、退出原因
+func GetPodStatus(pod *Pod) *PodStatus {
+	st := &PodStatus{
+		Name:      pod.Metadata.Name,
+		Namespace: pod.Metadata.Namespace,
+		Node:      pod.Spec.NodeName,
+		Phase:     pod.Status.Phase,
+		Status:    pod.Status.Phase,
+		IP:        pod.Status.PodIP,
+		StartTime: pod.Status.StartTime,
+	}
+	if len(pod.Status.Reason) > 0 {
+		st.Status = pod.Status.Reason
+	}
+
+	ready := 0
+	for _, v := range pod.Status.ContainerStatuses {
+		cs := ContainerStatus{
+			Name:     v.Name,
+			Image:    v.Image,
+			Ready:    v.Ready,
+			Restarts: v.RestartCount,
+		}
+		if i := strings.Index(v.ContainerID, "://"); i >= 0 {
+			cs.ID = v.ContainerID[i+3:]
+		}
+		switch {
+		case v.State.Running != nil:
+			cs.State = "Running"
+		case v.State.Waiting != nil:
+			cs.State = "Waiting"
+			cs.Reason = v.State.Waiting.Reason
+		case v.State.Terminated != nil:
+			cs.State = "Terminated"
+			cs.Reason = v.State.Terminated.Reason
+			if len(cs.Reason) == 0 {
+				cs.Reason = "ExitCode:" + strconv.Itoa(v.State.Terminated.ExitCode)
+			}
+		}
+		if len(cs.Reason) > 0 && cs.Reason != "Completed" {
+			st.Status = cs.Reason
+		}
+		if v.Ready {
+			ready++
+		}
+		st.Restarts += v.RestartCount
+		st.Containers = append(st.Containers, cs)
+	}
+	st.Ready = fmt.Sprintf("%d/%d", ready, len(pod.Spec.Containers))
+	if pod.Metadata.DeletionTimestamp != nil {
+		st.Status = "Terminating"
+	}
+	return st
+}
+
+// 先查 metrics-server，未部署时通过 apiserver 代理读取 kubelet summary
+func (c *Client) GetPodMetrics(pod *Pod) (*PodMetrics, error) {
+	m, err := c.getMetricsServer(pod)
+	if err == nil {
+		return m, nil
+	}
+	if len(pod.Spec.NodeName) == 0 {
+		return nil, err
+	}
+	summary, err := c.GetSummary(pod.Spec.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	m = summary.PodMetrics(pod.Metadata.Namespace, pod.Metadata.Name)
+	if m == nil {
+		return nil, errors.New("pod not found in kubelet summary")
+	}
+	return m, nil
+}
+
+func (c *Client) getMetricsServer(pod *Pod) (*PodMetrics, error) {
+	item := podMetricsItem{}
+	err := c.Get("/apis/metrics.k8s.io/v1beta1/namespaces/"+pod.Metadata.Namespace+"/pods/"+pod.Metadata.Name, &item)
+	if err != nil {
+		return nil, err
+	}
+	m := &PodMetrics{Source: "metrics-server"}
+	for _, v := range item.Containers {
+		cm := ContainerMetrics{Name: v.Name}
+		cm.CPU = ParseQuantity(v.Usage["cpu"], true)
+		cm.Memory = ParseQuantity(v.Usage["memory"], false)
+		m.CPU += cm.CPU
+		m.Memory += cm.Memory
+		m.Containers = append(m.Containers, cm)
+	}
+	return m, nil
+}
+
+func (c *Client) GetSummary(node string) (*Summary, error) {
+	summary := &Summary{}
+	err := c.Get("/api/v1/nodes/"+node+"/proxy/stats/summary", summary)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func (s *Summary) PodMetrics(ns, name string) *PodMetrics {
+	for _, p := range s.Pods {
+		if p.PodRef.Name != name || p.PodRef.Namespace != ns {
+			continue
+		}
+		m := &PodMetrics{Source: "kubelet", CPU: nanoToMilli(p.CPU.UsageNanoCores), Memory: value(p.Memory.WorkingSetBytes)}
+		for _, v := range p.Containers {
+			cm := ContainerMetrics{Name: v.Name, CPU: nanoToMilli(v.CPU.UsageNanoCores), Memory: value(v.Memory.WorkingSetBytes)}
+			m.Containers = append(m.Containers, cm)
+		}
+		return m
+	}
+	return nil
+}
+
+// 节点的 CPU（millicore）和内存（字节）使用
+func (s *Summary) NodeUsage() (int64, int64) {
+	return nanoToMilli(s.Node.CPU.UsageNanoCores), value(s.Node.Memory.WorkingSetBytes)
+}
+
+func nanoToMilli(v *int64) int64 {
+	return value(v) / 1000000
+}
+
+func value(v *int64) int64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// resource.Quantity 字符串，milli 为 true 时返回千分之一单位（CPU 的 millicore）
+func ParseQuantity(str string, milli bool) int64 {
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return 0
+	}
+	suffixes := []struct {
+		suffix string
+		num    float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"n", 1e-9}, {"u", 1e-6}, {"m", 1e-3}, {"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	mul := 1.0
+	for _, v := range suffixes {
+		if strings.HasSuffix(str, v.suffix) {
+			str = strings.TrimSuffix(str, v.suffix)
+			mul = v.num
+			break
+		}
+	}
+	num, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0
+	}
+	if milli {
+		mul *= 1000
+	}
+	return int64(num*mul + 0.5)
+}
@@ -0,0 +1,146 @@
+package kubeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// exec 使用 websocket 的 v4.channel.k8s.io 协议，每个消息第一个字节为通道号
+const execProtocol string = "v4.channel.k8s.io"
+
+const (
+	channelStdout byte = 1
+	channelStderr byte = 2
+	channelError  byte = 3
+)
+
+type LogOptions struct {
+	Container string
+	Follow    bool
+	Since     time.Duration
+	Tail      int
+}
+
+// 返回日志流，Follow 时直到 pod 退出或调用者关闭才结束
+func (c *Client) Logs(ns, pod string, opt *LogOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	if len(opt.Container) > 0 {
+		query.Set("container", opt.Container)
+	}
+	if opt.Follow {
+		query.Set("follow", "true")
+	}
+	if opt.Since > 0 {
+		query.Set("sinceSeconds", strconv.FormatInt(int64(opt.Since.Seconds()), 10))
+	}
+	if opt.Tail > 0 {
+		query.Set("tailLines", strconv.Itoa(opt.Tail))
+	}
+
+	req, err := c.newRequest("GET", c.podPath(ns, pod)+"/log?"+query.Encode(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := c.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return nil, statusError(rsp.StatusCode, data)
+	}
+	return rsp.Body, nil
+}
+
+// 在容器中执行命令，不带标准输入，返回命令的退出码
+func (c *Client) Exec(ns, pod, container string, cmd []string, stdout, stderr io.Writer) (int, error) {
+	query := url.Values{"command": cmd, "stdout": {"true"}, "stderr": {"true"}}
+	if len(container) > 0 {
+		query.Set("container", container)
+	}
+	u := c.Server + c.podPath(ns, pod) + "/exec?" + query.Encode()
+	u = "ws" + strings.TrimPrefix(u, "http")
+
+	header := http.Header{}
+	if len(c.token) > 0 {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	dialer := websocket.Dialer{
+		TLSClientConfig:  c.tls,
+		Subprotocols:     []string{execProtocol},
+		HandshakeTimeout: defTimeout,
+	}
+	ws, rsp, err := dialer.Dial(u, header)
+	if err != nil {
+		if rsp != nil && rsp.StatusCode/100 != 2 {
+			data, _ := ioutil.ReadAll(rsp.Body)
+			return -1, statusError(rsp.StatusCode, data)
+		}
+		return -1, err
+	}
+	defer ws.Close()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, nil
+			}
+			return -1, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case channelStdout:
+			stdout.Write(data[1:])
+		case channelStderr:
+			stderr.Write(data[1:])
+		case channelError:
+			return execResult(data[1:])
+		}
+	}
+}
+
+// 错误通道中为 metav1.Status，非零退出码在 details.causes 的 ExitCode 中
+func execResult(data []byte) (int, error) {
+	st := struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Reason  string `json:"reason"`
+		Details struct {
+			Causes []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"causes"`
+		} `json:"details"`
+	}{}
+	err := json.Unmarshal(data, &st)
+	if err != nil {
+		return -1, err
+	}
+	if st.Status == "Success" {
+		return 0, nil
+	}
+	if st.Reason == "NonZeroExitCode" {
+		for _, v := range st.Details.Causes {
+			if v.Reason == "ExitCode" {
+				code, err := strconv.Atoi(v.Message)
+				if err == nil {
+					return code, nil
+				}
+			}
+		}
+	}
+	return -1, errors.New(st.Message)
+}
@@ -0,0 +1,289 @@
+package kubeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindDeployment string = "Deployment"
+const KindDaemonSet string = "DaemonSet"
+
+const restartedAtAnnotation string = "kubectl.kubernetes.io/restartedAt"
+const revisionAnnotation string = "deployment.kubernetes.io/revision"
+
+// apps/v1 Deployment、DaemonSet 共用的字段，Kind 由查询的资源类型填写
+type Workload struct {
+	Kind     string     `json:"kind"`
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Replicas *int `json:"replicas"`
+		Selector struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration     int64 `json:"observedGeneration"`
+		Replicas               int   `json:"replicas"`
+		UpdatedReplicas        int   `json:"updatedReplicas"`
+		AvailableReplicas      int   `json:"availableReplicas"`
+		DesiredNumberScheduled int   `json:"desiredNumberScheduled"`
+		UpdatedNumberScheduled int   `json:"updatedNumberScheduled"`
+		NumberAvailable        int   `json:"numberAvailable"`
+	} `json:"status"`
+}
+
+// rollout status 的结构化结果，Message 与 kubectl rollout status 的输出相同
+type RolloutStatus struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Done      bool   `json:"done"`
+	Desired   int    `json:"desired"`
+	Updated   int    `json:"updated"`
+	Available int    `json:"available"`
+	Message   string `json:"message"`
+}
+
+type replicaSet struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Template map[string]interface{} `json:"template"`
+	} `json:"spec"`
+}
+
+type controllerRevision struct {
+	Metadata ObjectMeta      `json:"metadata"`
+	Data     json.RawMessage `json:"data"`
+	Revision int64           `json:"revision"`
+}
+
+func (w *Workload) path() string {
+	return "/apis/apps/v1/namespaces/" + w.Metadata.Namespace + "/" + strings.ToLower(w.Kind) + "s/" + w.Metadata.Name
+}
+
+func (w *Workload) LabelSelector() string {
+	var lst []string
+	for k, v := range w.Spec.Selector.MatchLabels {
+		lst = append(lst, k+"="+v)
+	}
+	sort.Strings(lst)
+	return strings.Join(lst, ",")
+}
+
+func (w *Workload) isOwner(meta *ObjectMeta) bool {
+	for _, v := range meta.OwnerReferences {
+		if v.Kind == w.Kind && v.Name == w.Metadata.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// 应用名依次按 Deployment、DaemonSet 查找，都不存在时返回 NotFound 错误
+func (c *Client) GetWorkload(ns, name string) (*Workload, error) {
+	if len(ns) == 0 {
+		ns = c.Namespace
+	}
+	var err error
+	for _, kind := range []string{KindDeployment, KindDaemonSet} {
+		w := &Workload{}
+		err = c.Get("/apis/apps/v1/namespaces/"+ns+"/"+strings.ToLower(kind)+"s/"+name, w)
+		if err == nil {
+			w.Kind = kind
+			return w, nil
+		}
+		if false == IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) WorkloadPods(w *Workload) ([]Pod, error) {
+	return c.ListPods(w.Metadata.Namespace, "", w.LabelSelector())
+}
+
+// 与 kubectl rollout restart 相同，修改 pod 模板的注解触发滚动重启，返回注解中的时间
+func (c *Client) Restart(w *Workload) (string, error) {
+	now := time.Now().Format(time.RFC3339)
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{restartedAtAnnotation: now},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+	err = c.DoRaw("PATCH", w.path(), strings.NewReader(string(data)), "application/strategic-merge-patch+json", nil)
+	return now, err
+}
+
+func (c *Client) DeletePod(ns, name string) error {
+	return c.Do("DELETE", c.podPath(ns, name), nil, nil)
+}
+
+// 重新查询 w 并按 kubectl rollout status 的规则判断是否完成
+func (c *Client) GetRolloutStatus(w *Workload) (*RolloutStatus, error) {
+	cur := &Workload{}
+	err := c.Get(w.path(), cur)
+	if err != nil {
+		return nil, err
+	}
+	st := &RolloutStatus{Kind: w.Kind, Name: w.Metadata.Name}
+
+	if w.Kind == KindDaemonSet {
+		st.Desired = cur.Status.DesiredNumberScheduled
+		st.Updated = cur.Status.UpdatedNumberScheduled
+		st.Available = cur.Status.NumberAvailable
+		switch {
+		case cur.Metadata.Generation > cur.Status.ObservedGeneration:
+			st.Message = "Waiting for daemon set spec update to be observed..."
+		case st.Updated < st.Desired:
+			st.Message = fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d out of %d new pods have been updated...", st.Name, st.Updated, st.Desired)
+		case st.Available < st.Desired:
+			st.Message = fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d of %d updated pods are available...", st.Name, st.Available, st.Desired)
+		default:
+			st.Done = true
+			st.Message = fmt.Sprintf("daemon set %q successfully rolled out", st.Name)
+		}
+		return st, nil
+	}
+
+	st.Desired = 1
+	if cur.Spec.Replicas != nil {
+		st.Desired = *cur.Spec.Replicas
+	}
+	st.Updated = cur.Status.UpdatedReplicas
+	st.Available = cur.Status.AvailableReplicas
+	switch {
+	case cur.Metadata.Generation > cur.Status.ObservedGeneration:
+		st.Message = "Waiting for deployment spec update to be observed..."
+	case st.Updated < st.Desired:
+		st.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated...", st.Name, st.Updated, st.Desired)
+	case cur.Status.Replicas > st.Updated:
+		st.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination...", st.Name, cur.Status.Replicas-st.Updated)
+	case st.Available < st.Updated:
+		st.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available...", st.Name, st.Available, st.Updated)
+	default:
+		st.Done = true
+		st.Message = fmt.Sprintf("deployment %q successfully rolled out", st.Name)
+	}
+	return st, nil
+}
+
+// 回滚到 revision，0 为上一个版本，返回回滚到的版本号
+func (c *Client) Undo(w *Workload, revision int64) (int64, error) {
+	if w.Kind == KindDaemonSet {
+		return c.undoDaemonSet(w, revision)
+	}
+	return c.undoDeployment(w, revision)
+}
+
+// Deployment 的历史版本为 ReplicaSet，版本号在 deployment.kubernetes.io/revision 注解中
+func (c *Client) undoDeployment(w *Workload, revision int64) (int64, error) {
+	lst := struct {
+		Items []replicaSet `json:"items"`
+	}{}
+	query := url.Values{"labelSelector": {w.LabelSelector()}}
+	err := c.Get("/apis/apps/v1/namespaces/"+w.Metadata.Namespace+"/replicasets?"+query.Encode(), &lst)
+	if err != nil {
+		return 0, err
+	}
+
+	revisions := make(map[int64]*replicaSet)
+	var nums []int64
+	for k := range lst.Items {
+		rs := &lst.Items[k]
+		if false == w.isOwner(&rs.Metadata) {
+			continue
+		}
+		num, err := strconv.ParseInt(rs.Metadata.Annotations[revisionAnnotation], 10, 64)
+		if err != nil {
+			continue
+		}
+		revisions[num] = rs
+		nums = append(nums, num)
+	}
+	revision, err = selectRevision(nums, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	// pod-template-hash 由 ReplicaSet 控制器添加，不能带回 Deployment
+	tmpl := revisions[revision].Spec.Template
+	if meta, ok := tmpl["metadata"].(map[string]interface{}); ok {
+		if labels, ok := meta["labels"].(map[string]interface{}); ok {
+			delete(labels, "pod-template-hash")
+		}
+	}
+	patch := []map[string]interface{}{{"op": "replace", "path": "/spec/template", "value": tmpl}}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return 0, err
+	}
+	err = c.DoRaw("PATCH", w.path(), strings.NewReader(string(data)), "application/json-patch+json", nil)
+	return revision, err
+}
+
+// DaemonSet 的历史版本为 ControllerRevision，data 即为 pod 模板的 strategic merge patch
+func (c *Client) undoDaemonSet(w *Workload, revision int64) (int64, error) {
+	lst := struct {
+		Items []controllerRevision `json:"items"`
+	}{}
+	query := url.Values{"labelSelector": {w.LabelSelector()}}
+	err := c.Get("/apis/apps/v1/namespaces/"+w.Metadata.Namespace+"/controllerrevisions?"+query.Encode(), &lst)
+	if err != nil {
+		return 0, err
+	}
+
+	revisions := make(map[int64]*controllerRevision)
+	var nums []int64
+	for k := range lst.Items {
+		cr := &lst.Items[k]
+		if w.isOwner(&cr.Metadata) {
+			revisions[cr.Revision] = cr
+			nums = append(nums, cr.Revision)
+		}
+	}
+	revision, err = selectRevision(nums, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	data := revisions[revision].Data
+	err = c.DoRaw("PATCH", w.path(), strings.NewReader(string(data)), "application/strategic-merge-patch+json", nil)
+	return revision, err
+}
+
+// 最大的版本号为当前版本，revision 为 0 时选择当前版本之前的一个
+func selectRevision(nums []int64, revision int64) (int64, error) {
+	if len(nums) == 0 {
+		return 0, errors.New("no rollout history found")
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] > nums[j] })
+	if revision == 0 {
+		if len(nums) < 2 {
+			return 0, errors.New("no previous revision to roll back to")
+		}
+		return nums[1], nil
+	}
+	if revision == nums[0] {
+		return 0, fmt.Errorf("revision %d is the current revision", revision)
+	}
+	for _, v := range nums {
+		if v == revision {
+			return revision, nil
+		}
+	}
+	return 0, fmt.Errorf("revision %d not found", revision)
+}
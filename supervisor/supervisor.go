@@ -0,0 +1,292 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 应用启动描述，Args 为空时不带参数启动
+type Proc struct {
+	Name string
+	Path string
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// monitor.cfg 中 appmonitor 与 appctl-daemon 共用的应用字段
+type Item struct {
+	Pid       int    `json:"pid"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Cmd       int    `json:"cmd"`
+	Status    int    `json:"status"`
+	Enable    int    `json:"enable"`
+	StartTime int64  `json:"starttime"`
+	Param     string `json:"param"`
+}
+
+type List struct {
+	Items []Item `json:"items"`
+}
+
+// 与 appctl-daemon 的 APP_CMD_xxx、APP_STATUS_xxx 取值一致
+const (
+	CmdStart      int = 1
+	CmdStop       int = 2
+	StatusInstall int = 1
+	StatusRunning int = 2
+	StatusStop    int = 3
+)
+
+var ErrNotStart = errors.New("process not start")
+
+func Command(p *Proc) *exec.Cmd {
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Dir = p.Dir
+	if len(p.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.Env...)
+	}
+	return cmd
+}
+
+// 启动后由独立协程 Wait，进程退出后不会残留僵尸
+func Start(cmd *exec.Cmd) (int, error) {
+	if cmd == nil {
+		return 0, ErrNotStart
+	}
+	err := cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
+
+// 0,1,2为系统进程
+func IsAlive(pid int) bool {
+	if pid < 3 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		return true
+	}
+	return false
+}
+
+// 回收已退出的子进程，返回 true 表示 pid 已退出
+func Reap(pid int) bool {
+	if pid < 3 {
+		return false
+	}
+	var ws syscall.WaitStatus
+	wpid, _ := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	return wpid == pid
+}
+
+// pid 存活且可执行文件为 path；脚本应用的 exe 为解释器，再从 cmdline 中匹配
+func IsRunning(pid int, path string) bool {
+	if false == IsAlive(pid) {
+		return false
+	}
+	exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if exe == path {
+		return true
+	}
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return false
+	}
+	for _, v := range strings.Split(string(data), "\x00") {
+		if v == path {
+			return true
+		}
+	}
+	return false
+}
+
+// 先 SIGTERM，grace 内未退出再 SIGKILL，返回实际耗时
+func Stop(pid int, grace time.Duration) time.Duration {
+	start := time.Now()
+	if false == IsAlive(pid) {
+		return 0
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	for IsAlive(pid) && false == Reap(pid) && time.Since(start) < grace {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if IsAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return time.Since(start)
+}
+
+// 当前进程的直接子进程
+func ChildPids() []int {
+	var lst []int
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return lst
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, v := range dirs {
+		pid, err := strconv.Atoi(v.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile("/proc/" + v.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// comm 可能含空格，从最后一个 ')' 之后取字段：state ppid ...
+		str := string(data)
+		fields := strings.Fields(str[strings.LastIndex(str, ")")+1:])
+		if len(fields) > 1 && fields[1] == self {
+			lst = append(lst, pid)
+		}
+	}
+	return lst
+}
+
+// 回收列表中已退出的进程，返回仍在运行的
+func ReapList(pids []int) []int {
+	var lst []int
+	for _, pid := range pids {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		if wpid == 0 && err == nil {
+			lst = append(lst, pid)
+		}
+	}
+	return lst
+}
+
+func ReadState(fn string, v interface{}) error {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// 先写临时文件再 rename，掉电时不会留下半个 monitor.cfg
+func WriteState(fn string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp")
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// appmonitor 旧版 monitor.cfg 只有 pid/name/path/param，没有 enable，全部应用都需要拉起
+func IsLegacy(data []byte) bool {
+	lst := struct {
+		Items []map[string]json.RawMessage `json:"items"`
+	}{}
+	if json.Unmarshal(data, &lst) != nil || len(lst.Items) == 0 {
+		return false
+	}
+	for _, v := range lst.Items {
+		if _, ok := v["enable"]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// monitor.cfg 与 appctl-daemon 共用，按 name 只修改 items 中的 fields 字段，
+// 全局配置、其它应用字段和文件中已不存在的应用保持原样
+func UpdateList(fn string, items []Item, fields ...string) error {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]json.RawMessage)
+	err = json.Unmarshal(content, &doc)
+	if err != nil {
+		return err
+	}
+	var lst []map[string]json.RawMessage
+	if data, ok := doc["items"]; ok {
+		err = json.Unmarshal(data, &lst)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k := range items {
+		data, err := json.Marshal(&items[k])
+		if err != nil {
+			return err
+		}
+		val := make(map[string]json.RawMessage)
+		json.Unmarshal(data, &val)
+		for _, v := range lst {
+			name := ""
+			json.Unmarshal(v["name"], &name)
+			if name != items[k].Name {
+				continue
+			}
+			for _, field := range fields {
+				v[field] = val[field]
+			}
+		}
+	}
+
+	data, err := json.Marshal(lst)
+	if err != nil {
+		return err
+	}
+	doc["items"] = data
+	return WriteState(fn, doc)
+}
+
+// 读取 monitor.cfg，旧格式转换为新格式并先备份为 monitor.cfg.v1，返回是否做了迁移
+func LoadList(fn string) (List, bool, error) {
+	lst := List{}
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return lst, false, err
+	}
+	err = json.Unmarshal(content, &lst)
+	if err != nil {
+		return lst, false, err
+	}
+	if false == IsLegacy(content) {
+		return lst, false, nil
+	}
+
+	for k := range lst.Items {
+		lst.Items[k].Enable = 1
+		lst.Items[k].Cmd = CmdStart
+		lst.Items[k].Status = StatusStop
+	}
+	err = ioutil.WriteFile(fn+".v1", content, 0644)
+	if err == nil {
+		err = UpdateList(fn, lst.Items, "enable", "cmd", "status")
+	}
+	return lst, true, err
+}
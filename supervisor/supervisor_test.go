@@ -0,0 +1,294 @@
+package supervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const legacyCfg string = `{"items":[{"pid":0,"name":"app1","path":"/usr/local/app1/app1","param":"-d"},{"pid":12,"name":"app2","path":"/usr/local/app2/app2","param":""}]}`
+
+// appctl-daemon 写入的 monitor.cfg，带有 appmonitor 不认识的全局和应用字段
+const daemonCfg string = `{"cputhreshold":80,"shutdown":"detach","items":[` +
+	`{"pid":0,"name":"app1","path":"/usr/local/app1/app1","cmd":1,"status":3,"enable":1,"starttime":0,"param":"","version":"SV01.002","hash":"abc","memthreshold":70},` +
+	`{"pid":0,"name":"app2","path":"/usr/local/app2/app2","cmd":2,"status":3,"enable":0,"starttime":0,"param":"","url":"http://host/app2.tar.gz"}]}`
+
+func writeTempCfg(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "monitor.cfg")
+	err = ioutil.WriteFile(fn, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func readCfg(t *testing.T, fn string) map[string]interface{} {
+	doc := make(map[string]interface{})
+	err := ReadState(fn, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func cfgItem(doc map[string]interface{}, k int) map[string]interface{} {
+	return doc["items"].([]interface{})[k].(map[string]interface{})
+}
+
+func TestIsLegacy(t *testing.T) {
+	cases := []struct {
+		data   string
+		legacy bool
+	}{
+		{legacyCfg, true},
+		{daemonCfg, false},
+		{`{"items":[]}`, false},
+		{`{}`, false},
+		{`not json`, false},
+		{`{"items":[{"name":"a","enable":0},{"name":"b"}]}`, false},
+	}
+	for _, v := range cases {
+		if IsLegacy([]byte(v.data)) != v.legacy {
+			t.Errorf("IsLegacy(%s) = %v", v.data, !v.legacy)
+		}
+	}
+}
+
+func TestLoadListMigrate(t *testing.T) {
+	fn := writeTempCfg(t, legacyCfg)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	lst, migrated, err := LoadList(fn)
+	if err != nil || !migrated {
+		t.Fatalf("LoadList migrated=%v, err=%v", migrated, err)
+	}
+	if len(lst.Items) != 2 {
+		t.Fatalf("items %d", len(lst.Items))
+	}
+	for _, v := range lst.Items {
+		if v.Enable != 1 || v.Cmd != CmdStart || v.Status != StatusStop {
+			t.Errorf("%s enable=%d cmd=%d status=%d", v.Name, v.Enable, v.Cmd, v.Status)
+		}
+	}
+	if lst.Items[0].Param != "-d" {
+		t.Errorf("param %q", lst.Items[0].Param)
+	}
+
+	backup, err := ioutil.ReadFile(fn + ".v1")
+	if err != nil || string(backup) != legacyCfg {
+		t.Fatalf("backup %q, err=%v", backup, err)
+	}
+	content, _ := ioutil.ReadFile(fn)
+	if IsLegacy(content) {
+		t.Fatal("monitor.cfg still legacy after migrate")
+	}
+
+	_, migrated, err = LoadList(fn)
+	if err != nil || migrated {
+		t.Fatalf("second LoadList migrated=%v, err=%v", migrated, err)
+	}
+}
+
+func TestLoadListCurrent(t *testing.T) {
+	fn := writeTempCfg(t, daemonCfg)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	lst, migrated, err := LoadList(fn)
+	if err != nil || migrated {
+		t.Fatalf("LoadList migrated=%v, err=%v", migrated, err)
+	}
+	if len(lst.Items) != 2 || lst.Items[1].Enable != 0 || lst.Items[1].Cmd != CmdStop {
+		t.Fatalf("items %+v", lst.Items)
+	}
+	if _, err := os.Stat(fn + ".v1"); false == os.IsNotExist(err) {
+		t.Fatal("backup written for current format")
+	}
+}
+
+func TestUpdateListKeepsUnknownFields(t *testing.T) {
+	fn := writeTempCfg(t, daemonCfg)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	item := Item{Pid: 1234, Name: "app1", Status: StatusRunning, StartTime: 99, Enable: 0, Path: "/changed"}
+	gone := Item{Pid: 5678, Name: "removed", Status: StatusRunning}
+	err := UpdateList(fn, []Item{item, gone}, "pid", "status", "starttime")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := readCfg(t, fn)
+	if doc["cputhreshold"] != 80.0 || doc["shutdown"] != "detach" {
+		t.Errorf("global fields lost: %v", doc)
+	}
+	items := doc["items"].([]interface{})
+	if len(items) != 2 {
+		t.Fatalf("items %d", len(items))
+	}
+	app1 := cfgItem(doc, 0)
+	if app1["pid"] != 1234.0 || app1["status"] != float64(StatusRunning) || app1["starttime"] != 99.0 {
+		t.Errorf("runtime fields not updated: %v", app1)
+	}
+	if app1["enable"] != 1.0 || app1["path"] != "/usr/local/app1/app1" {
+		t.Errorf("fields not in list changed: %v", app1)
+	}
+	if app1["version"] != "SV01.002" || app1["hash"] != "abc" || app1["memthreshold"] != 70.0 {
+		t.Errorf("daemon fields lost: %v", app1)
+	}
+	if app2 := cfgItem(doc, 1); app2["pid"] != 0.0 || app2["url"] != "http://host/app2.tar.gz" {
+		t.Errorf("other item changed: %v", app2)
+	}
+}
+
+func TestIsRunning(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip(err)
+	}
+	sleep, _ = filepath.EvalSymlinks(sleep)
+	cmd := exec.Command(sleep, "10")
+	pid, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	if !IsAlive(pid) {
+		t.Fatal("IsAlive false after start")
+	}
+	exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if !IsRunning(pid, exe) {
+		t.Errorf("IsRunning(%d, %s) false", pid, exe)
+	}
+	if IsRunning(pid, "/usr/local/other/app") {
+		t.Error("IsRunning true for other path")
+	}
+	if IsRunning(0, exe) || IsAlive(1) || IsAlive(2) {
+		t.Error("system pid reported as app")
+	}
+}
+
+// 脚本应用的 exe 为 /bin/sh，从 cmdline 匹配脚本路径
+func TestIsRunningScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "app.sh")
+	// 最后一条命令会被 sh 直接 exec，sleep 后再加一条命令让 sh 保持运行
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 10\nexit 0\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := Command(&Proc{Name: "app", Path: script, Dir: dir})
+	pid, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	// 刚启动时内核可能还没有填好 cmdline，稍等片刻再判断
+	for i := 0; i < 50 && !IsRunning(pid, script); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !IsRunning(pid, script) {
+		t.Errorf("IsRunning(%d, %s) false", pid, script)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	if _, err := Start(nil); err != ErrNotStart {
+		t.Errorf("Start(nil) = %v", err)
+	}
+	if _, err := Start(exec.Command("/nonexistent/app")); err == nil {
+		t.Error("Start nonexistent succeeded")
+	}
+
+	cmd := Command(&Proc{Name: "sleep", Path: "/bin/sh", Args: []string{"-c", "sleep 10"}})
+	pid, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost := Stop(pid, 5*time.Second)
+	if cost >= 5*time.Second {
+		t.Errorf("Stop waited %s for SIGTERM", cost)
+	}
+	waitExit(t, pid)
+	if Stop(pid, time.Second) != 0 {
+		t.Error("Stop of exited pid waited")
+	}
+}
+
+// 忽略 SIGTERM 的进程在 grace 后被 SIGKILL
+func TestStopKill(t *testing.T) {
+	cmd := Command(&Proc{Name: "trap", Path: "/bin/sh", Args: []string{"-c", "trap '' TERM; while true; do sleep 1; done"}})
+	pid, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cost := Stop(pid, 500*time.Millisecond)
+	if cost < 500*time.Millisecond {
+		t.Errorf("Stop returned after %s, before grace", cost)
+	}
+	waitExit(t, pid)
+}
+
+// 不经过 Start 启动的子进程没有 Wait，由 Reap 回收
+func TestReap(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 0")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	deadline := time.Now().Add(5 * time.Second)
+	for false == Reap(pid) {
+		if time.Now().After(deadline) {
+			t.Fatal("Reap not true after exit")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if IsAlive(pid) {
+		t.Error("IsAlive true after reap")
+	}
+	if Reap(0) || Reap(pid) {
+		t.Error("Reap true for invalid or reaped pid")
+	}
+
+	cmd = exec.Command("/bin/sh", "-c", "sleep 10")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := cmd.Process.Pid
+	if lst := ReapList([]int{running}); len(lst) != 1 {
+		t.Errorf("ReapList removed running pid: %v", lst)
+	}
+	cmd.Process.Kill()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(ReapList([]int{running})) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ReapList kept exited pid")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func waitExit(t *testing.T, pid int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for IsAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pid %d still alive", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
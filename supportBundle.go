@@ -0,0 +1,461 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const help string = `
+support-bundle version1.0.0, command parameter:
+
+support-bundle -o /tmp -max 50 -sn devSn -upload http://host:8080/upload -f /path/file
+-o: output directory, default /tmp
+-max: max bundle content size MB(before compress), default 50
+-sn: device sn, default hostname
+-upload: HttpFileServer upload url, upload bundle after collect
+-f: extra file or directory to collect, multiple groups
+-keep: keep local bundle after upload
+-tail: lines of docker logs for each container, default 2000
+
+run on the edge node host, logs and monitor/app files of each container are collected
+with docker logs, docker exec and docker cp.
+
+example:
+support-bundle
+support-bundle -sn TTU0001 -upload http://192.168.1.10:8080/upload
+`
+
+const defMonitorFolder string = "/usr/local/monitor"
+const defAppsExtFolder string = "/usr/local/extapps"
+const defAppsLogFolder string = "/var/log/extapps"
+const defDumpFolder string = "/var/log/extapps-dump"
+const defFileMaxSize int64 = 5 * 1024 * 1024
+const defCmdTimeout time.Duration = 10 * time.Second
+const defCopyTimeout time.Duration = 60 * time.Second
+
+type StringArray []string
+
+func (s *StringArray) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *StringArray) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// 按顺序收集，前面的内容优先，超过总大小后剩余的只记录到 summary.txt
+type bundleWriter struct {
+	tw      *tar.Writer
+	prefix  string
+	total   int64
+	max     int64
+	skipped []string
+	now     time.Time
+}
+
+type bundleCmd struct {
+	name string
+	args []string
+}
+
+type bundleContainer struct {
+	id      string
+	name    string
+	running bool
+	monitor bool
+}
+
+// 在 appctl-daemon 所在的容器中执行
+var gAppctlCmdList = []bundleCmd{
+	{"appctl-list.json", []string{"appctl", "-list", "-o", "json"}},
+	{"appctl-daemon.json", []string{"appctl", "-daemon", "-o", "json"}},
+	{"appctl-reconcile.json", []string{"appctl", "-reconcile", "-o", "json"}},
+	{"appctl-events.txt", []string{"appctl", "-events", "--limit", "80"}},
+}
+
+var gCmdList = []bundleCmd{
+	{"ps.txt", []string{"ps", "-ef"}},
+	{"df.txt", []string{"df", "-h"}},
+	{"free.txt", []string{"free"}},
+	{"uptime.txt", []string{"uptime"}},
+	{"ip-addr.txt", []string{"ip", "addr"}},
+	{"docker-info.txt", []string{"docker", "info"}},
+	{"docker-ps.txt", []string{"docker", "ps", "-a"}},
+	{"docker-images.txt", []string{"docker", "images", "--digests"}},
+	{"docker-stats.txt", []string{"docker", "stats", "--no-stream"}},
+	{"docker-journal.txt", []string{"journalctl", "-u", "docker", "-n", "1000", "--no-pager"}},
+	{"containerd-journal.txt", []string{"journalctl", "-u", "containerd", "-n", "500", "--no-pager"}},
+	{"kubelet-status.txt", []string{"systemctl", "status", "kubelet", "--no-pager"}},
+	{"kubelet-journal.txt", []string{"journalctl", "-u", "kubelet", "-n", "500", "--no-pager"}},
+	{"kubectl-pods.txt", []string{"kubectl", "get", "pods", "--all-namespaces", "-o", "wide"}},
+}
+
+var gProcList = []string{"loadavg", "meminfo", "cpuinfo", "uptime", "version", "mounts", "stat", "diskstats", "net/dev"}
+
+var gConfigList = []string{
+	"/var/lib/kubelet/config.yaml",
+	"/etc/kubernetes/kubelet.conf",
+	"/etc/kubernetes/bootstrap-kubelet.conf",
+	"/etc/kubernetes/manifests",
+	"/etc/docker/daemon.json",
+	"/etc/hosts",
+}
+
+// 敏感内容统一替换为 <redacted>
+var gRedactList = []*regexp.Regexp{
+	regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`(?i)("?[\w.-]*(password|passwd|secret|token|apikey|api_key|private[_-]?key|client-key-data|client-certificate-data|certificate-authority-data|authorization)[\w.-]*"?\s*[:=]\s*)("[^"]*"|[^\s,}]+)`),
+}
+
+func main() {
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	out := flagSet.String("o", "/tmp", "output directory")
+	max := flagSet.Int("max", 50, "max bundle size MB")
+	sn := flagSet.String("sn", "", "device sn")
+	upload := flagSet.String("upload", "", "upload url")
+	keep := flagSet.Bool("keep", false, "keep local bundle after upload")
+	tail := flagSet.Int("tail", 2000, "docker logs lines")
+	extra := StringArray{}
+	flagSet.Var(&extra, "f", "extra file")
+	err := flagSet.Parse(os.Args[1:])
+	if err != nil || *max <= 0 {
+		fmt.Print(help)
+		os.Exit(1)
+	}
+
+	if len(*sn) == 0 {
+		*sn, _ = os.Hostname()
+	}
+	now := time.Now()
+	name := fmt.Sprintf("support-%s-%s", *sn, now.Format("20060102-150405"))
+	fn := filepath.Join(*out, name+".tar.gz")
+	err = collectBundle(fn, name, int64(*max)*1024*1024, *tail, extra)
+	if err != nil {
+		fmt.Println("collect support bundle error: ", err)
+		os.Remove(fn)
+		os.Exit(1)
+	}
+	fmt.Println(fn)
+
+	if len(*upload) == 0 {
+		return
+	}
+	err = uploadBundle(*upload, fn, *sn)
+	if err != nil {
+		fmt.Println("upload support bundle error: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("upload success: ", *upload)
+	if !*keep {
+		os.Remove(fn)
+	}
+}
+
+func collectBundle(fn, name string, max int64, tail int, extra []string) error {
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	bw := &bundleWriter{tw: tar.NewWriter(gz), prefix: name, max: max, now: time.Now()}
+
+	for _, v := range gCmdList {
+		bw.addData("cmd/"+v.name, runCmd(v.args))
+	}
+	for _, v := range gProcList {
+		data, err := ioutil.ReadFile("/proc/" + v)
+		if err == nil {
+			bw.addData("proc/"+v, data)
+		}
+	}
+
+	// 在容器中运行时直接读取本地文件
+	if _, err := exec.LookPath("appctl"); err == nil {
+		for _, v := range gAppctlCmdList {
+			bw.addData("cmd/"+v.name, runCmd(v.args))
+		}
+	}
+	bw.addPath(defMonitorFolder, "monitor", isMonitorFile)
+	bw.addPath(defAppsExtFolder, "extapps", isAppCfgFile)
+
+	// 各容器的标准输出日志，appctl-daemon 和应用的日志都在这里；monitor 容器再收集配置、事件日志
+	containers := listContainers()
+	for _, c := range containers {
+		bw.addContainer(c, tail)
+	}
+	for _, v := range gConfigList {
+		bw.addPath(v, "config"+v, nil)
+	}
+	for _, v := range extra {
+		bw.addPath(v, "extra"+filepath.Clean("/"+v), nil)
+	}
+
+	// 应用日志和 dump 最大，放在最后
+	bw.addPath(defAppsLogFolder, "applogs", isAppLogFile)
+	for _, c := range containers {
+		if c.monitor {
+			bw.addContainerPath(c, defAppsLogFolder, "applogs", isAppLogFile)
+		}
+	}
+	bw.addPath(defDumpFolder, "dumps", nil)
+	for _, c := range containers {
+		if c.monitor {
+			bw.addContainerPath(c, defDumpFolder, "dumps", nil)
+		}
+	}
+
+	var summary bytes.Buffer
+	fmt.Fprintf(&summary, "time: %s\ntotal: %d bytes, max: %d bytes\n", bw.now.Format(time.RFC3339), bw.total, bw.max)
+	if len(bw.skipped) > 0 {
+		fmt.Fprintf(&summary, "\nskipped (size cap):\n%s\n", strings.Join(bw.skipped, "\n"))
+	}
+	bw.max = -1
+	bw.addData("summary.txt", summary.Bytes())
+
+	err = bw.tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+func isMonitorFile(path string) bool {
+	base := filepath.Base(path)
+	return strings.Contains(base, ".log") || strings.HasSuffix(base, ".cfg") || strings.HasSuffix(base, ".yaml")
+}
+
+func isAppCfgFile(path string) bool {
+	base := filepath.Base(path)
+	return base == "app.cfg" || base == "version.cfg" || strings.HasPrefix(base, "event.log")
+}
+
+func isAppLogFile(path string) bool {
+	return !strings.HasSuffix(path, ".tar.gz")
+}
+
+// 包括已退出的容器，有 monitor.cfg 的为 monitor 容器，docker cp 对已退出的容器也可用
+func listContainers() []bundleContainer {
+	var lst []bundleContainer
+	out, err := exec.Command("docker", "ps", "-a", "--no-trunc", "--format", "{{.ID}}\t{{.Names}}\t{{.Status}}").Output()
+	if err != nil {
+		return lst
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		c := bundleContainer{id: fields[0], name: fields[1], running: strings.HasPrefix(fields[2], "Up")}
+		c.monitor = exec.Command("docker", "cp", c.id+":"+defMonitorFolder+"/monitor.cfg", "-").Run() == nil
+		lst = append(lst, c)
+	}
+	return lst
+}
+
+func (bw *bundleWriter) addContainer(c bundleContainer, tail int) {
+	dir := "containers/" + c.name + "/"
+	bw.addData(dir+"inspect.json", runCmd([]string{"docker", "inspect", c.id}))
+	bw.addData(dir+"logs.txt", runCmd([]string{"docker", "logs", "--timestamps", "--tail", fmt.Sprint(tail), c.id}))
+	if !c.monitor {
+		return
+	}
+	for _, v := range gAppctlCmdList {
+		if c.running {
+			bw.addData(dir+"cmd/"+v.name, runCmd(append([]string{"docker", "exec", c.id}, v.args...)))
+		}
+	}
+	bw.addContainerPath(c, defMonitorFolder, "monitor", isMonitorFile)
+	bw.addContainerPath(c, defAppsExtFolder, "extapps", isAppCfgFile)
+}
+
+// docker cp 输出 tar 流，按 filter 过滤后放到 containers/<name>/<name> 下
+func (bw *bundleWriter) addContainerPath(c bundleContainer, path, name string, filter func(string) bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), defCopyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker", "cp", c.id+":"+path+"/.", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	defer cmd.Wait()
+
+	var files []string
+	data := make(map[string][]byte)
+	tr := tar.NewReader(stdout)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		fn := filepath.Clean("/" + hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || (filter != nil && !filter(fn)) {
+			continue
+		}
+		// 单个文件只保留末尾 defFileMaxSize
+		if hdr.Size > defFileMaxSize {
+			io.CopyN(ioutil.Discard, tr, hdr.Size-defFileMaxSize)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			break
+		}
+		files = append(files, fn)
+		data[fn] = content
+	}
+	io.Copy(ioutil.Discard, stdout)
+
+	sort.Strings(files)
+	for _, fn := range files {
+		bw.addData("containers/"+c.name+"/"+name+fn, data[fn])
+	}
+}
+
+// 目录按文件名排序递归收集，filter 返回 false 的文件跳过
+func (bw *bundleWriter) addPath(path, name string, filter func(string) bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		if filter == nil || filter(path) {
+			bw.addFile(path, name)
+		}
+		return
+	}
+
+	var files []string
+	filepath.Walk(path, func(fn string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if filter == nil || filter(fn) {
+			files = append(files, fn)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	for _, v := range files {
+		rel, _ := filepath.Rel(path, v)
+		bw.addFile(v, filepath.Join(name, rel))
+	}
+}
+
+// 单个文件只保留末尾 defFileMaxSize
+func (bw *bundleWriter) addFile(fn, name string) {
+	fl, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer fl.Close()
+	fi, err := fl.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() > defFileMaxSize {
+		fl.Seek(fi.Size()-defFileMaxSize, io.SeekStart)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(fl, defFileMaxSize))
+	if err != nil {
+		return
+	}
+	bw.addData(name, data)
+}
+
+func (bw *bundleWriter) addData(name string, data []byte) {
+	data = redact(data)
+	if bw.max >= 0 && bw.total+int64(len(data)) > bw.max {
+		bw.skipped = append(bw.skipped, fmt.Sprintf("%s (%d bytes)", name, len(data)))
+		return
+	}
+
+	hdr := &tar.Header{Name: bw.prefix + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: bw.now}
+	err := bw.tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = bw.tw.Write(data)
+	}
+	if err != nil {
+		fmt.Println("write bundle error: ", name, err)
+		return
+	}
+	bw.total += int64(len(data))
+}
+
+// 二进制内容不做替换
+func redact(data []byte) []byte {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return data
+	}
+	data = gRedactList[0].ReplaceAll(data, []byte("<redacted private key>"))
+	return gRedactList[1].ReplaceAll(data, []byte("${1}<redacted>"))
+}
+
+// 命令不存在或超时时把错误写入输出，便于区分
+func runCmd(args []string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), defCmdTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = append(out, []byte(fmt.Sprintf("\n# %s: %s\n", strings.Join(args, " "), err.Error()))...)
+	}
+	return out
+}
+
+// 上传参数与 HttpFileServer /upload 一致：file、md5Code、oldFileName、devSn
+func uploadBundle(url, fn, sn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("md5Code", hex.EncodeToString(sum[:]))
+	w.WriteField("oldFileName", filepath.Base(fn))
+	w.WriteField("devSn", sn)
+	part, err := w.CreateFormFile("file", filepath.Base(fn))
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	rsp, err := client.Post(url, w.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	ret, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s", rsp.Status, strings.TrimSpace(string(ret)))
+	}
+	return nil
+}